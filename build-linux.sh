@@ -7,6 +7,7 @@ set -e
 APP_NAME="whatsapp-web-api"
 VERSION=${1:-"latest"}
 BUILD_DIR="releases"
+GIT_COMMIT=$(git rev-parse --short HEAD 2>/dev/null || echo "unknown")
 
 # Colors
 GREEN='\033[0;32m'
@@ -41,7 +42,7 @@ for platform in "${platforms[@]}"; do
 
     print_status "Building for $GOOS/$GOARCH..."
 
-    GOOS=$GOOS GOARCH=$GOARCH go build -ldflags="-w -s" -o "$BUILD_DIR/$OUTPUT_NAME" .
+    GOOS=$GOOS GOARCH=$GOARCH go build -ldflags="-w -s -X main.gitCommit=$GIT_COMMIT" -o "$BUILD_DIR/$OUTPUT_NAME" .
 
     # Create tar.gz archive for Linux
     cd $BUILD_DIR
@@ -3,9 +3,11 @@ module whatsapp-web-api
 go 1.24.3
 
 require (
+	github.com/HugoSmits86/nativewebp v0.9.3
 	github.com/gorilla/mux v1.8.1
 	github.com/joho/godotenv v1.5.1
 	github.com/lib/pq v1.10.9
+	github.com/nyaruka/phonenumbers v1.6.5
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	go.mau.fi/whatsmeow v0.0.0-20251024191251-088fa33fb87f
 	golang.org/x/image v0.32.0
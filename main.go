@@ -1,878 +1,11546 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
 	"image/png"
 	"io"
 	"log"
+	"maps"
+	mathrand "math/rand/v2"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/HugoSmits86/nativewebp"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
+	"github.com/nyaruka/phonenumbers"
 	"github.com/skip2/go-qrcode"
 	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/appstate"
 	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/proto/waSyncAction"
+	"go.mau.fi/whatsmeow/store"
 	"go.mau.fi/whatsmeow/store/sqlstore"
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
 	waLog "go.mau.fi/whatsmeow/util/log"
+	"golang.org/x/image/draw"
 	"golang.org/x/image/webp"
 	"google.golang.org/protobuf/proto"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+)
+
+const (
+	// Directory incoming images are saved to and served from by /images
+	downloadDir = "downloads"
+	// Stickers are square WebP images of this size
+	stickerSize = 512
+	// Thumbnails of quoted orders are scaled to fit a square of this size
+	orderThumbnailSize = 100
+	// Longest order title shown in a quoted order
+	maxOrderTitleLength = 100
+	// Default time allowed for a webhook request, overridden by WA_WEBHOOK_TIMEOUT
+	defaultWebhookTimeout = 10 * time.Second
+	// How long a finished background job stays available at /jobs/{id}
+	finishedJobTTL = time.Hour
+	// How long the full body of a webhook that was too large stays available at /webhook/payloads/{id}
+	oversizedPayloadTTL = time.Hour
+	// Most full webhook bodies kept at once; the one closest to expiring makes room for a new one
+	maxOversizedPayloads = 100
+	// Fields up to this many bytes are never left out of an oversized webhook
+	minOmittedFieldSize = 256
+	// Default delay before the first webhook retry; it doubles with every further retry
+	defaultWebhookBackoff = 2 * time.Second
+	// Upper bound for webhook retries per event, so a misconfiguration can't retry forever
+	maxWebhookRetries = 10
+	// Most undelivered webhooks kept as dead letters; the oldest are dropped beyond it
+	maxDeadLetters = 10000
+	// Dead letters replayed per request by default and at most
+	defaultDeadLetterReplay = 100
+	maxDeadLetterReplay     = 1000
+	// Default longest time a typing indicator is shown, overridden by WA_TYPING_TIMEOUT
+	defaultTypingTimeout = 30 * time.Second
+	// Default pause after WhatsApp signals rate limiting, overridden by WA_RATE_LIMIT_COOLDOWN
+	defaultRateLimitCooldown = 15 * time.Minute
+	// Pause after a temporary ban that doesn't say when it ends
+	defaultBanCooldown = time.Hour
+	// Default number of incoming media downloads that run at once, overridden by WA_MAX_CONCURRENT_DOWNLOADS
+	defaultMaxConcurrentDownloads = 4
+	// Automatic media downloads that can wait for a download worker; beyond that, message handling waits too
+	maxQueuedDownloads = 1000
+	// Default file name for downloaded media, see downloadFilename
+	defaultDownloadNameTemplate = "{id}.{ext}"
+	// JPEG quality used when converting incoming images
+	jpegQuality = 85
+	// WhatsApp lets messages be deleted for everyone for "about two days"; older ones are refused
+	revokeWindow = 48 * time.Hour
+	// Goes between a message's own text and the footer
+	footerSeparator = "\n\n"
+	// How long /pair waits for WhatsApp to produce a QR code
+	qrTimeout = 15 * time.Second
+	// Account ID of the global client, which the unprefixed endpoints act on
+	defaultAccountID = "default"
+	// How long /reconnect waits for the session to log in again
+	reconnectTimeout = 15 * time.Second
+	// How long /groups waits for WhatsApp to list the joined groups
+	groupListTimeout = 30 * time.Second
+	// Maximum duration of a single ffmpeg transcode
+	transcodeTimeout = 2 * time.Minute
+	// Longest pause allowed between the messages of one /send
+	maxSendDelay = 10 * time.Second
+	// Number of media items WhatsApp accepts in one album
+	minAlbumItems = 2
+	maxAlbumItems = 30
+	// How long a sender's business verification lookup is reused
+	businessCacheTTL = 24 * time.Hour
+	// How long a sender whose verification lookup failed is treated as unverified before asking again
+	businessLookupRetry = 5 * time.Minute
+	// How long the latest WhatsApp Web version looked up from web.whatsapp.com is reused
+	latestVersionCacheTTL = 6 * time.Hour
+	// How long /send-if-active waits for a contact's presence after subscribing to it
+	presenceWaitTimeout = 5 * time.Second
+	// How long a location request waits for the recipient to share their location
+	locationRequestTTL = 24 * time.Hour
+	// How often a failed app state sync is retried, e.g. while waiting for the phone to share missing keys
+	appStateRetryDelay = 30 * time.Second
+	appStateMaxRetries = 10
+	// How long to wait for the rest of an album before forwarding the items received so far
+	albumWaitTimeout = 10 * time.Second
 )
 
 var (
 	client     *whatsmeow.Client
+	db         *sql.DB
 	qrChannel  chan string
 	webhookURL string
 	isPaired   bool   = false
 	version    string = "v1.7.0"
+	startTime         = time.Now()
+
+	// Set at build time with -ldflags "-X main.gitCommit=$(git rev-parse --short HEAD)"
+	gitCommit = "unknown"
+
+	// Key required by every endpoint but /health and the API docs (API_KEY); open when empty
+	apiKey string
+
+	// Client for fetching attachments by URL; per-host download headers are swapped on redirects
+	downloadClient = &http.Client{CheckRedirect: redirectDownloadHeaders}
+
+	// Shared client for webhook delivery so connections to the receiver are reused
+	webhookClient = &http.Client{
+		Timeout: defaultWebhookTimeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 20,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+
+	// Longest time a typing indicator stays on if clearing it after a send is missed, set from WA_TYPING_TIMEOUT
+	typingTimeout = defaultTypingTimeout
+
+	// How long to stay away after WhatsApp signals rate limiting, set from WA_RATE_LIMIT_COOLDOWN
+	rateLimitCooldown = defaultRateLimitCooldown
+
+	// Cool-down of the default account after a temporary ban or rate limit signal; sends and
+	// reconnects are refused until it ends. Additional accounts have their own.
+	defaultCooldown = &sendCooldown{account: defaultAccountID, client: func() *whatsmeow.Client { return client }}
+
+	// Webhook retry policies, configured via WA_WEBHOOK_RETRIES and /config/webhook-retry
+	webhookRetries = &webhookRetryConfig{
+		fallback: webhookRetryPolicy{BackoffSeconds: defaultWebhookBackoff.Seconds()},
+		events:   make(map[string]webhookRetryPolicy),
+	}
+
+	// Webhook body signing, configured via WA_WEBHOOK_SECRET and /config/webhook-secret
+	webhookSecret = &webhookSigner{}
+
+	// Outgoing message pacing, configured via WA_RATE_LIMIT and /config/rate-limit
+	sendLimiter = &rateLimiter{}
+
+	// Held while /reconnect is cycling the connection so concurrent calls don't interleave
+	reconnectMu sync.Mutex
+
+	// Session store shared by the default account and the additional ones under /accounts/{id}/
+	storeContainer *sqlstore.Container
+	accounts       = &sessionManager{sessions: make(map[string]*accountSession)}
+	accountIDRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+	// HTTP header field names are RFC 9110 tokens
+	headerNameRegex = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+	// Hosts download headers are configured for: a host name, or *.domain for its subdomains
+	downloadHostRegex = regexp.MustCompile(`^(\*\.)?[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+	// Spam filter rules from filter_rules, reloaded whenever they change
+	filterRules   []FilterRule
+	filterRulesMu sync.RWMutex
+
+	// Media transfer counters since process start
+	bytesUploaded   atomic.Int64
+	bytesDownloaded atomic.Int64
+	uploadCount     atomic.Int64
+	downloadCount   atomic.Int64
+
+	// Messages that failed to decrypt, and how many of them arrived after all once resent
+	undecryptableCount     atomic.Int64
+	undecryptableRecovered atomic.Int64
+
+	// Automatic media downloads waiting for one of downloadWorkers workers (WA_MAX_CONCURRENT_DOWNLOADS)
+	downloadQueue   = make(chan func(), maxQueuedDownloads)
+	downloadWorkers = defaultMaxConcurrentDownloads
+	downloadsActive atomic.Int32
+
+	// File name scheme for downloaded media, set from WA_DOWNLOAD_NAME_TEMPLATE
+	downloadNameTemplate = defaultDownloadNameTemplate
+
+	// Set from WA_ENABLE_TRANSCODE when ffmpeg is available
+	transcodeEnabled bool
+
+	// Whether stored messages and downloaded media are removed when a chat is cleared or deleted on the phone (WA_PURGE_CLEARED_CHATS)
+	purgeClearedChats bool
+
+	// Whether incoming messages are marked as read as soon as they arrive (WA_AUTO_READ, default on)
+	autoRead atomic.Bool
+
+	// Whether messages sent through the API or from the phone are stored alongside incoming ones (WA_STORE_OUTGOING)
+	storeOutgoing atomic.Bool
+
+	// Text appended to outgoing texts and captions, e.g. an automated-message disclosure (WA_MESSAGE_FOOTER)
+	messageFooter atomic.Pointer[string]
+
+	// User-Agent and extra headers sent when fetching attachments by URL (WA_DOWNLOAD_USER_AGENT, WA_DOWNLOAD_HEADERS)
+	downloadHeaders atomic.Pointer[downloadHeaderConfig]
+
+	// Whether incoming media is downloaded as it arrives (WA_AUTO_DOWNLOAD, default on)
+	autoDownload atomic.Bool
+
+	// Largest incoming media file (bytes) downloaded automatically, 0 for no limit (WA_AUTO_DOWNLOAD_MAX_SIZE)
+	autoDownloadMaxSize atomic.Int64
+
+	// Whether a typing indicator is shown while messages are sent (WA_AUTO_TYPING, default on)
+	autoTyping atomic.Bool
+
+	// Largest webhook body (bytes) sent as is, 0 for no limit (WA_WEBHOOK_MAX_PAYLOAD); larger
+	// payloads lose their biggest fields, and the full payload is kept for a while to be fetched
+	webhookMaxPayload   int
+	oversizedPayloads   = make(map[string]oversizedPayload)
+	oversizedPayloadsMu sync.Mutex
+
+	// Address this service is reached at from outside, e.g. https://wa.example.com (WA_PUBLIC_URL);
+	// links handed out in webhooks are made absolute with it
+	publicURL string
+
+	// Disappearing-message timers (seconds) per chat JID, learned from incoming messages
+	chatTimers   = make(map[string]uint32)
+	chatTimersMu sync.RWMutex
+
+	// Group metadata fetched from WhatsApp, dropped again when a group info event reports a change
+	groupCache   = make(map[types.JID]*types.GroupInfo)
+	groupCacheMu sync.RWMutex
+
+	// Verified business names by sender ("" for senders that aren't verified businesses)
+	businessCache   = make(map[types.JID]businessCacheEntry)
+	businessCacheMu sync.Mutex
+
+	// Outstanding location requests by chat JID, so the shared location can be tied back to the request
+	locationRequests   = make(map[string]locationRequest)
+	locationRequestsMu sync.Mutex
+
+	// Albums whose items are still arriving, keyed by chat and album message ID
+	pendingAlbums   = make(map[string]*pendingAlbum)
+	pendingAlbumsMu sync.Mutex
+
+	// Recently handled incoming message IDs, so redelivered events reach the webhook only once
+	messageDedup = &dedupCache{ttl: 10 * time.Minute, seen: make(map[string]time.Time)}
+
+	// IDs of messages sent through the API, so their echo from the phone isn't reported as message_sent
+	sentMessages = &dedupCache{ttl: time.Hour, seen: make(map[string]time.Time)}
+
+	// Outcome of the last app state sync per patch type, reported by /diagnostics
+	appStateSync   = make(map[appstate.WAPatchName]*appStateSyncState)
+	appStateSyncMu sync.Mutex
+
+	// Background jobs started through the API, reported by /jobs/{id}
+	jobs   = make(map[string]*backgroundJob)
+	jobsMu sync.Mutex
+
+	// Presence announced after every connect (WA_PRESENCE, default available) and the outcome of the last announcement
+	accountPresence = types.PresenceAvailable
+	presenceSentAt  time.Time
+	presenceError   string
+	presenceMu      sync.Mutex
+
+	// Latest presence of contacts we subscribed to, and requests waiting for a contact's first update
+	contactPresences       = make(map[types.JID]contactPresence)
+	contactPresenceWaiters = make(map[types.JID][]chan struct{})
+	contactPresencesMu     sync.Mutex
+
+	// Chats whose typing notifications we subscribed to, renewed after every connect
+	presenceSubscriptions   = make(map[types.JID]bool)
+	presenceSubscriptionsMu sync.Mutex
+
+	// Latest view and reaction counts of channel posts, by channel and server ID
+	newsletterMetrics   = make(map[types.JID]map[types.MessageServerID]*NewsletterPostMetrics)
+	newsletterMetricsMu sync.Mutex
+
+	// Channels we receive live metric updates for, with the timer that renews each subscription
+	newsletterSubscriptions   = make(map[types.JID]*time.Timer)
+	newsletterSubscriptionsMu sync.Mutex
+
+	// Catch-up on the events missed while offline, reported by /diagnostics
+	offlineSync   offlineSyncState
+	offlineSyncMu sync.Mutex
+
+	// Client version checks reported by /diagnostics: when WhatsApp last rejected our version (zero
+	// once a connection succeeds again) and the cached latest version of WhatsApp Web
+	clientOutdatedAt     time.Time
+	latestVersion        store.WAVersionContainer
+	latestVersionChecked time.Time
+	latestVersionError   string
+	clientVersionMu      sync.Mutex
+
+	// Outcome of the last QR pairing attempt, reported by /diagnostics
+	pairingEvent string
+	pairingError string
+	pairingKind  string
+	pairingAt    time.Time
+	pairingMu    sync.Mutex
 )
 
-// Response structures for API
-type APIResponse struct {
-	Success bool        `json:"success"`
-	Message string      `json:"message"`
-	Data    interface{} `json:"data,omitempty"`
+// NewsletterPostMetrics holds the latest engagement counts of a channel post
+type NewsletterPostMetrics struct {
+	ServerID  types.MessageServerID `json:"server_id"`
+	MessageID string                `json:"message_id,omitempty"`
+	Views     int                   `json:"views"`
+	Reactions map[string]int        `json:"reactions"`
+	UpdatedAt time.Time             `json:"updated_at"`
 }
 
-type Attachment struct {
-	Type     string `json:"type"`     // image, document, audio, video
-	URL      string `json:"url"`      // URL or base64 data
-	Filename string `json:"filename"` // optional filename for documents
-	Caption  string `json:"caption"`  // optional caption
+// offlineSyncState tracks the delivery of events queued on the server while we were disconnected
+type offlineSyncState struct {
+	State       string // syncing, completed or interrupted
+	Expected    events.OfflineSyncPreview
+	Delivered   int // events the server reported as sent when it finished
+	Messages    int // messages handled while syncing
+	StartedAt   time.Time
+	CompletedAt time.Time
 }
 
-type SendRequest struct {
-	Number      string       `json:"number"`
-	Message     string       `json:"message"`
-	Attachments []Attachment `json:"attachments,omitempty"`
+// backgroundJob tracks the progress of a long running task such as a chat media download
+type backgroundJob struct {
+	mu         sync.Mutex
+	ID         string
+	Type       string
+	Chat       string
+	Status     string // running, completed or failed
+	Total      int
+	Downloaded int
+	Skipped    int
+	Failed     int
+	Errors     []string
+	StartedAt  time.Time
+	FinishedAt *time.Time
 }
 
-type WebhookPayload struct {
-	Event      string                 `json:"event"`
-	Message    string                 `json:"message,omitempty"`
-	Sender     string                 `json:"sender,omitempty"`
-	Chat       string                 `json:"chat,omitempty"`
-	Time       time.Time              `json:"time"`
-	Attachment map[string]interface{} `json:"attachment,omitempty"`
+// newJob registers a running job and returns it
+func newJob(jobType, chat string) *backgroundJob {
+	id := make([]byte, 8)
+	rand.Read(id)
+	job := &backgroundJob{
+		ID:        hex.EncodeToString(id),
+		Type:      jobType,
+		Chat:      chat,
+		Status:    "running",
+		StartedAt: time.Now(),
+	}
+
+	jobsMu.Lock()
+	jobs[job.ID] = job
+	jobsMu.Unlock()
+	return job
 }
 
-func getDatabaseURL() string {
-	// Load .env file if it exists
-	err := godotenv.Load()
-	if err != nil {
-		log.Println("Warning: .env file not found, using environment variables")
-	}
+// update applies fn to the job while holding its lock
+func (j *backgroundJob) update(fn func(j *backgroundJob)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(j)
+}
 
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		log.Fatal("DATABASE_URL environment variable is not set. Please set it in .env file or as environment variable")
-	}
+// finish marks the job as done, failed when err is set, and forgets it after finishedJobTTL
+func (j *backgroundJob) finish(err error) {
+	j.update(func(j *backgroundJob) {
+		now := time.Now()
+		j.FinishedAt = &now
+		j.Status = "completed"
+		if err != nil {
+			j.Status = "failed"
+			j.Errors = append(j.Errors, err.Error())
+		}
+	})
 
-	// Parse the URL to check if sslmode is specified
-	parsedURL, err := url.Parse(dbURL)
-	if err != nil {
-		log.Fatalf("Invalid DATABASE_URL format: %v", err)
-	}
+	time.AfterFunc(finishedJobTTL, func() {
+		jobsMu.Lock()
+		delete(jobs, j.ID)
+		jobsMu.Unlock()
+	})
+}
 
-	// Check if sslmode is already in the query parameters
-	query := parsedURL.Query()
-	if !query.Has("sslmode") {
-		// Add sslmode=disable if not present
-		query.Set("sslmode", "disable")
-		parsedURL.RawQuery = query.Encode()
-		log.Println("Note: Automatically added sslmode=disable to DATABASE_URL")
+// Snapshot returns a copy of the job that is safe to encode while it keeps running
+func (j *backgroundJob) Snapshot() map[string]interface{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	snapshot := map[string]interface{}{
+		"id":         j.ID,
+		"type":       j.Type,
+		"chat":       j.Chat,
+		"status":     j.Status,
+		"total":      j.Total,
+		"downloaded": j.Downloaded,
+		"skipped":    j.Skipped,
+		"failed":     j.Failed,
+		"started_at": j.StartedAt,
 	}
-
-	return parsedURL.String()
+	if len(j.Errors) > 0 {
+		snapshot["errors"] = append([]string(nil), j.Errors...)
+	}
+	if j.FinishedAt != nil {
+		snapshot["finished_at"] = *j.FinishedAt
+	}
+	return snapshot
 }
 
-func initializeWhatsApp() {
-	log.Println("=== INITIALIZING WHATSAPP CLIENT ===")
+// dedupCache remembers message IDs for ttl so duplicate deliveries can be skipped
+type dedupCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	seen    map[string]time.Time
+	order   []dedupEntry // in the order keys were recorded, which is also the order they expire in
+	skipped int64
+}
 
-	// Get database URL from environment
-	dbURL := getDatabaseURL()
+type dedupEntry struct {
+	key string
+	at  time.Time
+}
 
-	// Create database container with PostgreSQL
-	storeContainer, err := sqlstore.New(context.Background(), "postgres", dbURL, waLog.Stdout("Database", "INFO", true))
-	if err != nil {
-		log.Fatalf("Failed to create database container: %v", err)
+// Seen records key and reports whether it was already recorded within ttl
+func (c *dedupCache) Seen(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.evict(now)
+	if _, ok := c.seen[key]; ok {
+		c.skipped++
+		return true
 	}
+	c.record(key, now)
+	return false
+}
 
-	// Get device store
-	deviceStore, err := storeContainer.GetFirstDevice(context.Background())
-	if err != nil {
-		log.Fatalf("Failed to get device store: %v", err)
-	}
+// Add records key without counting it as a duplicate
+func (c *dedupCache) Add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.evict(now)
+	c.record(key, now)
+}
 
-	// Create WhatsApp client
-	clientLog := waLog.Stdout("Client", "INFO", true)
-	client = whatsmeow.NewClient(deviceStore, clientLog)
+// SeenAt reports when key was recorded, if that was within ttl, without recording it
+func (c *dedupCache) SeenAt(key string) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict(time.Now())
+	at, ok := c.seen[key]
+	return at, ok
+}
 
-	// Add event handlers
-	client.AddEventHandler(handler)
+// Forget removes key, e.g. for a message whose send failed
+func (c *dedupCache) Forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Its entry in order is skipped when it expires, as the times no longer match
+	delete(c.seen, key)
+}
 
-	// Check if already paired and attempt connection with better error handling
-	if client.Store.ID != nil {
-		log.Printf("Found existing session for device: %s", client.Store.ID.String())
-		isPaired = true
+func (c *dedupCache) record(key string, now time.Time) {
+	c.seen[key] = now
+	c.order = append(c.order, dedupEntry{key: key, at: now})
+}
 
-		// Attempt to connect to existing session
-		log.Println("Attempting to connect to existing session...")
-		err = client.Connect()
-		if err != nil {
-			log.Printf("Failed to connect to existing session: %v", err)
-			log.Println("💡 This could be due to:")
-			log.Println("   - Device being disconnected from WhatsApp mobile app")
-			log.Println("   - Device limit exceeded on WhatsApp account")
-			log.Println("   - Network connectivity issues")
-			log.Println("   - Session corruption")
-			log.Println("💡 Use /pair endpoint to create a new session")
-			isPaired = false
-		} else {
-			log.Println("🟢 Successfully connected to WhatsApp with existing session")
+// evict drops expired keys from the front of order, so the cache doesn't grow without bound
+// and only expired entries are looked at
+func (c *dedupCache) evict(now time.Time) {
+	n := 0
+	for n < len(c.order) && now.Sub(c.order[n].at) >= c.ttl {
+		entry := c.order[n]
+		if at, ok := c.seen[entry.key]; ok && at.Equal(entry.at) {
+			delete(c.seen, entry.key)
 		}
-	} else {
-		log.Println("No existing session found - use /pair endpoint to create one")
+		n++
 	}
+	c.order = c.order[n:]
+}
 
-	// Get webhook URL from environment
-	webhookURL = os.Getenv("WA_WEBHOOK_URL")
-	if webhookURL != "" {
-		log.Println("Webhook URL configured:", webhookURL)
+// Clear empties the cache and returns how many entries were removed
+func (c *dedupCache) Clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.seen)
+	c.seen = make(map[string]time.Time)
+	c.order = nil
+	return n
+}
+
+func (c *dedupCache) Stats() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]interface{}{
+		"size":        len(c.seen),
+		"skipped":     c.skipped,
+		"ttl_seconds": int(c.ttl.Seconds()),
 	}
+}
 
-	log.Println("=== WHATSAPP CLIENT INITIALIZATION COMPLETE ===")
+// rateLimiter spaces outgoing messages evenly so no more than perMinute are sent per minute.
+// A limit of 0 disables pacing.
+type rateLimiter struct {
+	mu        sync.Mutex
+	perMinute int
+	next      time.Time
 }
 
-// /pair endpoint - generate QR code for pairing
-func pairHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("=== PAIRING REQUEST STARTED ===")
+// Wait blocks until the next send slot is available
+func (l *rateLimiter) Wait() {
+	l.mu.Lock()
+	if l.perMinute <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	interval := time.Minute / time.Duration(l.perMinute)
+	now := time.Now()
+	slot := l.next
+	if slot.Before(now) {
+		slot = now
+	}
+	l.next = slot.Add(interval)
+	l.mu.Unlock()
 
-	// If already paired or connected, disconnect and clear session first
-	if client != nil && client.IsConnected() {
-		log.Println("Disconnecting existing session...")
-		client.Disconnect()
-		isPaired = false
-		log.Println("Disconnected from previous session")
+	if delay := time.Until(slot); delay > 0 {
+		log.Printf("Rate limit: waiting %s before sending", delay.Round(time.Millisecond))
+		time.Sleep(delay)
 	}
+}
 
-	// Clear existing session if any
-	if client != nil && client.Store != nil && client.Store.ID != nil {
-		log.Printf("Clearing existing session for device: %s", client.Store.ID.String())
-		err := client.Store.Delete(context.Background())
-		if err != nil {
-			log.Printf("Warning: Failed to clear existing session: %v", err)
-		} else {
-			log.Println("Existing session cleared successfully")
-		}
+func (l *rateLimiter) SetLimit(perMinute int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.perMinute = perMinute
+	// Let the new limit take effect immediately instead of honoring slots reserved under the old one
+	l.next = time.Time{}
+}
+
+func (l *rateLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.perMinute
+}
+
+// webhookSigner signs webhook bodies with HMAC-SHA256. After a rotation the previous secret keeps
+// signing alongside the new one until the grace period ends, so receivers can switch over without
+// rejecting deliveries. An empty secret disables signing.
+type webhookSigner struct {
+	mu            sync.Mutex
+	secret        string
+	previous      string
+	previousUntil time.Time
+}
+
+// Sign returns the X-Webhook-Signature header value for body, or "" when signing is disabled
+func (s *webhookSigner) Sign(body []byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.secret == "" {
+		return ""
 	}
 
-	// Add a small delay to ensure proper disconnection
-	time.Sleep(2 * time.Second)
+	signatures := []string{webhookSignature(s.secret, body)}
+	if s.previous != "" && time.Now().Before(s.previousUntil) {
+		signatures = append(signatures, webhookSignature(s.previous, body))
+	}
+	return strings.Join(signatures, ", ")
+}
 
-	// Get QR channel (must be called before connecting)
-	log.Println("Getting QR channel...")
-	qrChan, err := client.GetQRChannel(context.Background())
-	if err != nil {
-		log.Printf("Failed to get QR channel: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to get QR channel: %v", err), http.StatusInternalServerError)
-		return
+// SetSecret replaces the secret, keeping the old one valid for grace
+func (s *webhookSigner) SetSecret(secret string, grace time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.previous, s.previousUntil = "", time.Time{}
+	if grace > 0 && s.secret != "" && s.secret != secret {
+		s.previous, s.previousUntil = s.secret, time.Now().Add(grace)
 	}
+	s.secret = secret
+}
 
-	// Connect client after getting QR channel
-	log.Println("Connecting to WhatsApp...")
-	err = client.Connect()
-	if err != nil {
-		log.Printf("Failed to connect: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to connect: %v", err), http.StatusInternalServerError)
-		return
+// Status reports whether signing is enabled and until when the previous secret is still used, never the secrets
+func (s *webhookSigner) Status() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := map[string]interface{}{
+		"enabled": s.secret != "",
+	}
+	if s.previous != "" && time.Now().Before(s.previousUntil) {
+		status["previous_valid_until"] = s.previousUntil
 	}
+	return status
+}
 
-	log.Println("Connected successfully, waiting for QR code...")
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
 
-	// Wait for QR code with extended timeout
-	select {
-	case evt := <-qrChan:
-		log.Printf("QR event received: %s", evt.Event)
-		if evt.Event == "code" {
-			qrCode := evt.Code
-			log.Printf("QR code generated, length: %d", len(qrCode))
+// WebhookDeadLetter is a webhook that could not be delivered, kept in webhook_dead_letters for replay
+type WebhookDeadLetter struct {
+	ID       int64           `json:"id"`
+	Event    string          `json:"event"`
+	Payload  json.RawMessage `json:"payload"`
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`
+	FailedAt time.Time       `json:"failed_at"`
+}
 
-			// Generate QR code as PNG image
-			qr, err := qrcode.New(qrCode, qrcode.Medium)
-			if err != nil {
-				log.Printf("Failed to generate QR code: %v", err)
-				http.Error(w, fmt.Sprintf("Failed to generate QR code: %v", err), http.StatusInternalServerError)
-				return
-			}
+// webhookRetryPolicy says how often a failed webhook delivery is retried and how long to wait in between
+type webhookRetryPolicy struct {
+	MaxRetries     int     `json:"max_retries"`
+	BackoffSeconds float64 `json:"backoff_seconds"`
+}
 
-			// Set content type for PNG image
-			w.Header().Set("Content-Type", "image/png")
-			w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-			w.Header().Set("Pragma", "no-cache")
-			w.Header().Set("Expires", "0")
+// webhookRetryConfig holds the default retry policy and per-event overrides
+type webhookRetryConfig struct {
+	mu       sync.Mutex
+	fallback webhookRetryPolicy
+	events   map[string]webhookRetryPolicy
+}
 
-			// Encode and send the image
-			err = png.Encode(w, qr.Image(256))
-			if err != nil {
-				log.Printf("Failed to encode QR image: %v", err)
-				http.Error(w, fmt.Sprintf("Failed to encode QR image: %v", err), http.StatusInternalServerError)
-				return
-			}
+// Policy returns the policy for an event, falling back to the default
+func (c *webhookRetryConfig) Policy(event string) webhookRetryPolicy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if policy, ok := c.events[event]; ok {
+		return policy
+	}
+	return c.fallback
+}
 
-			log.Println("QR code image generated successfully")
-			log.Println("=== PAIRING REQUEST COMPLETED ===")
+// SetDefault replaces the policy used for events without an override
+func (c *webhookRetryConfig) SetDefault(policy webhookRetryPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fallback = policy
+}
 
-			// Handle QR events in background
-			go handleQREvents(qrChan)
-			return
+// SetEvents replaces the per-event overrides; a nil policy removes the override for that event
+func (c *webhookRetryConfig) SetEvents(events map[string]*webhookRetryPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for event, policy := range events {
+		if policy == nil {
+			delete(c.events, event)
 		} else {
-			log.Printf("QR generation error: %s", evt.Event)
-			if evt.Error != nil {
-				log.Printf("QR error details: %v", evt.Error)
-			}
-			http.Error(w, fmt.Sprintf("QR generation error: %s", evt.Event), http.StatusInternalServerError)
-			return
+			c.events[event] = *policy
 		}
-	case <-time.After(15 * time.Second):
-		log.Println("QR code generation timeout after 15 seconds")
-		http.Error(w, "QR code generation timeout - please try again", http.StatusRequestTimeout)
-		return
 	}
 }
 
-func handleQREvents(qrChan <-chan whatsmeow.QRChannelItem) {
-	log.Println("=== QR EVENT HANDLER STARTED ===")
-	for evt := range qrChan {
-		log.Printf("QR Event: %s", evt.Event)
-		switch evt.Event {
-		case "success":
-			isPaired = true
-			log.Println("🎉 Successfully paired with WhatsApp!")
-			log.Printf("Device ID: %s", client.Store.ID.String())
-		case "timeout":
-			log.Println("⏰ QR code pairing timed out.")
-			log.Println("💡 Tips: Check if WhatsApp is open on your phone and try scanning again")
-		case "err-client-outdated":
-			log.Println("🔄 Client is outdated. Please update the application.")
-		case "err-scanned-without-multidevice":
-			log.Println("📱 QR code was scanned but multi-device is not enabled on the phone.")
-			log.Println("💡 Solution: Go to WhatsApp Settings > Linked Devices > Enable multi-device")
-		case "err-device-limit-exceeded":
-			log.Println("🚫 Device limit exceeded on WhatsApp account.")
-			log.Println("💡 Solution: Remove unused devices from WhatsApp Settings > Linked Devices")
-		case "err-already-connected":
-			log.Println("⚠️ Device is already connected to another session.")
-			log.Println("💡 Solution: Disconnect other devices first")
-		case "error":
-			log.Printf("❌ QR pairing error: %v", evt.Error)
-			if evt.Error != nil {
-				log.Printf("Error details: %s", evt.Error.Error())
-			}
-		default:
-			log.Printf("❓ Unknown QR event: %s", evt.Event)
-		}
+func (c *webhookRetryConfig) Snapshot() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	events := make(map[string]webhookRetryPolicy, len(c.events))
+	for event, policy := range c.events {
+		events[event] = policy
+	}
+	return map[string]interface{}{
+		"default": c.fallback,
+		"events":  events,
 	}
-	log.Println("=== QR EVENT HANDLER ENDED ===")
 }
 
-// /send endpoint - send message to a number
-func sendHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+// Response structures for API
+type APIResponse struct {
+	Success bool        `json:"success"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
 
-	if r.Method != http.MethodPost {
-		response := APIResponse{
-			Success: false,
-			Message: "Method not allowed. Use POST",
-		}
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
+type Attachment struct {
+	Type     string `json:"type"`               // image, document, audio, video or location
+	URL      string `json:"url"`                // HTTP/HTTPS URL, data: URI or base64 data
+	Encoding string `json:"encoding,omitempty"` // "base64" when URL holds raw base64 data
+	Filename string `json:"filename"`           // optional filename for documents
+	Caption  string `json:"caption"`            // optional caption
+	Force    bool   `json:"force,omitempty"`    // skip the check that the file's content type matches Type
+
+	// Part of the image to send, for images only
+	Crop *ImageCrop `json:"crop,omitempty"`
+
+	// Locations only; they have no url
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	Address   string   `json:"address,omitempty"`
+}
 
-	// Check if paired
-	if !isPaired || !client.IsConnected() {
-		response := APIResponse{
-			Success: false,
-			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
-		}
-		json.NewEncoder(w).Encode(response)
-		return
-	}
+// ImageCrop selects the part of an image to send: "square" for the largest centered square,
+// or an explicit region in pixels of the original image
+type ImageCrop struct {
+	Square bool `json:"square,omitempty"`
+	X      int  `json:"x"`
+	Y      int  `json:"y"`
+	Width  int  `json:"width"`
+	Height int  `json:"height"`
+}
 
-	var req SendRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		response := APIResponse{
-			Success: false,
-			Message: "Invalid request body",
+// UnmarshalJSON accepts either the string "square" or an object with x, y, width and height
+func (c *ImageCrop) UnmarshalJSON(data []byte) error {
+	var mode string
+	if err := json.Unmarshal(data, &mode); err == nil {
+		if mode != "square" {
+			return fmt.Errorf("unknown crop %q, use \"square\" or an object with x, y, width and height", mode)
 		}
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
+		*c = ImageCrop{Square: true}
+		return nil
 	}
 
-	// Validate input
-	if req.Number == "" {
-		response := APIResponse{
-			Success: false,
-			Message: "Number is required",
-		}
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
+	type region ImageCrop
+	return json.Unmarshal(data, (*region)(c))
+}
 
-	if req.Message == "" && len(req.Attachments) == 0 {
-		response := APIResponse{
-			Success: false,
-			Message: "Either message or attachments are required",
-		}
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
+// rect returns the crop region within bounds, or an error if it doesn't fit inside them
+func (c *ImageCrop) rect(bounds image.Rectangle) (image.Rectangle, error) {
+	if c.Square {
+		side := min(bounds.Dx(), bounds.Dy())
+		x := bounds.Min.X + (bounds.Dx()-side)/2
+		y := bounds.Min.Y + (bounds.Dy()-side)/2
+		return image.Rect(x, y, x+side, y+side), nil
 	}
 
-	// Parse phone number (assuming it includes country code without +)
-	targetJID, err := types.ParseJID(req.Number + "@s.whatsapp.net")
-	if err != nil {
-		response := APIResponse{
-			Success: false,
-			Message: fmt.Sprintf("Invalid phone number: %v", err),
-		}
-		json.NewEncoder(w).Encode(response)
-		return
+	if c.Width <= 0 || c.Height <= 0 || c.X < 0 || c.Y < 0 || c.X+c.Width > bounds.Dx() || c.Y+c.Height > bounds.Dy() {
+		return image.Rectangle{}, fmt.Errorf("crop region %dx%d at %d,%d doesn't fit inside the %dx%d image",
+			c.Width, c.Height, c.X, c.Y, bounds.Dx(), bounds.Dy())
 	}
+	return image.Rect(c.X, c.Y, c.X+c.Width, c.Y+c.Height).Add(bounds.Min), nil
+}
 
-	var messages []*waProto.Message
+type SendRequest struct {
+	Number      string       `json:"number"`
+	Message     string       `json:"message"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	Persist     bool         `json:"persist,omitempty"` // send without the chat's disappearing timer
 
-	// Check if we have text + single image attachment to combine
-	if req.Message != "" && len(req.Attachments) == 1 && req.Attachments[0].Type == "image" {
-		// Combine text as image caption
-		attachment := req.Attachments[0]
-		attachment.Caption = req.Message // Use text message as caption
-		attachmentMsg, err := prepareAttachmentMessage(attachment, targetJID)
-		if err != nil {
-			response := APIResponse{
-				Success: false,
-				Message: fmt.Sprintf("Failed to prepare attachment: %v", err),
-			}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-		messages = append(messages, attachmentMsg)
-	} else {
-		// Add text message if provided
-		if req.Message != "" {
-			messages = append(messages, &waProto.Message{
-				Conversation: proto.String(req.Message),
-			})
-		}
+	// Caller-chosen ID for correlation; a repeated ID returns the original result instead of sending again
+	ClientMessageID string `json:"client_message_id,omitempty"`
 
-		// Process attachments
-		for _, attachment := range req.Attachments {
-			attachmentMsg, err := prepareAttachmentMessage(attachment, targetJID)
-			if err != nil {
-				response := APIResponse{
-					Success: false,
-					Message: fmt.Sprintf("Failed to prepare attachment: %v", err),
-				}
-				json.NewEncoder(w).Encode(response)
-				return
-			}
-			messages = append(messages, attachmentMsg)
-		}
-	}
+	// Order shown as a quoted message above the first message sent
+	Order *OrderContext `json:"order,omitempty"`
 
-	// Send typing indicator before sending messages
-	sendTypingIndicator(targetJID)
+	// Pause between the messages of one send, so clients display them in order
+	DelayMs int `json:"delay_ms,omitempty"`
 
-	// Send all messages
-	var sentMessages []map[string]interface{}
-	for i, msg := range messages {
-		_, err = client.SendMessage(context.Background(), targetJID, msg)
-		if err != nil {
-			response := APIResponse{
-				Success: false,
-				Message: fmt.Sprintf("Failed to send message %d: %v", i+1, err),
-			}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
+	// Quote the last message received in the chat, if there is one
+	ReplyToLatest bool `json:"reply_to_latest,omitempty"`
 
-		sentInfo := map[string]interface{}{"index": i + 1}
-		if req.Message != "" && len(req.Attachments) == 1 && req.Attachments[0].Type == "image" {
-			// Combined message case
-			sentInfo["type"] = "image_with_caption"
-			sentInfo["content"] = req.Message
-			sentInfo["filename"] = req.Attachments[0].Filename
-		} else if i == 0 && req.Message != "" {
-			sentInfo["type"] = "text"
-			sentInfo["content"] = req.Message
-		} else if i > 0 || req.Message == "" {
-			attachmentIndex := i
-			if req.Message != "" {
-				attachmentIndex = i - 1
-			}
-			if attachmentIndex < len(req.Attachments) {
-				sentInfo["type"] = req.Attachments[attachmentIndex].Type
-				sentInfo["filename"] = req.Attachments[attachmentIndex].Filename
-			}
-		}
-		sentMessages = append(sentMessages, sentInfo)
-	}
+	// Quote a specific message. Messages missing from the message store are quoted with quoted_text,
+	// and in groups reply_sender (who wrote it) is then required.
+	ReplyTo     string `json:"reply_to,omitempty"`
+	ReplySender string `json:"reply_sender,omitempty"`
+	QuotedText  string `json:"quoted_text,omitempty"`
 
-	response := APIResponse{
-		Success: true,
-		Message: fmt.Sprintf("Successfully sent %d message(s)", len(messages)),
-		Data: map[string]interface{}{
-			"number":      req.Number,
-			"message":     req.Message,
-			"attachments": req.Attachments,
-			"sent":        sentMessages,
-		},
-	}
-	json.NewEncoder(w).Encode(response)
+	// Footer for this send instead of WA_MESSAGE_FOOTER; "" sends without one
+	Footer *string `json:"footer,omitempty"`
 }
 
-// Health check endpoint
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+// Kinds of message destinations, each determined by the server of its JID (see sendTargetKind)
+const (
+	targetUser       = "user"
+	targetGroup      = "group"
+	targetStatus     = "status"
+	targetBroadcast  = "broadcast"
+	targetNewsletter = "newsletter"
+)
 
-	status := map[string]interface{}{
-		"version":            version,
-		"paired":             isPaired,
-		"connected":          client != nil && client.IsConnected(),
-		"webhook_configured": webhookURL != "",
-	}
+// OrderContext describes an order to quote in an outgoing message, e.g. for an order confirmation.
+// There is no real order message to reply to; the quote is built from these fields.
+type OrderContext struct {
+	OrderID   string  `json:"order_id"`
+	Title     string  `json:"title"`
+	ItemCount int     `json:"item_count,omitempty"`
+	Total     float64 `json:"total,omitempty"`
+	Currency  string  `json:"currency,omitempty"`
+	Thumbnail string  `json:"thumbnail,omitempty"` // URL or base64 image
+}
 
-	response := APIResponse{
-		Success: true,
-		Message: "WhatsApp service is running",
-		Data:    status,
-	}
-	json.NewEncoder(w).Encode(response)
+// ClientMessage maps a caller-supplied client_message_id to a WhatsApp message it produced
+type ClientMessage struct {
+	ClientMessageID string    `json:"client_message_id"`
+	MessageID       string    `json:"message_id"`
+	Chat            string    `json:"chat"`
+	Index           int       `json:"index"`
+	CreatedAt       time.Time `json:"created_at"`
 }
 
-// Device management endpoint
-func devicesHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+// VCardPhone is a single TEL entry parsed from a vCard
+type VCardPhone struct {
+	Number string `json:"number"`
+	Type   string `json:"type,omitempty"`
+	WaID   string `json:"wa_id,omitempty"` // WhatsApp ID from the waid= parameter, if present
+}
 
-	if client == nil {
-		response := APIResponse{
-			Success: false,
-			Message: "Client not initialized",
-		}
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
+// VCardContact is the structured form of a received vCard
+type VCardContact struct {
+	Name         string       `json:"name"`
+	Organization string       `json:"organization,omitempty"`
+	Phones       []VCardPhone `json:"phones"`
+	Emails       []string     `json:"emails"`
+}
 
-	deviceInfo := map[string]interface{}{
-		"connected": client.IsConnected(),
-		"paired":    isPaired,
-	}
+type ImportContactsRequest struct {
+	VCard  string   `json:"vcard,omitempty"`
+	VCards []string `json:"vcards,omitempty"`
+}
 
-	// Only add device info if store exists and has ID
-	if client.Store != nil && client.Store.ID != nil {
-		deviceInfo["device_id"] = client.Store.ID.String()
-		deviceInfo["jid"] = client.Store.ID
-		deviceInfo["phone"] = client.Store.ID.User
-	} else {
-		deviceInfo["device_id"] = nil
-		deviceInfo["jid"] = nil
-		deviceInfo["phone"] = nil
-	}
+type PaymentRequest struct {
+	Number      string  `json:"number"`
+	Amount      float64 `json:"amount"`
+	Currency    string  `json:"currency"`
+	Note        string  `json:"note,omitempty"`
+	ExpiryHours int     `json:"expiry_hours,omitempty"` // defaults to 7 days
+	Footer      *string `json:"footer,omitempty"`
+}
 
-	response := APIResponse{
-		Success: true,
-		Message: "Device information retrieved",
-		Data:    deviceInfo,
-	}
-	json.NewEncoder(w).Encode(response)
+// WhatsApp payments are only available in a few markets; map the account's
+// country calling code to the currency payments are settled in there
+var paymentRegions = map[string]string{
+	"91": "INR", // India (UPI)
+	"55": "BRL", // Brazil
 }
 
-// Disconnect endpoint
-func disconnectHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+// paymentAmount converts a WhatsApp payment amount to a decimal value and currency
+func paymentAmount(req *waProto.RequestPaymentMessage) (float64, string) {
+	if money := req.GetAmount(); money != nil && money.GetOffset() > 0 {
+		return float64(money.GetValue()) / float64(money.GetOffset()), money.GetCurrencyCode()
+	}
+	return float64(req.GetAmount1000()) / 1000, req.GetCurrencyCodeIso4217()
+}
 
-	if client == nil {
-		response := APIResponse{
-			Success: false,
-			Message: "Client not initialized",
+// paymentDetails describes a WhatsApp Pay message in chat for the webhook, or returns nil for other
+// messages. Payments made against a request only reference it, so amount and currency are taken from
+// the stored request when it is available.
+func paymentDetails(chat types.JID, msg *waProto.Message) (map[string]interface{}, string) {
+	var payment map[string]interface{}
+	var reference string
+	switch {
+	case msg.RequestPaymentMessage != nil:
+		req := msg.RequestPaymentMessage
+		amount, currency := paymentAmount(req)
+		payment = map[string]interface{}{
+			"status":       "requested",
+			"amount":       amount,
+			"currency":     currency,
+			"request_from": req.GetRequestFrom(),
+			"note":         req.GetNoteMessage().GetExtendedTextMessage().GetText(),
 		}
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
-		return
+		if expiry := req.GetExpiryTimestamp(); expiry > 0 {
+			payment["expires_at"] = time.Unix(expiry, 0)
+		}
+	case msg.SendPaymentMessage != nil:
+		reference = msg.SendPaymentMessage.GetRequestMessageKey().GetID()
+		payment = map[string]interface{}{
+			"status":           "paid",
+			"note":             msg.SendPaymentMessage.GetNoteMessage().GetExtendedTextMessage().GetText(),
+			"transaction_data": msg.SendPaymentMessage.GetTransactionData(),
+		}
+	case msg.DeclinePaymentRequestMessage != nil:
+		reference = msg.DeclinePaymentRequestMessage.GetKey().GetID()
+		payment = map[string]interface{}{"status": "declined"}
+	case msg.CancelPaymentRequestMessage != nil:
+		reference = msg.CancelPaymentRequestMessage.GetKey().GetID()
+		payment = map[string]interface{}{"status": "cancelled"}
+	case msg.PaymentInviteMessage != nil:
+		payment = map[string]interface{}{
+			"status":       "invited",
+			"service_type": msg.PaymentInviteMessage.GetServiceType().String(),
+		}
+	default:
+		return nil, ""
 	}
 
-	// Disconnect if connected
-	if client.IsConnected() {
-		client.Disconnect()
-		log.Println("Manually disconnected from WhatsApp")
+	payment["type"] = "payment"
+	payment["reference"] = reference
+	if reference != "" {
+		var raw []byte
+		err := db.QueryRow("SELECT raw FROM messages WHERE chat = $1 AND id = $2", chat.String(), reference).Scan(&raw)
+		request := &waProto.Message{}
+		if err == nil && proto.Unmarshal(raw, request) == nil && request.RequestPaymentMessage != nil {
+			payment["amount"], payment["currency"] = paymentAmount(request.RequestPaymentMessage)
+		}
 	}
 
-	// Clear session
-	if client.Store.ID != nil {
-		err := client.Store.Delete(context.Background())
-		if err != nil {
-			log.Printf("Warning: Failed to clear session during disconnect: %v", err)
-		} else {
-			log.Println("Session cleared successfully")
-		}
+	content := fmt.Sprintf("Payment %s", payment["status"])
+	if amount, ok := payment["amount"].(float64); ok {
+		content = fmt.Sprintf("Payment %s: %.2f %s", payment["status"], amount, payment["currency"])
 	}
+	return payment, content
+}
 
-	isPaired = false
+// MessageTemplate is a named message body with {{placeholder}} variables
+type MessageTemplate struct {
+	Name         string    `json:"name"`
+	Body         string    `json:"body"`
+	Placeholders []string  `json:"placeholders"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
 
-	response := APIResponse{
-		Success: true,
-		Message: "Successfully disconnected and session cleared",
-	}
-	json.NewEncoder(w).Encode(response)
+// ReceiptRule overrides the automatic read receipt for one chat
+type ReceiptRule struct {
+	Chat      string    `json:"chat"`
+	Mode      string    `json:"mode"` // read, read_self or none
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
-// Image endpoint - serve downloaded images
-func imageHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	filename := vars["filename"]
+// FilterRule marks incoming messages containing a keyword or matching a regex as spam
+type FilterRule struct {
+	ID          int64     `json:"id"`
+	Pattern     string    `json:"pattern"`
+	Regex       bool      `json:"regex"`
+	DropWebhook bool      `json:"drop_webhook"` // don't forward matching messages to the webhook
+	SkipRead    bool      `json:"skip_read"`    // don't send a read receipt for matching messages
+	CreatedAt   time.Time `json:"created_at"`
 
-	if filename == "" {
+	compiled *regexp.Regexp
+}
+
+// receiptModes maps the receipt rule modes to the receipt sent for incoming messages; "none" sends nothing
+var receiptModes = map[string]types.ReceiptType{
+	"read":      types.ReceiptTypeRead,     // blue ticks for the sender
+	"read_self": types.ReceiptTypeReadSelf, // read on our own devices only
+}
+
+type SendTemplateRequest struct {
+	Number    string            `json:"number"`
+	Template  string            `json:"template"`
+	Variables map[string]string `json:"variables"`
+	Footer    *string           `json:"footer,omitempty"`
+}
+
+var templatePlaceholderPattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_]+)\s*\}\}`)
+
+type BulkSendRequest struct {
+	Numbers     []string     `json:"numbers"`
+	Message     string       `json:"message"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	Persist     bool         `json:"persist,omitempty"`
+	Footer      *string      `json:"footer,omitempty"`
+}
+
+// BulkSendResult is the outcome for a single number in a bulk send
+type BulkSendResult struct {
+	Number      string   `json:"number"`
+	JID         string   `json:"jid,omitempty"`
+	Status      string   `json:"status"` // sent, failed, duplicate, not_on_whatsapp
+	DuplicateOf string   `json:"duplicate_of,omitempty"`
+	MessageIDs  []string `json:"message_ids,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+type SendAlbumRequest struct {
+	Number      string       `json:"number"`
+	Attachments []Attachment `json:"attachments"` // images and videos only
+	Persist     bool         `json:"persist,omitempty"`
+	Footer      *string      `json:"footer,omitempty"`
+}
+
+type BroadcastLocationRequest struct {
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	Name      string   `json:"name,omitempty"`
+	Address   string   `json:"address,omitempty"`
+	Persist   bool     `json:"persist,omitempty"`
+}
+
+// BroadcastLocationResult is the outcome of sending the location to one group member
+type BroadcastLocationResult struct {
+	Participant string `json:"participant"`
+	Status      string `json:"status"` // sent or failed
+	MessageID   string `json:"message_id,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type RequestLocationRequest struct {
+	Number  string  `json:"number"`
+	Message string  `json:"message"` // text shown above the "Send location" button
+	Footer  *string `json:"footer,omitempty"`
+}
+
+type locationRequest struct {
+	id     string
+	sentAt time.Time
+}
+
+type SendStickerRequest struct {
+	Number string `json:"number"`
+	Image  string `json:"image"` // HTTP/HTTPS URL or base64 data (optionally as a data: URI)
+}
+
+// ContactCard is one contact to share, either a raw vCard or the fields to build one from
+type ContactCard struct {
+	DisplayName  string `json:"display_name,omitempty"` // defaults to the card's name
+	Name         string `json:"name,omitempty"`
+	Phone        string `json:"phone,omitempty"`
+	Organization string `json:"organization,omitempty"`
+	VCard        string `json:"vcard,omitempty"` // sent instead of a card built from name/phone
+}
+
+// SendContactRequest shares the inline card, or every card in contacts as one message
+type SendContactRequest struct {
+	Number string `json:"number"`
+	ContactCard
+	Contacts []ContactCard `json:"contacts,omitempty"`
+	Validate bool          `json:"validate,omitempty"`
+}
+
+// ReactRequest reacts to a message in a chat; chat is an alias of number
+type ReactRequest struct {
+	Number    string `json:"number"`
+	Chat      string `json:"chat"`
+	MessageID string `json:"message_id"`
+	Sender    string `json:"sender"` // who wrote the message being reacted to
+	Emoji     string `json:"emoji"`  // empty to remove our reaction
+}
+
+type SendIfActiveRequest struct {
+	Number  string  `json:"number"`
+	Message string  `json:"message"`
+	Within  string  `json:"within"` // e.g. "30m", "72h" or "7d"
+	Footer  *string `json:"footer,omitempty"`
+}
+
+// contactPresence is the last presence WhatsApp reported for a contact
+type contactPresence struct {
+	Online   bool
+	LastSeen time.Time // zero when the contact hides their last seen
+}
+
+// ContactValidation is the WhatsApp lookup of one phone number on a shared contact card
+type ContactValidation struct {
+	Phone      string `json:"phone"`
+	OnWhatsApp bool   `json:"on_whatsapp"`
+	JID        string `json:"jid,omitempty"`
+}
+
+type ForwardRequest struct {
+	Chat      string `json:"chat"`       // chat the original message was received in
+	MessageID string `json:"message_id"` // ID of the stored message to forward
+	To        string `json:"to"`         // destination number or JID
+}
+
+type StarMessageRequest struct {
+	Chat      string `json:"chat"`
+	MessageID string `json:"message_id"`
+	Sender    string `json:"sender,omitempty"`  // required for group messages not in the message store
+	FromMe    bool   `json:"from_me,omitempty"` // the message was sent by this account
+	Starred   *bool  `json:"starred,omitempty"` // false unstars; defaults to true
+}
+
+// DeleteMessageRequest deletes a message; sender is only needed for someone else's group message
+type DeleteMessageRequest struct {
+	Chat        string `json:"chat"`
+	MessageID   string `json:"message_id"`
+	ForEveryone bool   `json:"for_everyone"`
+	Sender      string `json:"sender,omitempty"`
+}
+
+// EditMessageRequest replaces the text of a message sent by this account
+type EditMessageRequest struct {
+	Chat      string `json:"chat"`
+	MessageID string `json:"message_id"`
+	Message   string `json:"message"`
+}
+
+type KeepMessageRequest struct {
+	Chat      string `json:"chat"`
+	MessageID string `json:"message_id"`
+	Sender    string `json:"sender,omitempty"` // required for group messages not in the message store
+	Keep      *bool  `json:"keep,omitempty"`   // false undoes a previous keep; defaults to true
+}
+
+// StoredMessage is a message row from the messages table
+type StoredMessage struct {
+	ID         string                 `json:"id"`
+	Chat       string                 `json:"chat"`
+	Sender     string                 `json:"sender"`
+	PushName   string                 `json:"push_name,omitempty"`
+	Timestamp  time.Time              `json:"timestamp"`
+	FromMe     bool                   `json:"from_me"`
+	Direction  string                 `json:"direction"` // incoming or outgoing
+	Type       string                 `json:"type"`
+	Content    string                 `json:"content"`
+	Attachment map[string]interface{} `json:"attachment,omitempty"`
+
+	// Disappearing messages only
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Kept      bool       `json:"kept,omitempty"`
+	Expired   bool       `json:"expired,omitempty"`
+
+	// Set when the message was deleted for everyone
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+type WebhookPayload struct {
+	Event      string                 `json:"event"`
+	Message    string                 `json:"message,omitempty"`
+	Sender     string                 `json:"sender,omitempty"`
+	Chat       string                 `json:"chat,omitempty"`
+	Time       time.Time              `json:"time"`
+	Attachment map[string]interface{} `json:"attachment,omitempty"`
+
+	// Set on events of additional accounts (/accounts/{id}/) to their account ID
+	Account string `json:"account,omitempty"`
+
+	// Set on incoming message events only
+	IsVerifiedBusiness *bool  `json:"is_verified_business,omitempty"`
+	VerifiedName       string `json:"verified_name,omitempty"`
+}
+
+func getDatabaseURL() string {
+	// Load .env file if it exists
+	err := godotenv.Load()
+	if err != nil {
+		log.Println("Warning: .env file not found, using environment variables")
+	}
+
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		log.Fatal("DATABASE_URL environment variable is not set. Please set it in .env file or as environment variable")
+	}
+
+	// Parse the URL to check if sslmode is specified
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		log.Fatalf("Invalid DATABASE_URL format: %v", err)
+	}
+
+	// Check if sslmode is already in the query parameters
+	query := parsedURL.Query()
+	if !query.Has("sslmode") {
+		// Add sslmode=disable if not present
+		query.Set("sslmode", "disable")
+		parsedURL.RawQuery = query.Encode()
+		log.Println("Note: Automatically added sslmode=disable to DATABASE_URL")
+	}
+
+	return parsedURL.String()
+}
+
+// parseEnvDuration reads a positive duration from the named environment variable, given as a
+// Go duration ("15s", "1m") or a plain number of seconds. It returns def when the variable is
+// unset or invalid.
+func parseEnvDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, convErr := strconv.Atoi(value)
+		duration, err = time.Duration(seconds)*time.Second, convErr
+	}
+	if err != nil || duration <= 0 {
+		log.Printf("Warning: Invalid %s %q, using %s", name, value, def)
+		return def
+	}
+	log.Printf("%s configured: %s", name, duration)
+	return duration
+}
+
+func initializeWhatsApp() {
+	log.Println("=== INITIALIZING WHATSAPP CLIENT ===")
+
+	// Get database URL from environment
+	dbURL := getDatabaseURL()
+
+	// Open a shared PostgreSQL connection for the session store and our own tables
+	var err error
+	db, err = sql.Open("postgres", dbURL)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+
+	// Create database container with PostgreSQL
+	storeContainer = sqlstore.NewWithDB(db, "postgres", waLog.Stdout("Database", "INFO", true))
+	err = storeContainer.Upgrade(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to create database container: %v", err)
+	}
+
+	// Create application tables
+	err = initializeAppTables()
+	if err != nil {
+		log.Fatalf("Failed to create application tables: %v", err)
+	}
+	go expireMessages()
+	if err := loadFilterRules(); err != nil {
+		log.Printf("Failed to load filter rules: %v", err)
+	}
+
+	// Get device store, leaving out devices that belong to additional accounts
+	deviceStore, err := loadAccounts()
+	if err != nil {
+		log.Fatalf("Failed to get device store: %v", err)
+	}
+
+	// Create WhatsApp client
+	clientLog := waLog.Stdout("Client", "INFO", true)
+	client = whatsmeow.NewClient(deviceStore, clientLog)
+	// Undecryptable messages are retried with the sender first; ask our phone for a copy if that doesn't help
+	client.AutomaticMessageRerequestFromPhone = true
+	// Don't keep retrying the connection while WhatsApp asked us to stay away
+	client.AutoReconnectHook = defaultCooldown.AllowReconnect
+
+	// Add event handlers
+	client.AddEventHandler(handler)
+
+	// Check if already paired and attempt connection with better error handling
+	if client.Store.ID != nil {
+		log.Printf("Found existing session for device: %s", client.Store.ID.String())
+		isPaired = true
+
+		// Attempt to connect to existing session
+		log.Println("Attempting to connect to existing session...")
+		err = client.Connect()
+		if err != nil {
+			log.Printf("Failed to connect to existing session: %v", err)
+			log.Println("💡 This could be due to:")
+			log.Println("   - Device being disconnected from WhatsApp mobile app")
+			log.Println("   - Device limit exceeded on WhatsApp account")
+			log.Println("   - Network connectivity issues")
+			log.Println("   - Session corruption")
+			log.Println("💡 Use /pair endpoint to create a new session")
+			isPaired = false
+		} else {
+			log.Println("🟢 Successfully connected to WhatsApp with existing session")
+		}
+	} else {
+		log.Println("No existing session found - use /pair endpoint to create one")
+	}
+
+	// Get webhook URL from environment
+	webhookURL = os.Getenv("WA_WEBHOOK_URL")
+	if webhookURL != "" {
+		log.Println("Webhook URL configured:", webhookURL)
+	}
+
+	retryPolicy := webhookRetryPolicy{BackoffSeconds: defaultWebhookBackoff.Seconds()}
+	if retries := os.Getenv("WA_WEBHOOK_RETRIES"); retries != "" {
+		n, err := strconv.Atoi(retries)
+		if err != nil || n < 0 || n > maxWebhookRetries {
+			log.Printf("Warning: Invalid WA_WEBHOOK_RETRIES %q, failed webhooks will not be retried", retries)
+		} else {
+			retryPolicy.MaxRetries = n
+			log.Printf("Webhook retries configured: %d", n)
+		}
+	}
+	retryPolicy.BackoffSeconds = parseEnvDuration("WA_WEBHOOK_BACKOFF", defaultWebhookBackoff).Seconds()
+	webhookRetries.SetDefault(retryPolicy)
+
+	webhookClient.Timeout = parseEnvDuration("WA_WEBHOOK_TIMEOUT", defaultWebhookTimeout)
+
+	if secret := os.Getenv("WA_WEBHOOK_SECRET"); secret != "" {
+		webhookSecret.SetSecret(secret, 0)
+		log.Println("Webhook signing enabled (X-Webhook-Signature)")
+	}
+
+	apiKey = os.Getenv("API_KEY")
+	if apiKey != "" {
+		log.Println("🔐 API key authentication enabled for all endpoints except /health and /swagger")
+	} else {
+		log.Println("⚠️ ==================================================================")
+		log.Println("⚠️ API_KEY is not set: anyone who can reach this port can pair, read")
+		log.Println("⚠️ messages and media, send messages and change the configuration.")
+		log.Println("⚠️ Set API_KEY to require it as a Bearer token or X-API-Key header.")
+		log.Println("⚠️ ==================================================================")
+	}
+
+	rateLimitCooldown = parseEnvDuration("WA_RATE_LIMIT_COOLDOWN", defaultRateLimitCooldown)
+	typingTimeout = parseEnvDuration("WA_TYPING_TIMEOUT", defaultTypingTimeout)
+
+	// Get send rate limit (messages per minute) from environment
+	if limit := os.Getenv("WA_RATE_LIMIT"); limit != "" {
+		perMinute, err := strconv.Atoi(limit)
+		if err != nil || perMinute < 0 {
+			log.Printf("Warning: Invalid WA_RATE_LIMIT %q, sending without a rate limit", limit)
+		} else {
+			sendLimiter.SetLimit(perMinute)
+			log.Printf("Send rate limit configured: %d message(s) per minute", perMinute)
+		}
+	}
+
+	if template := os.Getenv("WA_DOWNLOAD_NAME_TEMPLATE"); template != "" {
+		if !strings.Contains(template, "{id}") {
+			log.Printf("Warning: WA_DOWNLOAD_NAME_TEMPLATE %q has no {id} token, so files could overwrite each other; using %q", template, defaultDownloadNameTemplate)
+		} else {
+			downloadNameTemplate = template
+			log.Printf("Download file name template: %s", template)
+		}
+	}
+
+	if value := os.Getenv("WA_MAX_CONCURRENT_DOWNLOADS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			log.Printf("Warning: Invalid WA_MAX_CONCURRENT_DOWNLOADS %q, using %d", value, defaultMaxConcurrentDownloads)
+		} else {
+			downloadWorkers = n
+			log.Printf("Concurrent media downloads limited to %d", n)
+		}
+	}
+	startDownloadWorkers(downloadWorkers)
+
+	if value := os.Getenv("WA_PUBLIC_URL"); value != "" {
+		parsed, err := url.Parse(value)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			log.Printf("Warning: Invalid WA_PUBLIC_URL %q, webhook links will be relative", value)
+		} else {
+			publicURL = strings.TrimRight(value, "/")
+			log.Printf("Public URL: %s", publicURL)
+		}
+	}
+
+	if value := os.Getenv("WA_WEBHOOK_MAX_PAYLOAD"); value != "" {
+		size, err := parseByteSize(value)
+		if err != nil {
+			log.Printf("Warning: Invalid WA_WEBHOOK_MAX_PAYLOAD %q, webhook payloads will not be limited: %v", value, err)
+		} else {
+			webhookMaxPayload = int(size)
+			log.Printf("Webhook payloads limited to %d bytes", size)
+		}
+	}
+
+	autoDownload.Store(true)
+	if value := os.Getenv("WA_AUTO_DOWNLOAD"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("Warning: Invalid WA_AUTO_DOWNLOAD %q, incoming media will be downloaded automatically", value)
+		} else {
+			autoDownload.Store(enabled)
+			log.Printf("Automatic media downloads: %t", enabled)
+		}
+	}
+
+	autoTyping.Store(true)
+	if value := os.Getenv("WA_AUTO_TYPING"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("Warning: Invalid WA_AUTO_TYPING %q, a typing indicator will be shown while sending", value)
+		} else {
+			autoTyping.Store(enabled)
+			log.Printf("Typing indicator while sending: %t", enabled)
+		}
+	}
+
+	if value := os.Getenv("WA_AUTO_DOWNLOAD_MAX_SIZE"); value != "" {
+		size, err := parseByteSize(value)
+		if err != nil {
+			log.Printf("Warning: Invalid WA_AUTO_DOWNLOAD_MAX_SIZE %q, media of any size will be downloaded: %v", value, err)
+		} else {
+			autoDownloadMaxSize.Store(size)
+			log.Printf("Automatic media downloads limited to %d bytes", size)
+		}
+	}
+
+	autoRead.Store(true)
+	if value := os.Getenv("WA_AUTO_READ"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("Warning: Invalid WA_AUTO_READ %q, messages will be marked as read automatically", value)
+		} else {
+			autoRead.Store(enabled)
+			log.Printf("Automatic read receipts: %t", enabled)
+		}
+	}
+
+	if value := os.Getenv("WA_STORE_OUTGOING"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("Warning: Invalid WA_STORE_OUTGOING %q, only incoming messages will be stored", value)
+		} else {
+			storeOutgoing.Store(enabled)
+			log.Printf("Storing outgoing messages: %t", enabled)
+		}
+	}
+
+	if footer := os.Getenv("WA_MESSAGE_FOOTER"); footer != "" {
+		// Allow multi-line footers in one env line
+		footer = strings.ReplaceAll(footer, `\n`, "\n")
+		messageFooter.Store(&footer)
+		log.Printf("Message footer configured: %q", footer)
+	}
+
+	downloadConfig := &downloadHeaderConfig{UserAgent: os.Getenv("WA_DOWNLOAD_USER_AGENT")}
+	if value := os.Getenv("WA_DOWNLOAD_HEADERS"); value != "" {
+		var hosts map[string]map[string]string
+		err := json.Unmarshal([]byte(value), &hosts)
+		if err == nil {
+			hosts, err = validateDownloadHeaders(hosts)
+		}
+		if err != nil {
+			log.Printf("Warning: Invalid WA_DOWNLOAD_HEADERS, attachments are fetched without extra headers: %v", err)
+		} else {
+			downloadConfig.Hosts = hosts
+		}
+	}
+	if err := validateHeaderValue(downloadConfig.UserAgent); err != nil {
+		log.Printf("Warning: Invalid WA_DOWNLOAD_USER_AGENT, using the default: %v", err)
+		downloadConfig.UserAgent = ""
+	}
+	downloadHeaders.Store(downloadConfig)
+	if downloadConfig.UserAgent != "" || len(downloadConfig.Hosts) > 0 {
+		log.Printf("Attachment downloads use User-Agent %q and extra headers for %d host(s)", downloadConfig.UserAgent, len(downloadConfig.Hosts))
+	}
+
+	if value := os.Getenv("WA_PRESENCE"); value != "" {
+		presence := types.Presence(strings.ToLower(value))
+		if presence != types.PresenceAvailable && presence != types.PresenceUnavailable {
+			log.Printf("Warning: Invalid WA_PRESENCE %q, using %s", value, types.PresenceAvailable)
+		} else {
+			accountPresence = presence
+			log.Printf("Account presence after connecting: %s", presence)
+		}
+	}
+
+	if enabled, _ := strconv.ParseBool(os.Getenv("WA_PURGE_CLEARED_CHATS")); enabled {
+		purgeClearedChats = true
+		log.Println("Stored messages and media will be purged when a chat is cleared or deleted")
+	}
+
+	// Optional audio/video transcoding via ffmpeg
+	if enabled, _ := strconv.ParseBool(os.Getenv("WA_ENABLE_TRANSCODE")); enabled {
+		if _, err := exec.LookPath("ffmpeg"); err != nil {
+			log.Println("Warning: WA_ENABLE_TRANSCODE is set but ffmpeg was not found in PATH, media will be sent as-is")
+		} else {
+			transcodeEnabled = true
+			log.Println("Media transcoding enabled (audio -> OGG/Opus, video -> H.264 MP4)")
+		}
+	}
+
+	log.Println("=== WHATSAPP CLIENT INITIALIZATION COMPLETE ===")
+}
+
+// initializeAppTables creates the tables used by the API itself (separate from whatsmeow's session store)
+func initializeAppTables() error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS contacts (
+			phone      TEXT PRIMARY KEY,
+			name       TEXT NOT NULL DEFAULT '',
+			email      TEXT NOT NULL DEFAULT '',
+			vcard      TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS messages (
+			id         TEXT NOT NULL,
+			chat       TEXT NOT NULL,
+			sender     TEXT NOT NULL,
+			push_name  TEXT NOT NULL DEFAULT '',
+			timestamp  TIMESTAMPTZ NOT NULL,
+			from_me    BOOLEAN NOT NULL DEFAULT FALSE,
+			type       TEXT NOT NULL,
+			content    TEXT NOT NULL DEFAULT '',
+			attachment JSONB,
+			raw        BYTEA,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			PRIMARY KEY (chat, id)
+		)`,
+		// Message IDs are only unique within a chat; tables created keyed on the ID alone are rekeyed
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_constraint
+				WHERE conrelid = 'messages'::regclass AND contype = 'p' AND array_length(conkey, 1) = 2) THEN
+				ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_pkey;
+				ALTER TABLE messages ADD PRIMARY KEY (chat, id);
+			END IF;
+		END $$`,
+		`CREATE INDEX IF NOT EXISTS messages_chat_timestamp_idx ON messages (chat, timestamp)`,
+		// Disappearing message state
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS kept BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS expired BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`,
+		`CREATE TABLE IF NOT EXISTS templates (
+			name       TEXT PRIMARY KEY,
+			body       TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS message_receipts (
+			message_id  TEXT NOT NULL,
+			chat        TEXT NOT NULL,
+			participant TEXT NOT NULL,
+			type        TEXT NOT NULL,
+			timestamp   TIMESTAMPTZ NOT NULL,
+			PRIMARY KEY (message_id, participant, type)
+		)`,
+		`CREATE TABLE IF NOT EXISTS client_messages (
+			client_message_id TEXT NOT NULL,
+			idx               INTEGER NOT NULL,
+			message_id        TEXT NOT NULL,
+			chat              TEXT NOT NULL,
+			created_at        TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			PRIMARY KEY (client_message_id, idx)
+		)`,
+		`CREATE TABLE IF NOT EXISTS client_message_keys (
+			client_message_id TEXT PRIMARY KEY,
+			status            TEXT NOT NULL,
+			created_at        TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at        TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		// Keys used before they were reserved up front all belong to finished sends
+		`INSERT INTO client_message_keys (client_message_id, status)
+			SELECT DISTINCT client_message_id, 'complete' FROM client_messages ON CONFLICT DO NOTHING`,
+		`CREATE TABLE IF NOT EXISTS receipt_rules (
+			chat       TEXT PRIMARY KEY,
+			mode       TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS filter_rules (
+			id           BIGSERIAL PRIMARY KEY,
+			pattern      TEXT NOT NULL,
+			is_regex     BOOLEAN NOT NULL DEFAULT FALSE,
+			drop_webhook BOOLEAN NOT NULL DEFAULT TRUE,
+			skip_read    BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		// Additional accounts and the device each one is linked to
+		`CREATE TABLE IF NOT EXISTS accounts (
+			id         TEXT PRIMARY KEY,
+			jid        TEXT,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+			id        BIGSERIAL PRIMARY KEY,
+			event     TEXT NOT NULL,
+			payload   BYTEA NOT NULL,
+			error     TEXT NOT NULL,
+			attempts  INTEGER NOT NULL,
+			failed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// /pair endpoint - generate QR code for pairing
+func pairHandler(w http.ResponseWriter, r *http.Request) {
+	// A working session is only replaced when a fresh pairing is asked for explicitly
+	force := false
+	if value := r.URL.Query().Get("force"); value != "" {
+		var err error
+		force, err = strconv.ParseBool(value)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			response := APIResponse{
+				Success: false,
+				Message: "force must be true or false",
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+	if !force && client != nil && client.Store.ID != nil && sessionWorks() {
+		log.Printf("Pairing skipped: session for %s is working (use ?force=true to pair again)", client.Store.ID.String())
+		w.Header().Set("Content-Type", "application/json")
+		response := APIResponse{
+			Success: false,
+			Message: "Already paired with a working session. Use ?force=true to unlink it and pair again",
+			Data: map[string]interface{}{
+				"connected": client.IsConnected(),
+				"logged_in": client.IsLoggedIn(),
+				"paired":    isPaired,
+				"jid":       client.Store.ID,
+			},
+		}
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	switch method := r.URL.Query().Get("method"); method {
+	case "", "qr":
+	case "code":
+		// A code can fail to be entered in time, so an existing session is never given up for one
+		if force {
+			w.Header().Set("Content-Type", "application/json")
+			response := APIResponse{
+				Success: false,
+				Message: "force can't be used with method=code. Use /disconnect first to link another phone",
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		pairCodeHandler(w, r)
+		return
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Unknown pairing method %q, use qr or code", method),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	log.Println("=== PAIRING REQUEST STARTED ===")
+
+	// If already paired or connected, disconnect and clear session first
+	if client != nil && client.IsConnected() {
+		log.Println("Disconnecting existing session...")
+		client.Disconnect()
+		isPaired = false
+		log.Println("Disconnected from previous session")
+	}
+
+	// Clear existing session if any
+	if client != nil && client.Store != nil && client.Store.ID != nil {
+		log.Printf("Clearing existing session for device: %s", client.Store.ID.String())
+		err := client.Store.Delete(context.Background())
+		if err != nil {
+			log.Printf("Warning: Failed to clear existing session: %v", err)
+		} else {
+			log.Println("Existing session cleared successfully")
+		}
+	}
+
+	// Add a small delay to ensure proper disconnection
+	time.Sleep(2 * time.Second)
+
+	// Get QR channel (must be called before connecting)
+	log.Println("Getting QR channel...")
+	qrChan, err := client.GetQRChannel(context.Background())
+	if err != nil {
+		log.Printf("Failed to get QR channel: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to get QR channel: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Connect client after getting QR channel
+	log.Println("Connecting to WhatsApp...")
+	err = client.Connect()
+	if err != nil {
+		log.Printf("Failed to connect: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to connect: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("Connected successfully, waiting for QR code...")
+
+	// Wait for QR code with extended timeout
+	select {
+	case evt := <-qrChan:
+		log.Printf("QR event received: %s", evt.Event)
+		if evt.Event == "code" {
+			qrCode := evt.Code
+			log.Printf("QR code generated, length: %d", len(qrCode))
+
+			// Generate QR code as PNG image
+			qr, err := qrcode.New(qrCode, qrcode.Medium)
+			if err != nil {
+				log.Printf("Failed to generate QR code: %v", err)
+				http.Error(w, fmt.Sprintf("Failed to generate QR code: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			// Set content type for PNG image
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+			w.Header().Set("Pragma", "no-cache")
+			w.Header().Set("Expires", "0")
+
+			// Encode and send the image
+			err = png.Encode(w, qr.Image(256))
+			if err != nil {
+				log.Printf("Failed to encode QR image: %v", err)
+				http.Error(w, fmt.Sprintf("Failed to encode QR image: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			log.Println("QR code image generated successfully")
+			log.Println("=== PAIRING REQUEST COMPLETED ===")
+
+			// Handle QR events in background
+			go handleQREvents(qrChan)
+			return
+		} else {
+			log.Printf("QR generation error: %s", evt.Event)
+			if evt.Error != nil {
+				log.Printf("QR error details: %v", evt.Error)
+			}
+			http.Error(w, fmt.Sprintf("QR generation error: %s", evt.Event), http.StatusInternalServerError)
+			return
+		}
+	case <-time.After(qrTimeout):
+		log.Printf("QR code generation timeout after %s", qrTimeout)
+		http.Error(w, "QR code generation timeout - please try again", http.StatusRequestTimeout)
+		return
+	}
+}
+
+// sessionWorks reports whether the stored session can log in, connecting it first if it isn't
+func sessionWorks() bool {
+	if client.IsLoggedIn() {
+		return true
+	}
+	if !client.IsConnected() {
+		log.Println("Checking the existing session before pairing...")
+		if err := client.Connect(); err != nil {
+			log.Printf("Existing session can't connect: %v", err)
+			return false
+		}
+	}
+	if !client.WaitForConnection(reconnectTimeout) {
+		log.Printf("Existing session did not log in within %s", reconnectTimeout)
+		return false
+	}
+	isPaired = true
+	return true
+}
+
+// /pair?method=code - link with an 8-character code entered on the phone instead of scanning a QR code
+func pairCodeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	log.Println("=== PAIRING CODE REQUEST STARTED ===")
+
+	// The number of the phone that will enter the code, with country code
+	number := normalizePhone(r.URL.Query().Get("number"))
+	if len(number) < 8 || len(number) > 15 || strings.HasPrefix(number, "0") {
+		response := APIResponse{
+			Success: false,
+			Message: "number must be the phone's number in international format, e.g. 628123456789",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Unlike QR pairing, an existing session is never replaced here
+	if client.Store.ID != nil {
+		response := APIResponse{
+			Success: false,
+			Message: "Already paired with WhatsApp. Use /disconnect first to link another phone",
+		}
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// A connection left over from an unfinished pairing attempt
+	if client.IsConnected() {
+		client.Disconnect()
+	}
+
+	// The server only accepts pairing codes on a connection that is showing QR codes
+	qrChan, err := client.GetQRChannel(context.Background())
+	if err != nil {
+		log.Printf("Failed to get QR channel: %v", err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to start pairing: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	err = client.Connect()
+	if err != nil {
+		log.Printf("Failed to connect: %v", err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to connect: %v", err),
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Wait for the first QR code, which means the connection is ready for pairing
+	select {
+	case evt := <-qrChan:
+		if evt.Event != whatsmeow.QRChannelEventCode {
+			log.Printf("Pairing failed before a code could be requested: %s %v", evt.Event, evt.Error)
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Pairing failed: %s", evt.Event),
+			}
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	case <-time.After(qrTimeout):
+		log.Printf("Pairing connection not ready after %s", qrTimeout)
+		response := APIResponse{
+			Success: false,
+			Message: "Timed out waiting for WhatsApp - please try again",
+		}
+		w.WriteHeader(http.StatusGatewayTimeout)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	code, err := client.PairPhone(context.Background(), number, true, whatsmeow.PairClientChrome, "Chrome (Linux)")
+	if err != nil {
+		log.Printf("Failed to get pairing code for %s: %v", number, err)
+		client.Disconnect()
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("WhatsApp refused to create a pairing code: %v", err),
+		}
+		status := http.StatusBadGateway
+		switch {
+		case errors.Is(err, whatsmeow.ErrPhoneNumberTooShort), errors.Is(err, whatsmeow.ErrPhoneNumberIsNotInternational):
+			response.Message = fmt.Sprintf("Invalid number: %v", err)
+			status = http.StatusBadRequest
+		case errors.Is(err, whatsmeow.ErrIQBadRequest):
+			response.Message = "WhatsApp rejected the pairing code request; check that the number is registered on WhatsApp"
+		case errors.Is(err, whatsmeow.ErrIQRateOverLimit):
+			response.Message = "Too many pairing code requests for this number, wait a few minutes before trying again"
+			status = http.StatusTooManyRequests
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	log.Printf("Pairing code generated for %s", number)
+	log.Println("=== PAIRING CODE REQUEST COMPLETED ===")
+
+	// The outcome (success, timeout or a pairing error) arrives on the QR channel
+	go handleQREvents(qrChan)
+
+	response := APIResponse{
+		Success: true,
+		Message: "Pairing code generated. On the phone, open Linked Devices > Link a device > Link with phone number instead and enter the code",
+		Data: map[string]interface{}{
+			"code":   code,
+			"number": number,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func handleQREvents(qrChan <-chan whatsmeow.QRChannelItem) {
+	log.Println("=== QR EVENT HANDLER STARTED ===")
+	for evt := range qrChan {
+		log.Printf("QR Event: %s", evt.Event)
+		if evt.Event != whatsmeow.QRChannelEventCode {
+			recordPairing(evt.Event, evt.Error)
+		}
+		switch evt.Event {
+		case whatsmeow.QRChannelEventCode:
+			// A new QR code replaces the previous one every few seconds until pairing completes
+		case "success":
+			isPaired = true
+			log.Println("🎉 Successfully paired with WhatsApp!")
+			log.Printf("Device ID: %s", client.Store.ID.String())
+		case "timeout":
+			log.Println("⏰ QR code pairing timed out.")
+			log.Println("💡 Tips: Check if WhatsApp is open on your phone and try scanning again")
+		case "err-client-outdated":
+			log.Println("🔄 Client is outdated. Please update the application.")
+		case "err-scanned-without-multidevice":
+			log.Println("📱 QR code was scanned but multi-device is not enabled on the phone.")
+			log.Println("💡 Solution: Go to WhatsApp Settings > Linked Devices > Enable multi-device")
+		case "err-device-limit-exceeded":
+			log.Println("🚫 Device limit exceeded on WhatsApp account.")
+			log.Println("💡 Solution: Remove unused devices from WhatsApp Settings > Linked Devices")
+		case "err-already-connected":
+			log.Println("⚠️ Device is already connected to another session.")
+			log.Println("💡 Solution: Disconnect other devices first")
+		case "err-unexpected-state":
+			log.Println("⚠️ Pairing ended in an unexpected state. Please try scanning again.")
+		case "error":
+			if pairingErrorKind(evt.Error) == "device_verification" {
+				log.Printf("🔐 Phone could not verify this device: %v", evt.Error)
+				log.Println("💡 Solution: Make sure the phone isn't waiting for the two-step verification PIN, then unlink and scan a fresh QR code")
+				continue
+			}
+			log.Printf("❌ QR pairing error: %v", evt.Error)
+			if evt.Error != nil {
+				log.Printf("Error details: %s", evt.Error.Error())
+			}
+		default:
+			log.Printf("❓ Unknown QR event: %s", evt.Event)
+		}
+	}
+	log.Println("=== QR EVENT HANDLER ENDED ===")
+}
+
+// pairingErrorKind groups pairing errors so identity verification failures can be told apart from the rest
+func pairingErrorKind(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, whatsmeow.ErrPairInvalidDeviceIdentityHMAC), errors.Is(err, whatsmeow.ErrPairInvalidDeviceSignature):
+		return "device_verification"
+	case errors.Is(err, whatsmeow.ErrPairRejectedLocally):
+		return "rejected_locally"
+	default:
+		return "other"
+	}
+}
+
+// recordPairing remembers the outcome of a QR pairing attempt for /diagnostics
+func recordPairing(event string, err error) {
+	pairingMu.Lock()
+	defer pairingMu.Unlock()
+	pairingEvent = event
+	pairingError = ""
+	if err != nil {
+		pairingError = err.Error()
+	}
+	pairingKind = pairingErrorKind(err)
+	pairingAt = time.Now()
+}
+
+// pairingStatus reports the last pairing attempt, or nil if there was none since startup
+func pairingStatus() map[string]interface{} {
+	pairingMu.Lock()
+	defer pairingMu.Unlock()
+	if pairingAt.IsZero() {
+		return nil
+	}
+	status := map[string]interface{}{
+		"event": pairingEvent,
+		"at":    pairingAt,
+	}
+	if pairingError != "" {
+		status["error"] = pairingError
+		status["error_kind"] = pairingKind
+	}
+	return status
+}
+
+// /send endpoint - send message to a number
+func sendHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		response := APIResponse{
+			Success: false,
+			Message: "Method not allowed. Use POST",
+		}
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req SendRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Validate input
+	if req.Number == "" {
+		response := APIResponse{
+			Success: false,
+			Message: "Number is required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if req.Message == "" && len(req.Attachments) == 0 {
+		response := APIResponse{
+			Success: false,
+			Message: "Either message or attachments are required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if req.DelayMs < 0 || time.Duration(req.DelayMs)*time.Millisecond > maxSendDelay {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("delay_ms must be between 0 and %d", maxSendDelay.Milliseconds()),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// A phone number, "status" or any chat JID (group, broadcast list, newsletter)
+	targetJID, err := resolveSendTarget(req.Number)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid recipient: %v", err),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// ?debug=true adds what WhatsApp returned for each uploaded attachment to the response
+	debug, _ := strconv.ParseBool(r.URL.Query().Get("debug"))
+
+	// Newsletter media needs a different upload and envelope, which isn't supported
+	if sendTargetKind(targetJID) == targetNewsletter && len(req.Attachments) > 0 {
+		response := APIResponse{
+			Success: false,
+			Message: "Attachments can't be sent to newsletters, send text only",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// The client_message_id is reserved before anything is sent, so concurrent retries can't both send.
+	// A key that was already used means this is a retry: of a send that went through, one still in
+	// progress, or one that failed after some of its messages were sent.
+	keyOutcome := ""
+	if req.ClientMessageID != "" {
+		reserved, err := reserveClientMessageID(req.ClientMessageID)
+		var status string
+		var existing []ClientMessage
+		if err == nil && !reserved {
+			status, err = clientMessageStatus(req.ClientMessageID)
+			if err == nil {
+				existing, err = getClientMessages(req.ClientMessageID)
+			}
+		}
+		if err != nil {
+			log.Printf("Failed to reserve client_message_id %s: %v", req.ClientMessageID, err)
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to look up client_message_id: %v", err),
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		if !reserved {
+			log.Printf("client_message_id %s is %s, not sending again", req.ClientMessageID, status)
+			data := map[string]interface{}{
+				"client_message_id": req.ClientMessageID,
+				"duplicate":         true,
+				"status":            status,
+				"messages":          existing,
+			}
+			response := APIResponse{Success: false, Data: data}
+			switch status {
+			case clientMessageComplete:
+				response.Success = true
+				response.Message = "Message with this client_message_id was already sent"
+			case clientMessagePending, "":
+				response.Message = "A send with this client_message_id is still in progress"
+				w.Header().Set("Retry-After", "5")
+				w.WriteHeader(http.StatusConflict)
+			default:
+				response.Message = fmt.Sprintf("A send with this client_message_id failed after %d message(s) went out; it isn't sent again", len(existing))
+				w.WriteHeader(http.StatusConflict)
+			}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		// Released again if the handler returns before sending anything
+		defer func() { finishClientMessageID(req.ClientMessageID, keyOutcome) }()
+	}
+
+	quoteSources := 0
+	for _, set := range []bool{req.Order != nil, req.ReplyTo != "", req.ReplyToLatest} {
+		if set {
+			quoteSources++
+		}
+	}
+	if quoteSources > 1 {
+		response := APIResponse{
+			Success: false,
+			Message: "order, reply_to and reply_to_latest can't be combined, a message can only quote one thing",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Quote shown above the first message: an order, a given message or the latest message of the chat
+	var quote *waProto.ContextInfo
+	var replyTo string
+	if req.ReplyTo != "" {
+		quote, err = buildReplyQuote(targetJID, req.ReplyTo, req.ReplySender, req.QuotedText)
+		if err != nil {
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Invalid reply_to: %v", err),
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		replyTo = req.ReplyTo
+	}
+	if req.Order != nil {
+		quote, err = buildOrderQuote(client, req.Order, targetJID)
+		if err != nil {
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Invalid order: %v", err),
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+
+	messages, err := buildMessages(client, req.Message, req.Attachments, targetJID, resolveFooter(req.Footer))
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to prepare attachment: %v", err),
+		}
+		if errors.Is(err, errMimeTypeMismatch) {
+			response.Data = map[string]interface{}{"code": "MIME_TYPE_MISMATCH"}
+			w.WriteHeader(http.StatusBadRequest)
+		} else if errors.Is(err, errInvalidLocation) {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Without a known earlier message the reply goes out as a normal message
+	if req.ReplyToLatest {
+		latest, err := latestReceivedQuote(targetJID)
+		if err != nil {
+			log.Printf("Failed to look up the latest message in %s, sending without quote: %v", targetJID.String(), err)
+		} else if latest != nil {
+			quote = latest
+			replyTo = latest.GetStanzaID()
+		}
+	}
+
+	if quote != nil {
+		ctx := ensureContextInfo(messages[0])
+		ctx.StanzaID = quote.StanzaID
+		ctx.Participant = quote.Participant
+		ctx.QuotedMessage = quote.QuotedMessage
+	}
+
+	// Send typing indicator before sending messages
+	stopTyping := sendTypingIndicator(targetJID)
+	defer stopTyping()
+
+	// Send all messages one after another in request order; each send waits for the server's ack
+	var sentMessages []map[string]interface{}
+	var messageIDs []string
+	for i, msg := range messages {
+		if i > 0 && req.DelayMs > 0 {
+			time.Sleep(time.Duration(req.DelayMs) * time.Millisecond)
+		}
+
+		// Messages only disappear if they carry the chat's expiration, so persist simply leaves it out
+		if !req.Persist {
+			applyChatTimer(msg, targetJID)
+		}
+
+		sendLimiter.Wait()
+		resp, err := sendMessage(context.Background(), targetJID, msg)
+		if err != nil {
+			log.Printf("Failed to send message %d of %d to %s: %v", i+1, len(messages), targetJID.String(), err)
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to send message %d: %v", i+1, err),
+			}
+			if i > 0 {
+				// The earlier parts were delivered; callers need their IDs to follow up or clean up
+				keyOutcome = clientMessagePartial
+				response.Data = map[string]interface{}{
+					"failed_index": i + 1,
+					"sent":         sentMessages,
+					"message_ids":  messageIDs,
+				}
+			}
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		if req.ClientMessageID != "" {
+			_, err = db.Exec(`INSERT INTO client_messages (client_message_id, idx, message_id, chat)
+				VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`, req.ClientMessageID, i+1, resp.ID, targetJID.String())
+			if err == nil {
+				// Keeps a long multi-part send from looking abandoned
+				_, err = db.Exec(`UPDATE client_message_keys SET updated_at = NOW() WHERE client_message_id = $1`, req.ClientMessageID)
+			}
+			if err != nil {
+				log.Printf("Failed to record client_message_id %s: %v", req.ClientMessageID, err)
+			}
+		}
+
+		messageIDs = append(messageIDs, resp.ID)
+		// The ID and time assigned on the server's ack; later receipts refer to this ID
+		sentInfo := map[string]interface{}{"index": i + 1, "message_id": resp.ID, "timestamp": resp.Timestamp}
+		if resp.ServerID != 0 {
+			sentInfo["server_id"] = resp.ServerID
+		}
+		if req.Message != "" && len(req.Attachments) == 1 && req.Attachments[0].Type == "image" {
+			// Combined message case
+			sentInfo["type"] = "image_with_caption"
+			sentInfo["content"] = req.Message
+			sentInfo["filename"] = req.Attachments[0].Filename
+		} else if i == 0 && req.Message != "" {
+			sentInfo["type"] = "text"
+			sentInfo["content"] = req.Message
+		} else if i > 0 || req.Message == "" {
+			attachmentIndex := i
+			if req.Message != "" {
+				attachmentIndex = i - 1
+			}
+			if attachmentIndex < len(req.Attachments) {
+				sentInfo["type"] = req.Attachments[attachmentIndex].Type
+				sentInfo["filename"] = req.Attachments[attachmentIndex].Filename
+			}
+		}
+		if debug {
+			if upload := uploadDebugInfo(msg); upload != nil {
+				sentInfo["upload"] = upload
+			}
+		}
+		sentMessages = append(sentMessages, sentInfo)
+	}
+
+	data := map[string]interface{}{
+		"number":      req.Number,
+		"message":     req.Message,
+		"attachments": req.Attachments,
+		"sent":        sentMessages,
+		"message_ids": messageIDs,
+	}
+	if req.ClientMessageID != "" {
+		data["client_message_id"] = req.ClientMessageID
+		keyOutcome = clientMessageComplete
+	}
+	if req.ReplyToLatest || req.ReplyTo != "" {
+		data["reply_to"] = replyTo
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Successfully sent %d message(s)", len(messages)),
+		Data:    data,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// States of a client_message_id in client_message_keys
+const (
+	clientMessagePending  = "pending"  // a send is under way
+	clientMessageComplete = "complete" // every message was sent
+	clientMessagePartial  = "partial"  // the send failed after some messages went out
+
+	// A pending key untouched for this long belongs to a send that died with the process
+	clientMessagePendingTimeout = 10 * time.Minute
+)
+
+// reserveClientMessageID claims a client_message_id for a new send and reports whether it got it.
+// A key left pending by a send that died before sending anything is claimed again.
+func reserveClientMessageID(clientMessageID string) (bool, error) {
+	result, err := db.Exec(`INSERT INTO client_message_keys (client_message_id, status) VALUES ($1, 'pending')
+		ON CONFLICT (client_message_id) DO UPDATE SET updated_at = NOW()
+		WHERE client_message_keys.status = 'pending' AND client_message_keys.updated_at < NOW() - make_interval(secs => $2)
+			AND NOT EXISTS (SELECT 1 FROM client_messages WHERE client_message_id = $1)`,
+		clientMessageID, clientMessagePendingTimeout.Seconds())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// finishClientMessageID records how the send of a reserved client_message_id ended. Without an
+// outcome nothing was sent and the key is released, so a retry can send.
+func finishClientMessageID(clientMessageID, outcome string) {
+	var err error
+	if outcome == "" {
+		_, err = db.Exec(`DELETE FROM client_message_keys WHERE client_message_id = $1 AND status = 'pending'`, clientMessageID)
+	} else {
+		_, err = db.Exec(`UPDATE client_message_keys SET status = $2, updated_at = NOW() WHERE client_message_id = $1`, clientMessageID, outcome)
+	}
+	if err != nil {
+		log.Printf("Failed to update client_message_id %s: %v", clientMessageID, err)
+	}
+}
+
+// clientMessageStatus returns the state of a client_message_id, or "" if it was never used. A send
+// that died with the process while pending counts as partial.
+func clientMessageStatus(clientMessageID string) (string, error) {
+	var status string
+	var updatedAt time.Time
+	err := db.QueryRow(`SELECT status, updated_at FROM client_message_keys WHERE client_message_id = $1`, clientMessageID).Scan(&status, &updatedAt)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if status == clientMessagePending && time.Since(updatedAt) > clientMessagePendingTimeout {
+		status = clientMessagePartial
+	}
+	return status, nil
+}
+
+// getClientMessages returns the messages sent for a client_message_id, in send order
+func getClientMessages(clientMessageID string) ([]ClientMessage, error) {
+	rows, err := db.Query(`SELECT client_message_id, message_id, chat, idx, created_at
+		FROM client_messages WHERE client_message_id = $1 ORDER BY idx`, clientMessageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []ClientMessage{}
+	for rows.Next() {
+		var m ClientMessage
+		if err := rows.Scan(&m.ClientMessageID, &m.MessageID, &m.Chat, &m.Index, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// /client-messages/{id} endpoint - resolve a client_message_id to the WhatsApp message IDs it produced
+func clientMessageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	clientMessageID := mux.Vars(r)["id"]
+	messages, err := getClientMessages(clientMessageID)
+	if err != nil {
+		log.Printf("Failed to look up client_message_id %s: %v", clientMessageID, err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to look up client_message_id: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	status, err := clientMessageStatus(clientMessageID)
+	if err != nil {
+		log.Printf("Failed to look up client_message_id %s: %v", clientMessageID, err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to look up client_message_id: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if len(messages) == 0 && status == "" {
+		response := APIResponse{
+			Success: false,
+			Message: "No messages were sent with this client_message_id",
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Client message retrieved successfully",
+		Data: map[string]interface{}{
+			"client_message_id": clientMessageID,
+			"status":            status,
+			"messages":          messages,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// buildMessages turns a text message and attachments into the WhatsApp messages to send.
+// A text message with a single image attachment is combined into one captioned image.
+func buildMessages(c *whatsmeow.Client, text string, attachments []Attachment, targetJID types.JID, footer string) ([]*waProto.Message, error) {
+	var messages []*waProto.Message
+
+	// Check if we have text + single image attachment to combine
+	if text != "" && len(attachments) == 1 && attachments[0].Type == "image" {
+		// Combine text as image caption
+		attachment := attachments[0]
+		attachment.Caption = text // Use text message as caption
+		attachmentMsg, err := prepareAttachmentMessage(c, attachment, targetJID)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, attachmentMsg)
+	} else {
+		// Add text message if provided
+		if text != "" {
+			messages = append(messages, &waProto.Message{
+				Conversation: proto.String(text),
+			})
+		}
+
+		// Process attachments
+		for _, attachment := range attachments {
+			attachmentMsg, err := prepareAttachmentMessage(c, attachment, targetJID)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, attachmentMsg)
+		}
+	}
+
+	for _, msg := range messages {
+		applyFooter(msg, footer)
+	}
+	return messages, nil
+}
+
+// resolveFooter returns the footer of one send: the request's own when given (empty for none),
+// otherwise WA_MESSAGE_FOOTER
+func resolveFooter(override *string) string {
+	if override != nil {
+		return *override
+	}
+	if footer := messageFooter.Load(); footer != nil {
+		return *footer
+	}
+	return ""
+}
+
+// applyFooter appends the footer to the text or caption of an outgoing message. Media without a
+// caption gets the footer as caption; messages that can't carry text (audio, stickers) are left as is.
+func applyFooter(msg *waProto.Message, footer string) {
+	if footer == "" {
+		return
+	}
+	withFooter := func(text string) *string {
+		if text == "" {
+			return proto.String(footer)
+		}
+		return proto.String(text + footerSeparator + footer)
+	}
+
+	switch {
+	case msg.Conversation != nil:
+		msg.Conversation = withFooter(msg.GetConversation())
+	case msg.ExtendedTextMessage != nil:
+		msg.ExtendedTextMessage.Text = withFooter(msg.ExtendedTextMessage.GetText())
+	case msg.ImageMessage != nil:
+		msg.ImageMessage.Caption = withFooter(msg.ImageMessage.GetCaption())
+	case msg.VideoMessage != nil:
+		msg.VideoMessage.Caption = withFooter(msg.VideoMessage.GetCaption())
+	case msg.DocumentMessage != nil:
+		msg.DocumentMessage.Caption = withFooter(msg.DocumentMessage.GetCaption())
+	case msg.InteractiveMessage != nil:
+		if msg.InteractiveMessage.Body == nil {
+			msg.InteractiveMessage.Body = &waE2E.InteractiveMessage_Body{}
+		}
+		msg.InteractiveMessage.Body.Text = withFooter(msg.InteractiveMessage.Body.GetText())
+	case msg.RequestPaymentMessage != nil:
+		if msg.RequestPaymentMessage.NoteMessage == nil {
+			msg.RequestPaymentMessage.NoteMessage = &waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{}}
+		}
+		applyFooter(msg.RequestPaymentMessage.NoteMessage, footer)
+	}
+}
+
+// latestReceivedQuote builds a quote of the last message received in a chat from the message store,
+// or returns nil if none is known
+func latestReceivedQuote(chat types.JID) (*waProto.ContextInfo, error) {
+	var id, sender string
+	var raw []byte
+	err := db.QueryRow(`SELECT id, sender, raw FROM messages
+		WHERE chat = $1 AND from_me = FALSE AND deleted_at IS NULL AND type <> 'reaction' AND raw IS NOT NULL
+		ORDER BY timestamp DESC LIMIT 1`, chat.String()).Scan(&id, &sender, &raw)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return storedMessageQuote(id, sender, raw)
+}
+
+// buildReplyQuote builds the quote for a reply to the message with the given ID. The quoted message is
+// taken from the message store when known; otherwise the preview is built from quotedText.
+func buildReplyQuote(chat types.JID, id, sender, quotedText string) (*waProto.ContextInfo, error) {
+	var participant string
+	if sender != "" {
+		senderJID, err := resolveSendTarget(sender, targetUser)
+		if err != nil {
+			return nil, fmt.Errorf("reply_sender: %v", err)
+		}
+		participant = senderJID.String()
+	}
+
+	var storedSender string
+	var raw []byte
+	err := db.QueryRow(`SELECT sender, raw FROM messages WHERE chat = $1 AND id = $2 AND raw IS NOT NULL`,
+		chat.String(), id).Scan(&storedSender, &raw)
+	if err == nil {
+		if participant == "" {
+			participant = storedSender
+		}
+		return storedMessageQuote(id, participant, raw)
+	}
+	if err != sql.ErrNoRows {
+		log.Printf("Failed to look up message %s to quote, using quoted_text: %v", id, err)
+	}
+
+	// Without the stored message the consumer has to say what is being quoted
+	if strings.TrimSpace(quotedText) == "" {
+		return nil, fmt.Errorf("message %s isn't stored, so quoted_text is required", id)
+	}
+
+	// In a private chat an unknown message is assumed to be theirs; in a group it could be anyone's
+	if participant == "" {
+		if chat.Server == types.GroupServer {
+			return nil, fmt.Errorf("reply_sender is required to quote a group message that isn't stored")
+		}
+		participant = chat.String()
+	}
+	return &waProto.ContextInfo{
+		StanzaID:      proto.String(id),
+		Participant:   proto.String(participant),
+		QuotedMessage: &waProto.Message{Conversation: proto.String(quotedText)},
+	}, nil
+}
+
+// storedMessageQuote builds a quote of a message from its stored raw protobuf
+func storedMessageQuote(id, sender string, raw []byte) (*waProto.ContextInfo, error) {
+	quoted := &waProto.Message{}
+	if err := proto.Unmarshal(raw, quoted); err != nil {
+		return nil, fmt.Errorf("failed to decode stored message %s: %v", id, err)
+	}
+	// The message secret belongs to the original message and must not be reused
+	quoted.MessageContextInfo = nil
+
+	// Stored senders can carry the device they sent from, but quotes name the account
+	if senderJID, err := types.ParseJID(sender); err == nil {
+		sender = senderJID.ToNonAD().String()
+	}
+
+	return &waProto.ContextInfo{
+		StanzaID:      proto.String(id),
+		Participant:   proto.String(sender),
+		QuotedMessage: quoted,
+	}, nil
+}
+
+// buildOrderQuote validates an order and builds the quote that shows it above a message. WhatsApp
+// renders the quote from the embedded order message, so it needs no earlier message to point at.
+func buildOrderQuote(c *whatsmeow.Client, order *OrderContext, targetJID types.JID) (*waProto.ContextInfo, error) {
+	order.OrderID = strings.TrimSpace(order.OrderID)
+	order.Title = strings.TrimSpace(order.Title)
+	order.Currency = strings.ToUpper(order.Currency)
+
+	switch {
+	case order.OrderID == "":
+		return nil, fmt.Errorf("order_id is required")
+	case order.Title == "":
+		return nil, fmt.Errorf("title is required")
+	case len([]rune(order.Title)) > maxOrderTitleLength:
+		return nil, fmt.Errorf("title must be at most %d characters", maxOrderTitleLength)
+	case order.ItemCount < 0:
+		return nil, fmt.Errorf("item_count can't be negative")
+	case order.Total < 0:
+		return nil, fmt.Errorf("total can't be negative")
+	case order.Total > 0 && len(order.Currency) != 3:
+		return nil, fmt.Errorf("a 3-letter ISO 4217 currency is required with total")
+	}
+
+	orderMsg := &waProto.OrderMessage{
+		OrderID:    proto.String(order.OrderID),
+		OrderTitle: proto.String(order.Title),
+		Message:    proto.String(order.Title),
+		Status:     waProto.OrderMessage_ACCEPTED.Enum(),
+		Surface:    waProto.OrderMessage_CATALOG.Enum(),
+		SellerJID:  proto.String(c.Store.ID.ToNonAD().String()),
+	}
+	if order.ItemCount > 0 {
+		orderMsg.ItemCount = proto.Int32(int32(order.ItemCount))
+	}
+	if order.Total > 0 {
+		orderMsg.TotalAmount1000 = proto.Int64(int64(order.Total*1000 + 0.5))
+		orderMsg.TotalCurrencyCode = proto.String(order.Currency)
+	}
+
+	if order.Thumbnail != "" {
+		thumbnail, err := orderThumbnail(order.Thumbnail)
+		if err != nil {
+			return nil, fmt.Errorf("thumbnail: %v", err)
+		}
+		orderMsg.Thumbnail = thumbnail
+	}
+
+	return &waProto.ContextInfo{
+		StanzaID:      proto.String(c.GenerateMessageID()),
+		Participant:   proto.String(targetJID.String()),
+		QuotedMessage: &waProto.Message{OrderMessage: orderMsg},
+	}, nil
+}
+
+// orderThumbnail loads an image from a URL or base64 data and scales it down to a small JPEG
+func orderThumbnail(source string) ([]byte, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		data, _, err = downloadFile(source)
+	} else if strings.HasPrefix(source, "data:") {
+		data, _, err = decodeDataURI(source)
+	} else {
+		data, err = decodeBase64(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > orderThumbnailSize || height > orderThumbnailSize {
+		if width >= height {
+			height = height * orderThumbnailSize / width
+			width = orderThumbnailSize
+		} else {
+			width = width * orderThumbnailSize / height
+			height = orderThumbnailSize
+		}
+	}
+	// JPEG has no transparency, so transparent areas end up white instead of black
+	scaled := image.NewRGBA(image.Rect(0, 0, max(width, 1), max(height, 1)))
+	draw.Draw(scaled, scaled.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: jpegQuality})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// /send-album endpoint - send images and videos grouped as a single album
+func sendAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req SendAlbumRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if req.Number == "" {
+		response := APIResponse{
+			Success: false,
+			Message: "Number is required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if len(req.Attachments) < minAlbumItems || len(req.Attachments) > maxAlbumItems {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("An album needs between %d and %d attachments", minAlbumItems, maxAlbumItems),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var imageCount, videoCount uint32
+	for i, attachment := range req.Attachments {
+		switch attachment.Type {
+		case "image":
+			imageCount++
+		case "video":
+			videoCount++
+		default:
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Attachment %d: albums can only contain images and videos", i+1),
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+
+	targetJID, err := resolveSendTarget(req.Number, targetUser, targetGroup)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid phone number: %v", err),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Upload everything before sending so a failed upload doesn't leave a half-sent album
+	items, err := buildMessages(client, "", req.Attachments, targetJID, resolveFooter(req.Footer))
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to prepare attachment: %v", err),
+		}
+		if errors.Is(err, errMimeTypeMismatch) {
+			response.Data = map[string]interface{}{"code": "MIME_TYPE_MISMATCH"}
+			w.WriteHeader(http.StatusBadRequest)
+		} else if errors.Is(err, errInvalidLocation) {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	stopTyping := sendTypingIndicator(targetJID)
+	defer stopTyping()
+
+	// The album header announces the items; each item then points back at it
+	albumID := client.GenerateMessageID()
+	header := &waProto.Message{
+		AlbumMessage: &waE2E.AlbumMessage{
+			ExpectedImageCount: proto.Uint32(imageCount),
+			ExpectedVideoCount: proto.Uint32(videoCount),
+		},
+	}
+	if !req.Persist {
+		applyChatTimer(header, targetJID)
+	}
+	sendLimiter.Wait()
+	_, err = sendMessage(context.Background(), targetJID, header, whatsmeow.SendRequestExtra{ID: albumID})
+	if err != nil {
+		log.Printf("Failed to send album header to %s: %v", targetJID.String(), err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to send album: %v", err),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	messageIDs := make([]string, 0, len(items))
+	for i, msg := range items {
+		msg.MessageContextInfo = &waProto.MessageContextInfo{
+			MessageAssociation: &waE2E.MessageAssociation{
+				AssociationType: waE2E.MessageAssociation_MEDIA_ALBUM.Enum(),
+				ParentMessageKey: &waProto.MessageKey{
+					RemoteJID: proto.String(targetJID.String()),
+					FromMe:    proto.Bool(true),
+					ID:        proto.String(albumID),
+				},
+				MessageIndex: proto.Int32(int32(i)),
+			},
+		}
+		if !req.Persist {
+			applyChatTimer(msg, targetJID)
+		}
+
+		sendLimiter.Wait()
+		resp, err := sendMessage(context.Background(), targetJID, msg)
+		if err != nil {
+			log.Printf("Failed to send album item %d to %s: %v", i+1, targetJID.String(), err)
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to send album item %d: %v", i+1, err),
+				Data: map[string]interface{}{
+					"album_id":    albumID,
+					"message_ids": messageIDs,
+				},
+			}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		messageIDs = append(messageIDs, resp.ID)
+	}
+
+	log.Printf("Album %s sent to %s with %d item(s)", albumID, targetJID.String(), len(items))
+
+	response := APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Successfully sent album with %d item(s)", len(items)),
+		Data: map[string]interface{}{
+			"number":      req.Number,
+			"album_id":    albumID,
+			"message_ids": messageIDs,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// takeLocationRequest returns and clears the outstanding location request for a chat, if any
+func takeLocationRequest(chat types.JID) string {
+	locationRequestsMu.Lock()
+	defer locationRequestsMu.Unlock()
+
+	request, ok := locationRequests[chat.ToNonAD().String()]
+	if !ok {
+		return ""
+	}
+	delete(locationRequests, chat.ToNonAD().String())
+	if time.Since(request.sentAt) > locationRequestTTL {
+		return ""
+	}
+	return request.id
+}
+
+// /request-location endpoint - ask the recipient to share their location
+func requestLocationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req RequestLocationRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Number == "" {
+		response := APIResponse{
+			Success: false,
+			Message: "Number is required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if req.Message == "" {
+		req.Message = "Please share your location"
+	}
+
+	targetJID, err := resolveSendTarget(req.Number, targetUser, targetGroup)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid phone number: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// A native flow "send_location" button opens the location picker on the recipient's phone
+	msg := &waProto.Message{
+		InteractiveMessage: &waE2E.InteractiveMessage{
+			Body: &waE2E.InteractiveMessage_Body{
+				Text: proto.String(req.Message),
+			},
+			InteractiveMessage: &waE2E.InteractiveMessage_NativeFlowMessage_{
+				NativeFlowMessage: &waE2E.InteractiveMessage_NativeFlowMessage{
+					Buttons: []*waE2E.InteractiveMessage_NativeFlowMessage_NativeFlowButton{
+						{
+							Name:             proto.String("send_location"),
+							ButtonParamsJSON: proto.String("{}"),
+						},
+					},
+				},
+			},
+		},
+	}
+	applyFooter(msg, resolveFooter(req.Footer))
+	applyChatTimer(msg, targetJID)
+
+	stopTyping := sendTypingIndicator(targetJID)
+	defer stopTyping()
+	sendLimiter.Wait()
+	resp, err := sendMessage(context.Background(), targetJID, msg)
+	if err != nil {
+		log.Printf("Failed to send location request to %s: %v", targetJID.String(), err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to send location request: %v", err),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// A newer request to the same chat replaces the previous one
+	locationRequestsMu.Lock()
+	locationRequests[targetJID.String()] = locationRequest{id: resp.ID, sentAt: time.Now()}
+	locationRequestsMu.Unlock()
+
+	log.Printf("Location request %s sent to %s", resp.ID, targetJID.String())
+
+	response := APIResponse{
+		Success: true,
+		Message: "Location request sent successfully",
+		Data: map[string]interface{}{
+			"number":     req.Number,
+			"request_id": resp.ID,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /send-sticker endpoint - turn any image into a sticker and send it
+func sendStickerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req SendStickerRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Number == "" || req.Image == "" {
+		response := APIResponse{
+			Success: false,
+			Message: "Number and image are required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	targetJID, err := resolveSendTarget(req.Number, targetUser, targetGroup)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid phone number: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var data []byte
+	if strings.HasPrefix(req.Image, "http://") || strings.HasPrefix(req.Image, "https://") {
+		data, _, err = downloadFile(req.Image)
+	} else if strings.HasPrefix(req.Image, "data:") {
+		data, _, err = decodeDataURI(req.Image)
+	} else {
+		data, err = decodeBase64(req.Image)
+	}
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to load image: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	sticker, err := convertImageToSticker(data)
+	if err != nil {
+		log.Printf("Failed to convert image to sticker: %v", err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to convert image to sticker: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	log.Printf("Sticker created: %d bytes", len(sticker))
+
+	uploaded, err := client.Upload(context.Background(), sticker, whatsmeow.MediaImage)
+	if err != nil {
+		log.Printf("Failed to upload sticker: %v", err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to upload sticker: %v", err),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	recordUpload(len(sticker))
+
+	msg := &waProto.Message{
+		StickerMessage: &waProto.StickerMessage{
+			URL:               &uploaded.URL,
+			DirectPath:        &uploaded.DirectPath,
+			Mimetype:          proto.String("image/webp"),
+			FileLength:        proto.Uint64(uint64(len(sticker))),
+			MediaKey:          uploaded.MediaKey,
+			FileEncSHA256:     uploaded.FileEncSHA256,
+			FileSHA256:        uploaded.FileSHA256,
+			Width:             proto.Uint32(stickerSize),
+			Height:            proto.Uint32(stickerSize),
+			MediaKeyTimestamp: proto.Int64(time.Now().Unix()),
+			IsAnimated:        proto.Bool(false),
+		},
+	}
+	applyChatTimer(msg, targetJID)
+
+	sendLimiter.Wait()
+	resp, err := sendMessage(context.Background(), targetJID, msg)
+	if err != nil {
+		log.Printf("Failed to send sticker to %s: %v", targetJID.String(), err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to send sticker: %v", err),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Sticker sent successfully",
+		Data: map[string]interface{}{
+			"number":     req.Number,
+			"message_id": resp.ID,
+			"size":       len(sticker),
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /test-send endpoint - send a short text to our own number as an end-to-end smoke test
+func testSendHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() || client.Store.ID == nil {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// The text is optional, so an empty body is fine
+	var req struct {
+		Message string `json:"message"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			response := APIResponse{
+				Success: false,
+				Message: "Invalid request body",
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+	if req.Message == "" {
+		req.Message = fmt.Sprintf("✅ Test message from whatsapp-web-api %s (%s)", version, time.Now().Format(time.RFC1123))
+	}
+
+	// Lands in the "Message yourself" chat on the phone
+	ownJID := client.Store.ID.ToNonAD()
+	msg := &waProto.Message{Conversation: proto.String(req.Message)}
+	applyFooter(msg, resolveFooter(nil))
+
+	sendLimiter.Wait()
+	start := time.Now()
+	resp, err := sendMessage(context.Background(), ownJID, msg)
+	if err != nil {
+		log.Printf("Test send to %s failed: %v", ownJID.String(), err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Test send failed: %v", err),
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	log.Printf("✅ Test message sent to own number %s (ID: %s)", ownJID.String(), resp.ID)
+
+	response := APIResponse{
+		Success: true,
+		Message: "Test message sent to your own number",
+		Data: map[string]interface{}{
+			"to":         ownJID.String(),
+			"message":    req.Message,
+			"message_id": resp.ID,
+			"timestamp":  resp.Timestamp,
+			"ack_ms":     time.Since(start).Milliseconds(),
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /react endpoint - react to a message with an emoji, or remove our reaction with an empty one
+func reactHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req ReactRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if req.Chat == "" {
+		req.Chat = req.Number
+	}
+	if err != nil || req.Chat == "" || req.MessageID == "" || req.Sender == "" {
+		response := APIResponse{
+			Success: false,
+			Message: "Number (or chat), message_id and sender are required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chatJID, err := resolveSendTarget(req.Chat, targetUser, targetGroup)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid chat: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	senderJID, err := resolveSendTarget(req.Sender, targetUser)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid sender: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// The message key marks our own messages as from_me when sender is the linked number
+	msg := client.BuildReaction(chatJID, senderJID, req.MessageID, req.Emoji)
+	sendLimiter.Wait()
+	resp, err := sendMessage(context.Background(), chatJID, msg)
+	if err != nil {
+		log.Printf("Failed to react to %s in %s: %v", req.MessageID, chatJID.String(), err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to send reaction: %v", err),
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	removed := req.Emoji == ""
+	if removed {
+		log.Printf("Removed reaction from message %s in %s", req.MessageID, chatJID.String())
+	} else {
+		log.Printf("Reacted %s to message %s in %s", req.Emoji, req.MessageID, chatJID.String())
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Reaction sent",
+		Data: map[string]interface{}{
+			"id":         resp.ID,
+			"chat":       chatJID.String(),
+			"message_id": req.MessageID,
+			"emoji":      req.Emoji,
+			"removed":    removed,
+			"timestamp":  resp.Timestamp,
+		},
+	}
+	if removed {
+		response.Message = "Reaction removed"
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /send-if-active endpoint - send a text only if the contact was online within a given period
+func sendIfActiveHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req SendIfActiveRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Number == "" || req.Message == "" || req.Within == "" {
+		response := APIResponse{
+			Success: false,
+			Message: "Number, message and within are required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Days aren't a Go duration unit but are the natural unit for activity windows
+	var within time.Duration
+	if days, found := strings.CutSuffix(req.Within, "d"); found {
+		var n int
+		n, err = strconv.Atoi(days)
+		within = time.Duration(n) * 24 * time.Hour
+	} else {
+		within, err = time.ParseDuration(req.Within)
+	}
+	if err != nil || within <= 0 {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid within %q, use a duration like \"30m\", \"72h\" or \"7d\"", req.Within),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	targetJID, err := resolveSendTarget(req.Number, targetUser)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid recipient: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	data := map[string]interface{}{
+		"number": req.Number,
+		"within": within.String(),
+		"sent":   false,
+	}
+	skip := func(reason, message string) {
+		log.Printf("Not sending to %s: %s", targetJID.String(), message)
+		data["reason"] = reason
+		response := APIResponse{
+			Success: true,
+			Message: message,
+			Data:    data,
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+
+	// Contacts' presence is only shared with accounts that announce their own
+	presenceMu.Lock()
+	ownPresence := accountPresence
+	presenceMu.Unlock()
+	if ownPresence != types.PresenceAvailable {
+		skip("own_presence_unavailable", "Contact presence is not shared while our presence is unavailable, see /config/presence")
+		return
+	}
+
+	subscribeChatPresence(targetJID)
+	presence, ok := waitForContactPresence(targetJID, presenceWaitTimeout)
+	if !ok {
+		skip("presence_hidden", "The contact doesn't share their presence")
+		return
+	}
+	data["online"] = presence.Online
+	if !presence.LastSeen.IsZero() {
+		data["last_seen"] = presence.LastSeen
+	}
+	switch {
+	case presence.Online:
+	case presence.LastSeen.IsZero():
+		skip("last_seen_hidden", "The contact hides their last seen")
+		return
+	case time.Since(presence.LastSeen) > within:
+		skip("inactive", fmt.Sprintf("The contact was last seen %s ago", time.Since(presence.LastSeen).Round(time.Minute)))
+		return
+	}
+
+	msg := &waProto.Message{Conversation: proto.String(req.Message)}
+	applyFooter(msg, resolveFooter(req.Footer))
+	applyChatTimer(msg, targetJID)
+
+	stopTyping := sendTypingIndicator(targetJID)
+	defer stopTyping()
+
+	sendLimiter.Wait()
+	resp, err := sendMessage(context.Background(), targetJID, msg)
+	if err != nil {
+		log.Printf("Failed to send to %s: %v", targetJID.String(), err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to send message: %v", err),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	log.Printf("Sent to active contact %s (ID: %s)", targetJID.String(), resp.ID)
+
+	data["sent"] = true
+	data["message_id"] = resp.ID
+	data["timestamp"] = resp.Timestamp
+	response := APIResponse{
+		Success: true,
+		Message: "Message sent, the contact was active recently",
+		Data:    data,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /send-contact endpoint - share a contact card, optionally checking that its number is on WhatsApp first
+func sendContactHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req SendContactRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	cards := req.Contacts
+	if len(cards) == 0 {
+		cards = []ContactCard{req.ContactCard}
+	}
+	if err != nil || req.Number == "" || slices.ContainsFunc(cards, func(card ContactCard) bool {
+		return card.VCard == "" && (card.Name == "" || normalizePhone(card.Phone) == "")
+	}) {
+		response := APIResponse{
+			Success: false,
+			Message: "Number and either vcard or name and phone for every contact are required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	targetJID, err := resolveSendTarget(req.Number, targetUser, targetGroup)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid recipient: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	vcards := make([]string, len(cards))
+	contacts := make([]VCardContact, len(cards))
+	for i, card := range cards {
+		vcards[i] = card.VCard
+		if vcards[i] == "" {
+			vcards[i] = buildVCard(card.Name, card.Organization, card.Phone)
+		}
+		contacts[i] = parseVCard(vcards[i])
+		if len(contacts[i].Phones) == 0 {
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("The vCard of %s has no phone number", contactLabel(i, len(cards))),
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+
+	var validation []ContactValidation
+	if req.Validate {
+		var phones []string
+		for _, contact := range contacts {
+			for _, phone := range contact.Phones {
+				phones = append(phones, "+"+normalizePhone(phone.Number))
+			}
+		}
+		resolved, err := client.IsOnWhatsApp(phones)
+		if err != nil {
+			log.Printf("Failed to check contact numbers: %v", err)
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to check contact numbers: %v", err),
+			}
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		waIDs := make(map[string]string)
+		for _, res := range resolved {
+			result := ContactValidation{Phone: res.Query, OnWhatsApp: res.IsIn}
+			if res.IsIn {
+				result.JID = res.JID.String()
+				waIDs[normalizePhone(res.Query)] = res.JID.User
+			}
+			validation = append(validation, result)
+		}
+		for i, contact := range contacts {
+			onWhatsApp := slices.ContainsFunc(contact.Phones, func(phone VCardPhone) bool {
+				return waIDs[normalizePhone(phone.Number)] != ""
+			})
+			if !onWhatsApp {
+				response := APIResponse{
+					Success: false,
+					Message: fmt.Sprintf("The phone number of %s is not on WhatsApp", contactLabel(i, len(cards))),
+					Data: map[string]interface{}{
+						"on_whatsapp": false,
+						"validation":  validation,
+					},
+				}
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				json.NewEncoder(w).Encode(response)
+				return
+			}
+
+			// With a waid the card gets WhatsApp's "Message" button
+			vcards[i] = addVCardWaIDs(vcards[i], waIDs)
+		}
+	}
+
+	contactMsgs := make([]*waProto.ContactMessage, len(cards))
+	displayNames := make([]string, len(cards))
+	for i, card := range cards {
+		displayNames[i] = card.DisplayName
+		if displayNames[i] == "" {
+			displayNames[i] = contacts[i].Name
+		}
+		if displayNames[i] == "" {
+			displayNames[i] = contacts[i].Phones[0].Number
+		}
+		contactMsgs[i] = &waProto.ContactMessage{
+			DisplayName: proto.String(displayNames[i]),
+			Vcard:       proto.String(vcards[i]),
+		}
+	}
+
+	// Several cards go out together as one contacts message
+	displayName := displayNames[0]
+	msg := &waProto.Message{ContactMessage: contactMsgs[0]}
+	if len(cards) > 1 {
+		displayName = fmt.Sprintf("%d contacts", len(cards))
+		msg = &waProto.Message{
+			ContactsArrayMessage: &waProto.ContactsArrayMessage{
+				DisplayName: proto.String(displayName),
+				Contacts:    contactMsgs,
+			},
+		}
+	}
+	applyChatTimer(msg, targetJID)
+
+	sendLimiter.Wait()
+	resp, err := sendMessage(context.Background(), targetJID, msg)
+	if err != nil {
+		log.Printf("Failed to send contact to %s: %v", targetJID.String(), err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to send contact: %v", err),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	data := map[string]interface{}{
+		"number":       req.Number,
+		"message_id":   resp.ID,
+		"display_name": displayName,
+	}
+	if len(cards) > 1 {
+		data["contacts"] = displayNames
+	}
+	if req.Validate {
+		data["on_whatsapp"] = true
+		data["validation"] = validation
+	}
+	response := APIResponse{
+		Success: true,
+		Message: "Contact sent successfully",
+		Data:    data,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// contactLabel names the i-th of n shared contacts in error messages
+func contactLabel(i, n int) string {
+	if n == 1 {
+		return "the contact"
+	}
+	return fmt.Sprintf("contact %d", i+1)
+}
+
+// buildVCard creates a minimal vCard 3.0 for a single phone number
+func buildVCard(name, organization, phone string) string {
+	var b strings.Builder
+	b.WriteString("BEGIN:VCARD\nVERSION:3.0\n")
+	fmt.Fprintf(&b, "N:;%s;;;\nFN:%s\n", name, name)
+	if organization != "" {
+		fmt.Fprintf(&b, "ORG:%s\n", organization)
+	}
+	fmt.Fprintf(&b, "TEL;type=CELL:+%s\n", normalizePhone(phone))
+	b.WriteString("END:VCARD")
+	return b.String()
+}
+
+// addVCardWaIDs adds the waid parameter to TEL lines of numbers found on WhatsApp that don't have one yet
+func addVCardWaIDs(vcard string, waIDs map[string]string) string {
+	lines := strings.Split(vcard, "\n")
+	for i, line := range lines {
+		sep := strings.Index(line, ":")
+		if sep <= 0 {
+			continue
+		}
+		params := strings.ToUpper(line[:sep])
+		if name := strings.Split(params, ";")[0]; name != "TEL" && !strings.HasSuffix(name, ".TEL") {
+			continue
+		}
+		if strings.Contains(params, "WAID=") {
+			continue
+		}
+		if waID, ok := waIDs[normalizePhone(line[sep+1:])]; ok {
+			lines[i] = line[:sep] + ";waid=" + waID + line[sep:]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// /send-bulk endpoint - send the same message to many numbers, messaging each WhatsApp account once
+func sendBulkHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req BulkSendRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if len(req.Numbers) == 0 {
+		response := APIResponse{
+			Success: false,
+			Message: "At least one number is required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if req.Message == "" && len(req.Attachments) == 0 {
+		response := APIResponse{
+			Success: false,
+			Message: "Either message or attachments are required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Resolve every number to its WhatsApp JID; differently formatted numbers for the same person resolve to the same JID
+	phones := make([]string, len(req.Numbers))
+	for i, number := range req.Numbers {
+		phones[i] = "+" + normalizePhone(number)
+	}
+	resolved, err := client.IsOnWhatsApp(phones)
+	if err != nil {
+		log.Printf("Failed to resolve numbers: %v", err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to resolve numbers: %v", err),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	jidByPhone := make(map[string]types.JID)
+	for _, res := range resolved {
+		if res.IsIn {
+			jidByPhone[normalizePhone(res.Query)] = res.JID
+		}
+	}
+
+	// Upload attachments once and reuse them for every recipient
+	messages, err := buildMessages(client, req.Message, req.Attachments, types.EmptyJID, resolveFooter(req.Footer))
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to prepare attachment: %v", err),
+		}
+		if errors.Is(err, errMimeTypeMismatch) {
+			response.Data = map[string]interface{}{"code": "MIME_TYPE_MISMATCH"}
+			w.WriteHeader(http.StatusBadRequest)
+		} else if errors.Is(err, errInvalidLocation) {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	results := make([]BulkSendResult, 0, len(req.Numbers))
+	firstNumberForJID := make(map[types.JID]string)
+	sent, failed, duplicates, notOnWhatsApp := 0, 0, 0, 0
+	for _, number := range req.Numbers {
+		result := BulkSendResult{Number: number}
+
+		targetJID, ok := jidByPhone[normalizePhone(number)]
+		if !ok {
+			result.Status = "not_on_whatsapp"
+			notOnWhatsApp++
+			results = append(results, result)
+			continue
+		}
+		result.JID = targetJID.String()
+
+		if first, seen := firstNumberForJID[targetJID]; seen {
+			log.Printf("Skipping %s: same WhatsApp account as %s", number, first)
+			result.Status = "duplicate"
+			result.DuplicateOf = first
+			duplicates++
+			results = append(results, result)
+			continue
+		}
+		firstNumberForJID[targetJID] = number
+
+		stopTyping := sendTypingIndicator(targetJID)
+		for _, msg := range messages {
+			// Each recipient gets its own copy since the disappearing timer is per chat
+			msg = proto.Clone(msg).(*waProto.Message)
+			if !req.Persist {
+				applyChatTimer(msg, targetJID)
+			}
+
+			sendLimiter.Wait()
+			resp, err := sendMessage(context.Background(), targetJID, msg)
+			if err != nil {
+				log.Printf("Failed to send to %s: %v", targetJID.String(), err)
+				result.Error = err.Error()
+				break
+			}
+			result.MessageIDs = append(result.MessageIDs, resp.ID)
+		}
+		stopTyping()
+
+		if result.Error != "" {
+			result.Status = "failed"
+			failed++
+		} else {
+			result.Status = "sent"
+			sent++
+		}
+		results = append(results, result)
+	}
+
+	log.Printf("Bulk send complete: %d sent, %d failed, %d duplicate, %d not on WhatsApp", sent, failed, duplicates, notOnWhatsApp)
+
+	response := APIResponse{
+		Success: failed == 0,
+		Message: fmt.Sprintf("Sent to %d recipient(s), skipped %d duplicate(s)", sent, duplicates),
+		Data: map[string]interface{}{
+			"sent":            sent,
+			"failed":          failed,
+			"duplicates":      duplicates,
+			"not_on_whatsapp": notOnWhatsApp,
+			"results":         results,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Health check endpoint
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	status := map[string]interface{}{
+		"version":            version,
+		"uptime_seconds":     int64(time.Since(startTime).Seconds()),
+		"paired":             isPaired,
+		"connected":          client != nil && client.IsConnected(),
+		"webhook_configured": webhookURL != "",
+		"rate_limited":       false,
+	}
+	if until, reason, active := defaultCooldown.Status(); active {
+		status["rate_limited"] = reason == "rate_limited"
+		status["cooldown_reason"] = reason
+		status["cooldown_until"] = until
+		if reason == "temporary_ban" {
+			status["banned_until"] = until
+		}
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "WhatsApp service is running",
+		Data:    status,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Diagnostics endpoint - runtime details for troubleshooting
+func diagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	diagnostics := map[string]interface{}{
+		"paired":         isPaired,
+		"connected":      client != nil && client.IsConnected(),
+		"auto_read":      autoRead.Load(),
+		"presence":       presenceStatus(),
+		"app_state_sync": appStateSyncStatus(),
+		"bandwidth": map[string]interface{}{
+			"uploaded_bytes":   bytesUploaded.Load(),
+			"downloaded_bytes": bytesDownloaded.Load(),
+			"uploads":          uploadCount.Load(),
+			"downloads":        downloadCount.Load(),
+		},
+		"undecryptable": map[string]interface{}{
+			"failed":    undecryptableCount.Load(),
+			"recovered": undecryptableRecovered.Load(),
+		},
+		"offline_sync":   offlineSyncStatus(),
+		"client_version": clientVersionStatus(),
+		"pairing":        pairingStatus(),
+		// whatsmeow keeps no two-step verification state; the PIN is only
+		// asked on the phone and never shared with linked devices
+		"two_factor": map[string]interface{}{
+			"known": false,
+		},
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Diagnostics retrieved",
+		Data:    diagnostics,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Version endpoint - build details and how long the process has been running
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	uptime := time.Since(startTime)
+	response := APIResponse{
+		Success: true,
+		Message: "Version information retrieved",
+		Data: map[string]interface{}{
+			"version":        version,
+			"git_commit":     gitCommit,
+			"go_version":     runtime.Version(),
+			"started_at":     startTime,
+			"uptime":         uptime.Round(time.Second).String(),
+			"uptime_seconds": int64(uptime.Seconds()),
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /capabilities endpoint - which optional features this build and configuration support
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	whatsmeowVersion := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "go.mau.fi/whatsmeow" {
+				whatsmeowVersion = dep.Version
+			}
+		}
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Capabilities retrieved",
+		Data: map[string]interface{}{
+			"version":    version,
+			"git_commit": gitCommit,
+			"whatsmeow":  whatsmeowVersion,
+			"features": map[string]bool{
+				"webhooks":            webhookURL != "",
+				"webhook_signing":     webhookSecret.Status()["enabled"].(bool),
+				"transcoding":         transcodeEnabled,
+				"purge_cleared_chats": purgeClearedChats,
+				"message_store":       true,
+				"inline_attachments":  true,
+				"image_crop":          true,
+				"albums":              true,
+				"stickers":            true,
+				"contacts":            true,
+				"templates":           true,
+				"payment_requests":    true,
+				"location_requests":   true,
+				"reactions":           true,
+				"newsletter_text":     true,
+				"newsletter_media":    false,
+				"pairing_code":        true,
+				"polls":               false,
+				"buttons":             false,
+				"multi_session":       true,
+				"metrics":             false, // counters are in /diagnostics, there is no metrics exporter
+			},
+			"send_targets":   []string{targetUser, targetGroup, targetStatus, targetBroadcast, targetNewsletter},
+			"webhook_events": webhookEvents,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /webhook/schema endpoint - JSON schema of the webhook payload and an example for each event
+func webhookSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	response := APIResponse{
+		Success: true,
+		Message: "Webhook schema retrieved",
+		Data: map[string]interface{}{
+			"schema":   webhookPayloadSchema(),
+			"examples": webhookExamples(),
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// webhookPayloadSchema builds a JSON schema from the fields and json tags of WebhookPayload,
+// so it can't drift from what is actually sent
+func webhookPayloadSchema() map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := []string{}
+
+	payloadType := reflect.TypeOf(WebhookPayload{})
+	for i := 0; i < payloadType.NumField(); i++ {
+		field := payloadType.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		property := map[string]interface{}{}
+		switch {
+		case fieldType == reflect.TypeOf(time.Time{}):
+			property["type"] = "string"
+			property["format"] = "date-time"
+		case fieldType.Kind() == reflect.String:
+			property["type"] = "string"
+		case fieldType.Kind() == reflect.Bool:
+			property["type"] = "boolean"
+		case fieldType.Kind() == reflect.Map:
+			property["type"] = "object"
+			property["description"] = "Event specific details; its \"type\" field tells which shape it has"
+		}
+		if name == "event" {
+			property["enum"] = webhookEvents
+		}
+		properties[name] = property
+
+		if !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	return map[string]interface{}{
+		"$schema":    "https://json-schema.org/draft/2020-12/schema",
+		"title":      "WebhookPayload",
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
+
+// webhookEvents lists every value of WebhookPayload.Event
+var webhookEvents = []string{
+	"message", "reaction", "album", "location_response", "payment", "message_starred", "message_kept", "message_expired",
+	"message_deleted", "undecryptable", "chat_presence", "chat_cleared", "chat_deleted", "group_update", "group_join_request",
+	"newsletter_metrics", "offline_sync_started", "offline_sync_completed", "client_outdated", "participant_joined",
+	"participant_left", "message_sent", "receipt", "connected", "disconnected",
+}
+
+// webhookExamples returns a sample payload for each webhook event
+func webhookExamples() map[string]WebhookPayload {
+	at := time.Date(2025, 10, 25, 16, 7, 24, 0, time.UTC)
+	user := "1234567890@s.whatsapp.net"
+	group := "120363025246125486@g.us"
+	verified := false
+
+	return map[string]WebhookPayload{
+		"message": {
+			Event: "message", Message: "Image received: vacation photo", Sender: user, Chat: user, Time: at,
+			Attachment: map[string]interface{}{
+				"type": "image", "caption": "vacation photo", "mimetype": "image/jpeg",
+				"file_length": 1024000, "width": 1920, "height": 1080, "url": "/images/3EB0C431C26A1916E6A2.jpg",
+			},
+			IsVerifiedBusiness: &verified,
+		},
+		"reaction": {
+			Event: "reaction", Message: "Reaction received: 👍", Sender: user, Chat: user, Time: at,
+			Attachment: map[string]interface{}{
+				"type": "reaction", "emoji": "👍", "removed": false, "message_id": "3EB0C431C26A1916E6A2",
+			},
+			IsVerifiedBusiness: &verified,
+		},
+		"album": {
+			Event: "album", Message: "Album received (2 items)", Sender: user, Chat: user, Time: at,
+			Attachment: map[string]interface{}{
+				"type": "album", "album_id": "3EB0C431C26A1916E6A0", "count": 2, "expected": 2,
+				"items": []map[string]interface{}{
+					{"type": "image", "index": 0, "message_id": "3EB0C431C26A1916E6A1", "caption": "Holiday", "url": "/images/3EB0C431C26A1916E6A1.jpg"},
+					{"type": "video", "index": 1, "message_id": "3EB0C431C26A1916E6A2", "caption": "", "url": "/media/3EB0C431C26A1916E6A2.mp4"},
+				},
+			},
+		},
+		"location_response": {
+			Event: "location_response", Message: "Location received: ", Sender: user, Chat: user, Time: at,
+			Attachment: map[string]interface{}{
+				"type": "location", "request_id": "3EB0C431C26A1916E6A7", "latitude": -6.2088, "longitude": 106.8456,
+			},
+			IsVerifiedBusiness: &verified,
+		},
+		"payment": {
+			Event: "payment", Message: "Payment paid: 150.00 INR", Sender: user, Chat: user, Time: at,
+			Attachment: map[string]interface{}{
+				"type": "payment", "status": "paid", "reference": "3EB0C431C26A1916E6A5", "amount": 150.0,
+				"currency": "INR", "note": "Order #1042", "transaction_data": "",
+			},
+			IsVerifiedBusiness: &verified,
+		},
+		"message_starred": {
+			Event: "message_starred", Message: "Message starred", Sender: user, Chat: group, Time: at,
+			Attachment: map[string]interface{}{
+				"type": "star", "message_id": "3EB0C431C26A1916E6A2", "starred": true, "from_me": false,
+			},
+		},
+		"message_kept": {
+			Event: "message_kept", Message: "Message kept in chat", Sender: user, Chat: user, Time: at,
+			Attachment: map[string]interface{}{
+				"type": "message_kept", "message_id": "3EB0C431C26A1916E6A2", "kept": true, "from_me": false, "stored": true,
+			},
+		},
+		"message_expired": {
+			Event: "message_expired", Message: "Disappearing message expired", Sender: user, Chat: user, Time: at,
+			Attachment: map[string]interface{}{
+				"type": "message_expired", "message_id": "3EB0C431C26A1916E6A2", "expired_at": at,
+			},
+		},
+		"message_deleted": {
+			Event: "message_deleted", Message: "Message deleted", Sender: user, Chat: user, Time: at,
+			Attachment: map[string]interface{}{
+				"type": "message_deleted", "message_id": "3EB0C431C26A1916E6A2", "from_me": false, "stored": true,
+			},
+		},
+		"undecryptable": {
+			Event: "undecryptable", Message: "Message could not be decrypted", Sender: user, Chat: user, Time: at,
+			Attachment: map[string]interface{}{
+				"type": "undecryptable", "message_id": "3EB0C431C26A1916E6A2", "from_me": false, "is_unavailable": false,
+			},
+		},
+		"chat_presence": {
+			Event: "chat_presence", Message: "Chat presence: composing", Sender: user, Chat: user, Time: at,
+			Attachment: map[string]interface{}{
+				"type": "chat_presence", "state": "composing", "is_group": false,
+			},
+		},
+		"chat_cleared": {
+			Event: "chat_cleared", Message: "Chat cleared", Chat: user, Time: at,
+			Attachment: map[string]interface{}{
+				"type": "chat_cleared", "purged": 0, "last_message_timestamp": at,
+			},
+		},
+		"chat_deleted": {
+			Event: "chat_deleted", Message: "Chat deleted", Chat: user, Time: at,
+			Attachment: map[string]interface{}{
+				"type": "chat_deleted", "purged": 0, "last_message_timestamp": at,
+			},
+		},
+		"group_update": {
+			Event: "group_update", Sender: user, Chat: group, Time: at,
+			Attachment: map[string]interface{}{
+				"type": "group_update", "subject": "Store Team (Jakarta)", "added": []string{"0987654321@s.whatsapp.net"},
+			},
+		},
+		"participant_joined": {
+			Event: "participant_joined", Message: "Participant joined", Sender: "0987654321@s.whatsapp.net", Chat: group, Time: at,
+			Attachment: map[string]interface{}{
+				"type": "participant_joined", "participant": user, "reason": "added", "actor": "0987654321@s.whatsapp.net",
+			},
+		},
+		"participant_left": {
+			Event: "participant_left", Message: "Participant left", Chat: group, Time: at,
+			Attachment: map[string]interface{}{
+				"type": "participant_left", "participant": user, "reason": "left", "actor": "",
+			},
+		},
+		"message_sent": {
+			Event: "message_sent", Message: "On my way", Sender: "0987654321@s.whatsapp.net", Chat: user, Time: at,
+			Attachment: map[string]interface{}{"type": "text", "message_id": "3EB0A1B2C3D4E5F60718"},
+		},
+		"group_join_request": {
+			Event: "group_join_request", Message: "Group join request received", Sender: user, Chat: group, Time: at,
+			Attachment: map[string]interface{}{
+				"type": "group_join_request", "status": "pending", "group": group, "requester": user,
+				"push_name": "John Doe", "request_method": "invite_link",
+			},
+		},
+		"newsletter_metrics": {
+			Event: "newsletter_metrics", Message: "Channel post metrics: 1520 views", Chat: "120363144038483540@newsletter", Time: at,
+			Attachment: map[string]interface{}{
+				"type": "newsletter_metrics", "server_id": 118, "message_id": "3EB0C431C26A1916E6A2",
+				"views": 1520, "reactions": map[string]int{"👍": 42, "❤️": 17},
+			},
+		},
+		"offline_sync_started": {
+			Event: "offline_sync_started", Message: "Catching up on 57 missed event(s)", Time: at,
+			Attachment: map[string]interface{}{
+				"type": "offline_sync_started", "total": 57, "messages": 12, "notifications": 5, "receipts": 40, "app_data_changes": 0,
+			},
+		},
+		"offline_sync_completed": {
+			Event: "offline_sync_completed", Message: "Caught up on 57 missed event(s)", Time: at,
+			Attachment: map[string]interface{}{
+				"type": "offline_sync_completed", "expected": 57, "delivered": 57, "messages": 12, "duration_ms": 1840,
+			},
+		},
+		"client_outdated": {
+			Event: "client_outdated", Message: "WhatsApp rejected client version 2.3000.1028000000 as outdated", Time: at,
+			Attachment: map[string]interface{}{
+				"type": "client_outdated", "version": "2.3000.1028000000",
+			},
+		},
+		"receipt": {
+			Event: "receipt", Message: "1 message(s) read", Sender: user, Chat: user, Time: at,
+			Attachment: map[string]interface{}{
+				"type": "receipt", "status": "read", "message_ids": []string{"3EB0A1B2C3D4E5F60718"},
+			},
+		},
+		"connected": {
+			Event: "connected", Message: "Connected to WhatsApp", Time: at,
+			Attachment: map[string]interface{}{
+				"type": "connected", "jid": "0987654321:12@s.whatsapp.net",
+			},
+		},
+		"disconnected": {
+			Event: "disconnected", Message: "Disconnected from WhatsApp", Time: at,
+			Attachment: map[string]interface{}{"type": "disconnected"},
+		},
+	}
+}
+
+// Device management endpoint
+func devicesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if client == nil {
+		response := APIResponse{
+			Success: false,
+			Message: "Client not initialized",
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	deviceInfo := map[string]interface{}{
+		"connected": client.IsConnected(),
+		"paired":    isPaired,
+	}
+
+	// Only add device info if store exists and has ID
+	maps.Copy(deviceInfo, jidFormats(client.Store))
+	if client.Store != nil && client.Store.ID != nil {
+		deviceInfo["device_id"] = client.Store.ID.String()
+		deviceInfo["jid"] = client.Store.ID
+		deviceInfo["phone"] = client.Store.ID.User
+		// Reported by the primary phone when the device was linked (e.g. "android", "smba" for WhatsApp Business)
+		deviceInfo["push_name"] = client.Store.PushName
+		deviceInfo["business_name"] = client.Store.BusinessName
+		deviceInfo["platform"] = client.Store.Platform
+	} else {
+		deviceInfo["device_id"] = nil
+		deviceInfo["jid"] = nil
+		deviceInfo["phone"] = nil
+		deviceInfo["push_name"] = nil
+		deviceInfo["business_name"] = nil
+		deviceInfo["platform"] = nil
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Device information retrieved",
+		Data:    deviceInfo,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// jidFormats returns the linked device's JID in the shapes consumers use: jid_full with the device
+// (1234567890:12@s.whatsapp.net), jid_user without it, the bare phone number and the account's LID.
+// Everything is nil while unpaired, and lid also when WhatsApp hasn't told us the LID yet.
+func jidFormats(device *store.Device) map[string]interface{} {
+	formats := map[string]interface{}{
+		"jid_full": nil,
+		"jid_user": nil,
+		"phone":    nil,
+		"lid":      nil,
+	}
+	if device == nil || device.ID == nil {
+		return formats
+	}
+	formats["jid_full"] = device.ID.String()
+	formats["jid_user"] = device.ID.ToNonAD().String()
+	formats["phone"] = device.ID.User
+	if !device.LID.IsEmpty() {
+		formats["lid"] = device.LID.ToNonAD().String()
+	}
+	return formats
+}
+
+// Account endpoint - linked account's phone number broken down into country and national parts
+func accountHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if client == nil {
+		response := APIResponse{
+			Success: false,
+			Message: "Client not initialized",
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	accountInfo := map[string]interface{}{
+		"paired":          isPaired,
+		"phone":           nil,
+		"country_code":    nil,
+		"national_number": nil,
+		"e164":            nil,
+		"international":   nil,
+		"region":          nil,
+		"valid":           false,
+	}
+	maps.Copy(accountInfo, jidFormats(client.Store))
+
+	if client.Store != nil && client.Store.ID != nil {
+		phone := client.Store.ID.User
+		accountInfo["phone"] = phone
+
+		// The JID user part is the number in international form without the leading +
+		number, err := phonenumbers.Parse("+"+phone, "")
+		if err != nil {
+			log.Printf("Failed to parse account phone number %s: %v", phone, err)
+			accountInfo["parse_error"] = err.Error()
+		} else {
+			accountInfo["country_code"] = number.GetCountryCode()
+			accountInfo["national_number"] = strconv.FormatUint(number.GetNationalNumber(), 10)
+			accountInfo["e164"] = phonenumbers.Format(number, phonenumbers.E164)
+			accountInfo["international"] = phonenumbers.Format(number, phonenumbers.INTERNATIONAL)
+			if region := phonenumbers.GetRegionCodeForNumber(number); region != "" && region != "ZZ" {
+				accountInfo["region"] = region
+			}
+			accountInfo["valid"] = phonenumbers.IsValidNumber(number)
+		}
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Account information retrieved",
+		Data:    accountInfo,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Disconnect endpoint
+func disconnectHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if client == nil {
+		response := APIResponse{
+			Success: false,
+			Message: "Client not initialized",
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Disconnect if connected
+	if client.IsConnected() {
+		client.Disconnect()
+		log.Println("Manually disconnected from WhatsApp")
+	}
+
+	// Clear session
+	if client.Store.ID != nil {
+		err := client.Store.Delete(context.Background())
+		if err != nil {
+			log.Printf("Warning: Failed to clear session during disconnect: %v", err)
+		} else {
+			log.Println("Session cleared successfully")
+		}
+	}
+
+	isPaired = false
+
+	response := APIResponse{
+		Success: true,
+		Message: "Successfully disconnected and session cleared",
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Reconnect endpoint - cycle the connection while keeping the existing session
+func reconnectHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if client == nil {
+		response := APIResponse{
+			Success: false,
+			Message: "Client not initialized",
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if client.Store.ID == nil {
+		response := APIResponse{
+			Success: false,
+			Message: "No session to reconnect. Please use /pair endpoint first",
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if !reconnectMu.TryLock() {
+		response := APIResponse{
+			Success: false,
+			Message: "A reconnect is already in progress",
+		}
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	defer reconnectMu.Unlock()
+
+	log.Println("=== MANUAL RECONNECT STARTED ===")
+	if client.IsConnected() {
+		client.Disconnect()
+		log.Println("Disconnected from WhatsApp")
+	}
+
+	err := client.Connect()
+	if err != nil {
+		log.Printf("Failed to reconnect: %v", err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to reconnect: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Wait for the session to finish logging in before reporting status
+	loggedIn := client.WaitForConnection(reconnectTimeout)
+	if loggedIn {
+		isPaired = true
+		log.Println("🟢 Reconnected to WhatsApp")
+	} else {
+		log.Printf("⏰ Reconnect did not complete login within %s", reconnectTimeout)
+	}
+	log.Println("=== MANUAL RECONNECT COMPLETE ===")
+
+	response := APIResponse{
+		Success: loggedIn,
+		Message: "Reconnected to WhatsApp",
+		Data: map[string]interface{}{
+			"connected": client.IsConnected(),
+			"logged_in": client.IsLoggedIn(),
+			"paired":    isPaired,
+		},
+	}
+	if !loggedIn {
+		response.Message = "Reconnect started but login did not complete in time"
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// accountSession is an additional linked WhatsApp account, served under /accounts/{id}/
+type accountSession struct {
+	ID       string
+	Client   *whatsmeow.Client
+	paired   atomic.Bool
+	limiter  *rateLimiter // paces this account's sends at the server's rate limit
+	cooldown *sendCooldown
+}
+
+// sessionManager holds the additional accounts by ID. The default account keeps using the
+// global client, so the unprefixed endpoints work as before.
+type sessionManager struct {
+	mu       sync.RWMutex
+	sessions map[string]*accountSession
+}
+
+func (m *sessionManager) Get(id string) (*accountSession, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	session, ok := m.sessions[id]
+	return session, ok
+}
+
+// GetOrCreate returns the account's session, starting one on a fresh device if it has none yet
+func (m *sessionManager) GetOrCreate(id string) *accountSession {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[id]
+	if !ok {
+		session = newAccountSession(id, storeContainer.NewDevice())
+		m.sessions[id] = session
+	}
+	return session
+}
+
+func (m *sessionManager) Remove(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+}
+
+// EvictUnpaired drops a session whose pairing ended without success, so abandoned pair attempts
+// don't leave clients behind
+func (m *sessionManager) EvictUnpaired(session *accountSession) {
+	if session.paired.Load() {
+		return
+	}
+	session.Client.Disconnect()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sessions[session.ID] == session {
+		delete(m.sessions, session.ID)
+		log.Printf("Account %s was not paired, session dropped", session.ID)
+	}
+}
+
+// List returns the sessions sorted by account ID
+func (m *sessionManager) List() []*accountSession {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	sessions := make([]*accountSession, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions
+}
+
+func newAccountSession(id string, device *store.Device) *accountSession {
+	session := &accountSession{ID: id, limiter: &rateLimiter{}}
+	session.limiter.SetLimit(sendLimiter.Limit())
+	session.Client = whatsmeow.NewClient(device, waLog.Stdout("Client/"+id, "INFO", true))
+	session.cooldown = &sendCooldown{account: id, client: func() *whatsmeow.Client { return session.Client }}
+	session.Client.AutomaticMessageRerequestFromPhone = true
+	session.Client.AutoReconnectHook = session.cooldown.AllowReconnect
+	session.Client.PrePairCallback = session.savePairing
+	session.Client.AddEventHandler(session.handleEvent)
+	session.paired.Store(device.ID != nil)
+	return session
+}
+
+// sessionWorks reports whether the account's existing session can log in, connecting it first if
+// needed, like sessionWorks does for the default account
+func (s *accountSession) sessionWorks() bool {
+	if s.Client.IsLoggedIn() {
+		return true
+	}
+	if !s.Client.IsConnected() {
+		log.Printf("Checking the existing session of account %s before pairing...", s.ID)
+		if err := s.Client.Connect(); err != nil {
+			log.Printf("Existing session of account %s can't connect: %v", s.ID, err)
+			return false
+		}
+	}
+	if !s.Client.WaitForConnection(reconnectTimeout) {
+		log.Printf("Existing session of account %s did not log in within %s", s.ID, reconnectTimeout)
+		return false
+	}
+	s.paired.Store(true)
+	return true
+}
+
+// savePairing records the account's JID before whatsmeow saves the device, so a paired device is
+// never left without its account row (and picked up as the default account on the next start).
+// Returning false cancels the pairing.
+func (s *accountSession) savePairing(jid types.JID, platform, businessName string) bool {
+	_, err := db.Exec(`INSERT INTO accounts (id, jid) VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET jid = EXCLUDED.jid`, s.ID, jid.String())
+	if err != nil {
+		log.Printf("Failed to save account %s, cancelling pairing: %v", s.ID, err)
+		return false
+	}
+	return true
+}
+
+// handleEvent tracks the connection of an additional account, pauses it when WhatsApp signals
+// rate limiting or a ban, and forwards its incoming messages to the webhook
+func (s *accountSession) handleEvent(evt interface{}) {
+	s.cooldown.Observe(evt)
+	switch v := evt.(type) {
+	case *events.PairSuccess:
+		s.paired.Store(true)
+		log.Printf("🎉 Account %s paired as %s", s.ID, v.ID.String())
+	case *events.Connected:
+		log.Printf("🟢 Account %s connected", s.ID)
+	case *events.Disconnected:
+		log.Printf("🔴 Account %s disconnected", s.ID)
+	case *events.LoggedOut:
+		s.paired.Store(false)
+		log.Printf("🚪 Account %s was logged out: %s", s.ID, v.Reason.String())
+	case *events.TemporaryBan:
+		log.Printf("⛔ Account %s: %s", s.ID, v.String())
+	case *events.Message:
+		s.forwardMessage(v)
+	}
+}
+
+// forwardMessage sends an incoming message of the account to the webhook with the account ID.
+// The attachment carries the media details; media of additional accounts isn't downloaded.
+func (s *accountSession) forwardMessage(evt *events.Message) {
+	if evt.Info.IsFromMe || webhookURL == "" || evt.Message.GetProtocolMessage() != nil {
+		return
+	}
+	if messageDedup.Seen(s.ID + "/" + evt.Info.Chat.String() + "/" + evt.Info.ID) {
+		return
+	}
+	text := filterText(evt.Message)
+	_, attachment := outgoingMessageDetails(evt.Info.Chat, evt.Message)
+	if attachment == nil {
+		attachment = map[string]interface{}{"type": "text"}
+	} else if attachment["type"] == "unknown" && text == "" {
+		return
+	}
+	attachment["message_id"] = evt.Info.ID
+	log.Printf("📨 Account %s received message %s from %s", s.ID, evt.Info.ID, evt.Info.Sender.String())
+	postWebhook(WebhookPayload{
+		Event:      "message",
+		Account:    s.ID,
+		Message:    text,
+		Sender:     evt.Info.Sender.String(),
+		Chat:       evt.Info.Chat.String(),
+		Time:       time.Now(),
+		Attachment: attachment,
+	})
+}
+
+// Info describes the session's device the same way /devices does for the default account
+func (s *accountSession) Info() map[string]interface{} {
+	info := map[string]interface{}{
+		"account":   s.ID,
+		"connected": s.Client.IsConnected(),
+		"paired":    s.paired.Load(),
+		"device_id": nil,
+		"jid":       nil,
+		"phone":     nil,
+		"push_name": nil,
+		"platform":  nil,
+	}
+	maps.Copy(info, jidFormats(s.Client.Store))
+	if s.Client.Store.ID != nil {
+		info["device_id"] = s.Client.Store.ID.String()
+		info["jid"] = s.Client.Store.ID
+		info["phone"] = s.Client.Store.ID.User
+		info["push_name"] = s.Client.Store.PushName
+		info["platform"] = s.Client.Store.Platform
+	}
+	if until, reason, active := s.cooldown.Status(); active {
+		info["cooldown_reason"] = reason
+		info["cooldown_until"] = until
+	}
+	return info
+}
+
+// loadAccounts reconnects the additional accounts saved in the accounts table and returns the
+// device for the default account: the first one not linked to an account, or a fresh one
+func loadAccounts() (*store.Device, error) {
+	rows, err := db.Query(`SELECT id, jid FROM accounts WHERE jid IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	accountJIDs := map[string]string{}
+	for rows.Next() {
+		var id, jid string
+		if err := rows.Scan(&id, &jid); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		accountJIDs[jid] = id
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	devices, err := storeContainer.GetAllDevices(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	var defaultDevice *store.Device
+	for _, device := range devices {
+		id, ok := accountJIDs[device.ID.String()]
+		if !ok {
+			if defaultDevice == nil {
+				defaultDevice = device
+			}
+			continue
+		}
+
+		session := newAccountSession(id, device)
+		accounts.mu.Lock()
+		accounts.sessions[id] = session
+		accounts.mu.Unlock()
+		log.Printf("Connecting account %s (%s)...", id, device.ID.String())
+		if err := session.Client.Connect(); err != nil {
+			log.Printf("Failed to connect account %s: %v", id, err)
+		}
+	}
+
+	if defaultDevice == nil {
+		defaultDevice = storeContainer.NewDevice()
+	}
+	return defaultDevice, nil
+}
+
+// accountFromRequest validates the {id} path segment. The default account is served by the
+// unprefixed endpoints, so it isn't accepted here.
+func accountFromRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id := mux.Vars(r)["id"]
+	if !accountIDRegex.MatchString(id) || id == defaultAccountID {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid account ID %q: use 1-64 letters, digits, - or _, and the unprefixed endpoints for the %s account", id, defaultAccountID),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return "", false
+	}
+	return id, true
+}
+
+// writeAccountNotFound answers 404 for an account that was never paired on this server
+func writeAccountNotFound(w http.ResponseWriter, id string) {
+	response := APIResponse{
+		Success: false,
+		Message: fmt.Sprintf("Account %s not found. Use /accounts/%s/pair to link it", id, id),
+	}
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(response)
+}
+
+// /accounts endpoint - list the default account and every additional one
+func accountsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	list := []map[string]interface{}{}
+	if client != nil {
+		defaultInfo := map[string]interface{}{
+			"account":   defaultAccountID,
+			"connected": client.IsConnected(),
+			"paired":    isPaired,
+			"jid":       nil,
+		}
+		if client.Store.ID != nil {
+			defaultInfo["jid"] = client.Store.ID
+		}
+		list = append(list, defaultInfo)
+	}
+	for _, session := range accounts.List() {
+		info := session.Info()
+		list = append(list, map[string]interface{}{
+			"account":   info["account"],
+			"connected": info["connected"],
+			"paired":    info["paired"],
+			"jid":       info["jid"],
+		})
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Found %d accounts", len(list)),
+		Data:    map[string]interface{}{"accounts": list},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /accounts/{id}/pair endpoint - link an additional account by QR code, like /pair does for the default one
+func accountPairHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, ok := accountFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// Like /pair, a working session is only replaced when a fresh pairing is asked for explicitly
+	force := false
+	if value := r.URL.Query().Get("force"); value != "" {
+		var err error
+		force, err = strconv.ParseBool(value)
+		if err != nil {
+			response := APIResponse{
+				Success: false,
+				Message: "force must be true or false",
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+
+	log.Printf("=== PAIRING REQUEST STARTED FOR ACCOUNT %s ===", id)
+	session := accounts.GetOrCreate(id)
+	if !force && session.Client.Store.ID != nil && session.sessionWorks() {
+		log.Printf("Pairing of account %s skipped: session for %s is working (use ?force=true to pair again)", id, session.Client.Store.ID.String())
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Account %s is already paired with a working session. Use ?force=true to unlink it and pair again", id),
+			Data: map[string]interface{}{
+				"account":   id,
+				"connected": session.Client.IsConnected(),
+				"logged_in": session.Client.IsLoggedIn(),
+				"paired":    session.paired.Load(),
+				"jid":       session.Client.Store.ID,
+			},
+		}
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if session.Client.IsConnected() {
+		session.Client.Disconnect()
+	}
+	if session.Client.Store.ID != nil {
+		log.Printf("Clearing existing session of account %s: %s", id, session.Client.Store.ID.String())
+		if err := session.Client.Store.Delete(context.Background()); err != nil {
+			log.Printf("Warning: Failed to clear session of account %s: %v", id, err)
+		}
+		// The row pointed at the cleared device; savePairing adds it again once the new pairing succeeds
+		if _, err := db.Exec(`DELETE FROM accounts WHERE id = $1`, id); err != nil {
+			log.Printf("Failed to delete account %s: %v", id, err)
+		}
+	}
+	session.paired.Store(false)
+
+	qrChan, err := session.Client.GetQRChannel(context.Background())
+	if err != nil {
+		accounts.EvictUnpaired(session)
+		log.Printf("Failed to get QR channel for account %s: %v", id, err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to get QR channel: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if err := session.Client.Connect(); err != nil {
+		accounts.EvictUnpaired(session)
+		log.Printf("Failed to connect account %s: %v", id, err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to connect: %v", err),
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	select {
+	case evt := <-qrChan:
+		if evt.Event != whatsmeow.QRChannelEventCode {
+			accounts.EvictUnpaired(session)
+			log.Printf("QR generation error for account %s: %s %v", id, evt.Event, evt.Error)
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("QR generation error: %s", evt.Event),
+			}
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		qr, err := qrcode.New(evt.Code, qrcode.Medium)
+		if err != nil {
+			accounts.EvictUnpaired(session)
+			log.Printf("Failed to generate QR code for account %s: %v", id, err)
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to generate QR code: %v", err),
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		if err := png.Encode(w, qr.Image(256)); err != nil {
+			log.Printf("Failed to encode QR image for account %s: %v", id, err)
+			return
+		}
+
+		// Log how pairing ends and drop the session unless it was paired; savePairing stores the account
+		go func() {
+			for evt := range qrChan {
+				if evt.Event != whatsmeow.QRChannelEventCode {
+					log.Printf("QR Event for account %s: %s", id, evt.Event)
+				}
+			}
+			accounts.EvictUnpaired(session)
+		}()
+	case <-time.After(qrTimeout):
+		accounts.EvictUnpaired(session)
+		log.Printf("QR code generation timeout for account %s after %s", id, qrTimeout)
+		response := APIResponse{
+			Success: false,
+			Message: "QR code generation timeout - please try again",
+		}
+		w.WriteHeader(http.StatusRequestTimeout)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// /accounts/{id}/send endpoint - send a message with attachments from an additional account
+func accountSendHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, ok := accountFromRequest(w, r)
+	if !ok {
+		return
+	}
+	session, ok := accounts.Get(id)
+	if !ok {
+		writeAccountNotFound(w, id)
+		return
+	}
+	if !session.paired.Load() || !session.Client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Account %s is not connected. Please use /accounts/%s/pair first", id, id),
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if writeCooldown(w, session.cooldown) {
+		return
+	}
+
+	var req SendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Number == "" || (req.Message == "" && len(req.Attachments) == 0) {
+		response := APIResponse{
+			Success: false,
+			Message: "Number and either message or attachments are required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if req.DelayMs < 0 || time.Duration(req.DelayMs)*time.Millisecond > maxSendDelay {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("delay_ms must be between 0 and %d", maxSendDelay.Milliseconds()),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	// Both look at data only kept for the default account
+	if req.ReplyToLatest || req.ClientMessageID != "" {
+		response := APIResponse{
+			Success: false,
+			Message: "reply_to_latest and client_message_id are only supported by the default account's /send; use reply_to with quoted_text to reply",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if req.Order != nil && req.ReplyTo != "" {
+		response := APIResponse{
+			Success: false,
+			Message: "order and reply_to can't be combined, a message can only quote one thing",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	jid, err := resolveSendTarget(req.Number, targetUser, targetGroup)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid number: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// The message store only holds the default account's chats, so a reply to this account's
+	// messages is normally built from quoted_text
+	var quote *waProto.ContextInfo
+	if req.ReplyTo != "" {
+		quote, err = buildReplyQuote(jid, req.ReplyTo, req.ReplySender, req.QuotedText)
+		if err != nil {
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Invalid reply_to: %v", err),
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+	if req.Order != nil {
+		quote, err = buildOrderQuote(session.Client, req.Order, jid)
+		if err != nil {
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Invalid order: %v", err),
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+
+	messages, err := buildMessages(session.Client, req.Message, req.Attachments, jid, resolveFooter(req.Footer))
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to prepare attachment: %v", err),
+		}
+		if errors.Is(err, errMimeTypeMismatch) {
+			response.Data = map[string]interface{}{"code": "MIME_TYPE_MISMATCH"}
+			w.WriteHeader(http.StatusBadRequest)
+		} else if errors.Is(err, errInvalidLocation) {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if quote != nil {
+		ctx := ensureContextInfo(messages[0])
+		ctx.StanzaID = quote.StanzaID
+		ctx.Participant = quote.Participant
+		ctx.QuotedMessage = quote.QuotedMessage
+	}
+
+	var sent []map[string]interface{}
+	var messageIDs []string
+	for i, msg := range messages {
+		if i > 0 && req.DelayMs > 0 {
+			time.Sleep(time.Duration(req.DelayMs) * time.Millisecond)
+		}
+
+		session.limiter.Wait()
+		resp, err := sendMessageAs(context.Background(), session.Client, jid, msg)
+		if err != nil {
+			log.Printf("Account %s failed to send message %d of %d to %s: %v", id, i+1, len(messages), jid.String(), err)
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to send message %d: %v", i+1, err),
+			}
+			if i > 0 {
+				response.Data = map[string]interface{}{
+					"failed_index": i + 1,
+					"sent":         sent,
+					"message_ids":  messageIDs,
+				}
+			}
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		log.Printf("✅ Account %s sent message to %s (ID: %s)", id, jid.String(), resp.ID)
+		messageIDs = append(messageIDs, resp.ID)
+		sent = append(sent, map[string]interface{}{"index": i + 1, "message_id": resp.ID, "timestamp": resp.Timestamp})
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Successfully sent %d message(s)", len(messages)),
+		Data: map[string]interface{}{
+			"account":     id,
+			"to":          jid.String(),
+			"message_id":  messageIDs[0],
+			"timestamp":   sent[0]["timestamp"],
+			"sent":        sent,
+			"message_ids": messageIDs,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /accounts/{id}/devices endpoint - device information of an additional account
+func accountDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, ok := accountFromRequest(w, r)
+	if !ok {
+		return
+	}
+	session, ok := accounts.Get(id)
+	if !ok {
+		writeAccountNotFound(w, id)
+		return
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Device information retrieved",
+		Data:    session.Info(),
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /accounts/{id}/disconnect endpoint - unlink an additional account and forget it
+func accountDisconnectHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, ok := accountFromRequest(w, r)
+	if !ok {
+		return
+	}
+	session, ok := accounts.Get(id)
+	if !ok {
+		writeAccountNotFound(w, id)
+		return
+	}
+
+	if session.Client.Store.ID != nil {
+		// Unlinks the device on the phone too; fall back to only dropping the local session
+		if err := session.Client.Logout(context.Background()); err != nil {
+			log.Printf("Warning: Logout of account %s failed, clearing local session: %v", id, err)
+			session.Client.Disconnect()
+			if err := session.Client.Store.Delete(context.Background()); err != nil {
+				log.Printf("Warning: Failed to clear session of account %s: %v", id, err)
+			}
+		}
+	} else {
+		session.Client.Disconnect()
+	}
+	accounts.Remove(id)
+	if _, err := db.Exec(`DELETE FROM accounts WHERE id = $1`, id); err != nil {
+		log.Printf("Failed to delete account %s: %v", id, err)
+	}
+	log.Printf("Account %s disconnected and removed", id)
+
+	response := APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Account %s disconnected and session cleared", id),
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Contacts import endpoint - store contacts from vCards in the local contacts table
+func importContactsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req ImportContactsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	vcards := req.VCards
+	if req.VCard != "" {
+		vcards = append(vcards, req.VCard)
+	}
+	if len(vcards) == 0 {
+		response := APIResponse{
+			Success: false,
+			Message: "Either vcard or vcards is required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var contacts []VCardContact
+	imported := 0
+	for _, vcard := range vcards {
+		contact := parseVCard(vcard)
+		contacts = append(contacts, contact)
+
+		email := ""
+		if len(contact.Emails) > 0 {
+			email = contact.Emails[0]
+		}
+
+		// One row per phone number so contacts with several numbers can be looked up by any of them
+		for _, phone := range contact.Phones {
+			number := phone.WaID
+			if number == "" {
+				number = normalizePhone(phone.Number)
+			}
+			if number == "" {
+				continue
+			}
+
+			_, err := db.Exec(`
+				INSERT INTO contacts (phone, name, email, vcard)
+				VALUES ($1, $2, $3, $4)
+				ON CONFLICT (phone) DO UPDATE SET name = EXCLUDED.name, email = EXCLUDED.email, vcard = EXCLUDED.vcard, updated_at = NOW()`,
+				number, contact.Name, email, vcard)
+			if err != nil {
+				log.Printf("Failed to import contact %s: %v", number, err)
+				response := APIResponse{
+					Success: false,
+					Message: fmt.Sprintf("Failed to import contact: %v", err),
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(response)
+				return
+			}
+			imported++
+		}
+	}
+
+	log.Printf("Imported %d contact number(s) from %d vCard(s)", imported, len(vcards))
+
+	response := APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Imported %d contact number(s)", imported),
+		Data: map[string]interface{}{
+			"imported": imported,
+			"contacts": contacts,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Payment request endpoint - ask a contact to pay an amount (WhatsApp Pay regions only)
+func sendPaymentRequestHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req PaymentRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	req.Currency = strings.ToUpper(req.Currency)
+	if req.Number == "" || req.Amount <= 0 || len(req.Currency) != 3 {
+		response := APIResponse{
+			Success: false,
+			Message: "Number, a positive amount and a 3-letter ISO 4217 currency are required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Refuse to send rather than deliver a payment request the recipient can't act on
+	accountRegionCurrency := ""
+	for prefix, currency := range paymentRegions {
+		if strings.HasPrefix(client.Store.ID.User, prefix) {
+			accountRegionCurrency = currency
+			break
+		}
+	}
+	if accountRegionCurrency == "" {
+		response := APIResponse{
+			Success: false,
+			Message: "Payments are not supported for this account's region (available in India and Brazil only)",
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if accountRegionCurrency != req.Currency {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Currency %s is not supported for this account's region, use %s", req.Currency, accountRegionCurrency),
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	targetJID, err := resolveSendTarget(req.Number, targetUser)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid phone number: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	expiryHours := req.ExpiryHours
+	if expiryHours <= 0 {
+		expiryHours = 7 * 24
+	}
+
+	amount1000 := uint64(req.Amount*1000 + 0.5)
+	message := &waProto.Message{
+		RequestPaymentMessage: &waProto.RequestPaymentMessage{
+			CurrencyCodeIso4217: proto.String(req.Currency),
+			Amount1000:          proto.Uint64(amount1000),
+			RequestFrom:         proto.String(targetJID.String()),
+			ExpiryTimestamp:     proto.Int64(time.Now().Add(time.Duration(expiryHours) * time.Hour).Unix()),
+			Amount: &waProto.Money{
+				Value:        proto.Int64(int64(amount1000)),
+				Offset:       proto.Uint32(1000),
+				CurrencyCode: proto.String(req.Currency),
+			},
+			NoteMessage: &waProto.Message{
+				ExtendedTextMessage: &waProto.ExtendedTextMessage{
+					Text: proto.String(req.Note),
+				},
+			},
+		},
+	}
+	applyFooter(message, resolveFooter(req.Footer))
+
+	sendLimiter.Wait()
+	resp, err := sendMessage(context.Background(), targetJID, message)
+	if err != nil {
+		log.Printf("Failed to send payment request: %v", err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to send payment request: %v", err),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	log.Printf("Payment request for %.2f %s sent to %s (ID: %s)", req.Amount, req.Currency, targetJID.String(), resp.ID)
+
+	// Keep the request so the payment answering it can be matched to its amount
+	sent := &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{Chat: targetJID, Sender: client.Store.ID.ToNonAD(), IsFromMe: true},
+			ID:            resp.ID,
+			Timestamp:     resp.Timestamp,
+		},
+		Message: message,
+	}
+	payment, content := paymentDetails(targetJID, message)
+	err = storeMessage(sent, content, payment)
+	if err != nil {
+		log.Printf("Failed to store payment request: %v", err)
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Payment request sent",
+		Data: map[string]interface{}{
+			"number":     req.Number,
+			"amount":     req.Amount,
+			"currency":   req.Currency,
+			"note":       req.Note,
+			"message_id": resp.ID,
+			"timestamp":  resp.Timestamp,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Rate limit config endpoint - view or update the send rate limit without restarting
+func rateLimitConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			PerMinute *int `json:"per_minute"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.PerMinute == nil || *req.PerMinute < 0 {
+			response := APIResponse{
+				Success: false,
+				Message: "per_minute is required and must be 0 (unlimited) or greater",
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		sendLimiter.SetLimit(*req.PerMinute)
+		for _, session := range accounts.List() {
+			session.limiter.SetLimit(*req.PerMinute)
+		}
+		log.Printf("Send rate limit updated: %d message(s) per minute", *req.PerMinute)
+	}
+
+	perMinute := sendLimiter.Limit()
+	response := APIResponse{
+		Success: true,
+		Message: "Rate limit retrieved",
+		Data: map[string]interface{}{
+			"per_minute": perMinute,
+			"unlimited":  perMinute == 0,
+		},
+	}
+	if r.Method == http.MethodPost {
+		response.Message = "Rate limit updated"
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /config/webhook-retry endpoint - view or change how failed webhooks are retried, per event type
+func webhookRetryConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			Default *webhookRetryPolicy            `json:"default"`
+			Events  map[string]*webhookRetryPolicy `json:"events"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || (req.Default == nil && len(req.Events) == 0) {
+			response := APIResponse{
+				Success: false,
+				Message: "default or events is required",
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		policies := map[string]*webhookRetryPolicy{"default": req.Default}
+		for event, policy := range req.Events {
+			policies[event] = policy
+		}
+		for name, policy := range policies {
+			if policy != nil && (policy.MaxRetries < 0 || policy.MaxRetries > maxWebhookRetries || policy.BackoffSeconds < 0) {
+				response := APIResponse{
+					Success: false,
+					Message: fmt.Sprintf("%s: max_retries must be between 0 and %d and backoff_seconds must not be negative", name, maxWebhookRetries),
+				}
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(response)
+				return
+			}
+		}
+
+		if req.Default != nil {
+			webhookRetries.SetDefault(*req.Default)
+		}
+		webhookRetries.SetEvents(req.Events)
+		log.Printf("Webhook retry policy updated: %+v", webhookRetries.Snapshot())
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Webhook retry policy retrieved",
+		Data:    webhookRetries.Snapshot(),
+	}
+	if r.Method == http.MethodPost {
+		response.Message = "Webhook retry policy updated"
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// redactURL hides credentials in a URL: the password and any query parameter that looks like a secret
+func redactURL(rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "REDACTED"
+	}
+
+	query := parsed.Query()
+	for name := range query {
+		lower := strings.ToLower(name)
+		for _, secret := range []string{"secret", "token", "key", "password", "signature", "auth"} {
+			if strings.Contains(lower, secret) {
+				query.Set(name, "REDACTED")
+				break
+			}
+		}
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.Redacted()
+}
+
+// Config endpoint - the configuration currently in effect, with secrets redacted
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	perMinute := sendLimiter.Limit()
+	config := map[string]interface{}{
+		"webhook_url":         redactURL(webhookURL),
+		"webhook_signing":     webhookSecret.Status(),
+		"webhook_retry":       webhookRetries.Snapshot(),
+		"webhook_max_payload": webhookMaxPayload,
+		"public_url":          publicURL,
+		"rate_limit": map[string]interface{}{
+			"per_minute": perMinute,
+			"unlimited":  perMinute == 0,
+		},
+		"auto_read":              autoRead.Load(),
+		"store_outgoing":         storeOutgoing.Load(),
+		"message_footer":         resolveFooter(nil),
+		"download_headers":       downloadHeaders.Load().Summary(),
+		"auto_download":          autoDownload.Load(),
+		"auto_download_max_size": autoDownloadMaxSize.Load(),
+		"auto_typing":            autoTyping.Load(),
+		"transcode":              transcodeEnabled,
+		"purge_cleared":          purgeClearedChats,
+		"download_dir":           downloadDir,
+		"download_name":          downloadNameTemplate,
+		"max_downloads":          downloadWorkers,
+		"image_quality":          jpegQuality,
+		"dedup_ttl_seconds":      int(messageDedup.ttl.Seconds()),
+		"timeouts": map[string]interface{}{
+			"qr_seconds":        int(qrTimeout.Seconds()),
+			"reconnect_seconds": int(reconnectTimeout.Seconds()),
+			"transcode_seconds": int(transcodeTimeout.Seconds()),
+			"typing_seconds":    int(typingTimeout.Seconds()),
+			"webhook_seconds":   webhookClient.Timeout.Seconds(),
+		},
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Configuration retrieved",
+		Data:    config,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /config/presence endpoint - GET returns the presence the account announces, POST changes it
+func presenceConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			Presence string `json:"presence"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		presence := types.Presence(strings.ToLower(req.Presence))
+		if err != nil || (presence != types.PresenceAvailable && presence != types.PresenceUnavailable) {
+			response := APIResponse{
+				Success: false,
+				Message: "presence is required and must be available or unavailable",
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		presenceMu.Lock()
+		accountPresence = presence
+		presenceMu.Unlock()
+		log.Printf("Account presence updated: %s", presence)
+
+		if client != nil && client.IsConnected() {
+			err = sendAccountPresence()
+			if err != nil {
+				response := APIResponse{
+					Success: false,
+					Message: fmt.Sprintf("Presence saved but could not be sent: %v", err),
+					Data:    presenceStatus(),
+				}
+				w.WriteHeader(http.StatusBadGateway)
+				json.NewEncoder(w).Encode(response)
+				return
+			}
+		}
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Presence setting retrieved",
+		Data:    presenceStatus(),
+	}
+	if r.Method == http.MethodPost {
+		response.Message = "Presence setting updated"
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /config/auto-download endpoint - GET returns whether and up to what size incoming media is downloaded automatically, POST changes it
+func autoDownloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			Enabled *bool            `json:"enabled"`
+			MaxSize *json.RawMessage `json:"max_size"`
+		}
+		var size int64
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err == nil && req.Enabled == nil && req.MaxSize == nil {
+			err = fmt.Errorf("enabled or max_size is required")
+		}
+		if err == nil && req.MaxSize != nil {
+			// Accepts a number of bytes or a string such as "10MB"
+			var text string
+			if json.Unmarshal(*req.MaxSize, &text) == nil {
+				size, err = parseByteSize(text)
+			} else if err = json.Unmarshal(*req.MaxSize, &size); err == nil && size < 0 {
+				err = fmt.Errorf("max_size can't be negative")
+			}
+		}
+		if err != nil {
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Invalid auto-download setting, pass enabled (true or false) and/or max_size as a number of bytes or a size like \"10MB\" (0 for no limit): %v", err),
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		if req.Enabled != nil {
+			autoDownload.Store(*req.Enabled)
+			log.Printf("Automatic media downloads updated: %t", *req.Enabled)
+		}
+		if req.MaxSize != nil {
+			autoDownloadMaxSize.Store(size)
+			log.Printf("Automatic media download limit updated: %d bytes", size)
+		}
+	}
+
+	maxSize := autoDownloadMaxSize.Load()
+	response := APIResponse{
+		Success: true,
+		Message: "Auto-download setting retrieved",
+		Data: map[string]interface{}{
+			"enabled":   autoDownload.Load(),
+			"max_size":  maxSize,
+			"unlimited": maxSize == 0,
+		},
+	}
+	if r.Method == http.MethodPost {
+		response.Message = "Auto-download setting updated"
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Auto-read config endpoint - GET returns whether incoming messages are marked read automatically, POST changes it
+func autoReadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.Enabled == nil {
+			response := APIResponse{
+				Success: false,
+				Message: "enabled is required and must be true or false",
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		autoRead.Store(*req.Enabled)
+		log.Printf("Automatic read receipts updated: %t", *req.Enabled)
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Auto-read setting retrieved",
+		Data: map[string]interface{}{
+			"enabled": autoRead.Load(),
+		},
+	}
+	if r.Method == http.MethodPost {
+		response.Message = "Auto-read setting updated"
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Store-outgoing config endpoint - GET returns whether sent messages are stored, POST changes it
+func storeOutgoingConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.Enabled == nil {
+			response := APIResponse{
+				Success: false,
+				Message: "enabled is required and must be true or false",
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		storeOutgoing.Store(*req.Enabled)
+		log.Printf("Storing outgoing messages updated: %t", *req.Enabled)
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Store-outgoing setting retrieved",
+		Data: map[string]interface{}{
+			"enabled": storeOutgoing.Load(),
+		},
+	}
+	if r.Method == http.MethodPost {
+		response.Message = "Store-outgoing setting updated"
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Message footer config endpoint - GET returns the footer added to outgoing messages, POST changes it ("" turns it off)
+func messageFooterConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			Footer *string `json:"footer"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.Footer == nil {
+			response := APIResponse{
+				Success: false,
+				Message: "footer is required; use an empty string to turn it off",
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		messageFooter.Store(req.Footer)
+		log.Printf("Message footer updated: %q", *req.Footer)
+	}
+
+	footer := resolveFooter(nil)
+	response := APIResponse{
+		Success: true,
+		Message: "Message footer retrieved",
+		Data: map[string]interface{}{
+			"footer":  footer,
+			"enabled": footer != "",
+		},
+	}
+	if r.Method == http.MethodPost {
+		response.Message = "Message footer updated"
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// downloadHeaderConfig holds what downloadFile sends along with the request. Extra headers are
+// configured per host, as they may hold tokens that must only reach the host they belong to.
+type downloadHeaderConfig struct {
+	UserAgent string                       // empty for Go's default
+	Hosts     map[string]map[string]string // host or *.domain -> headers, e.g. Authorization for a CDN
+}
+
+// Summary describes the config without header values, which may hold tokens
+func (c *downloadHeaderConfig) Summary() map[string]interface{} {
+	hosts := map[string][]string{}
+	for host, headers := range c.Hosts {
+		hosts[host] = slices.Sorted(maps.Keys(headers))
+	}
+	return map[string]interface{}{
+		"user_agent": c.UserAgent,
+		"headers":    hosts,
+	}
+}
+
+// headersFor returns the headers configured for host: its own, or those of the most specific
+// *.domain it is a subdomain of
+func (c *downloadHeaderConfig) headersFor(host string) map[string]string {
+	host = strings.ToLower(host)
+	if headers, ok := c.Hosts[host]; ok {
+		return headers
+	}
+	var match string
+	for pattern := range c.Hosts {
+		if domain, ok := strings.CutPrefix(pattern, "*"); ok && strings.HasSuffix(host, domain) && len(pattern) > len(match) {
+			match = pattern
+		}
+	}
+	return c.Hosts[match]
+}
+
+// Apply sets the User-Agent and the headers configured for req's host
+func (c *downloadHeaderConfig) Apply(req *http.Request) {
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	for name, value := range c.headersFor(req.URL.Hostname()) {
+		req.Header.Set(name, value)
+	}
+}
+
+// redirectDownloadHeaders is the download client's CheckRedirect. The headers of the previous
+// host are copied to the redirect, so on a move to another host they are replaced by that host's.
+func redirectDownloadHeaders(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	previous := via[len(via)-1]
+	if strings.EqualFold(req.URL.Hostname(), previous.URL.Hostname()) {
+		return nil
+	}
+	config := downloadHeaders.Load()
+	for name := range config.headersFor(previous.URL.Hostname()) {
+		req.Header.Del(name)
+	}
+	config.Apply(req)
+	return nil
+}
+
+// validateHeaderValue rejects values that would break or inject into the request
+func validateHeaderValue(value string) error {
+	for _, c := range value {
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return fmt.Errorf("header values can't contain control characters")
+		}
+	}
+	return nil
+}
+
+// validateDownloadHeaders checks per-host headers before they are sent with attachment downloads
+// and returns them with the hosts lowercased
+func validateDownloadHeaders(hosts map[string]map[string]string) (map[string]map[string]string, error) {
+	valid := make(map[string]map[string]string, len(hosts))
+	for host, headers := range hosts {
+		host = strings.ToLower(host)
+		if !downloadHostRegex.MatchString(host) {
+			return nil, fmt.Errorf("invalid host %q: use a host name like cdn.example.com or *.example.com for its subdomains", host)
+		}
+		for name, value := range headers {
+			if !headerNameRegex.MatchString(name) {
+				return nil, fmt.Errorf("invalid header name %q for %s", name, host)
+			}
+			switch http.CanonicalHeaderKey(name) {
+			case "Host", "Content-Length", "Transfer-Encoding", "Connection", "Upgrade":
+				return nil, fmt.Errorf("header %s is set by the HTTP client and can't be overridden", name)
+			case "User-Agent":
+				return nil, fmt.Errorf("set the User-Agent through user_agent instead of headers")
+			}
+			if err := validateHeaderValue(value); err != nil {
+				return nil, fmt.Errorf("header %s for %s: %v", name, host, err)
+			}
+		}
+		valid[host] = headers
+	}
+	return valid, nil
+}
+
+// Download headers endpoint - view (GET) or change (POST) the User-Agent and per-host headers used to fetch attachments by URL
+func downloadHeadersConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			UserAgent *string                      `json:"user_agent"`
+			Headers   map[string]map[string]string `json:"headers"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || (req.UserAgent == nil && req.Headers == nil) {
+			response := APIResponse{
+				Success: false,
+				Message: "user_agent or headers (an object of host to headers) is required; use an empty string or object to reset them",
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		config := *downloadHeaders.Load()
+		if req.UserAgent != nil {
+			if err := validateHeaderValue(*req.UserAgent); err != nil {
+				response := APIResponse{
+					Success: false,
+					Message: fmt.Sprintf("Invalid user_agent: %v", err),
+				}
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(response)
+				return
+			}
+			config.UserAgent = *req.UserAgent
+		}
+		if req.Headers != nil {
+			hosts, err := validateDownloadHeaders(req.Headers)
+			if err != nil {
+				response := APIResponse{
+					Success: false,
+					Message: fmt.Sprintf("Invalid headers: %v", err),
+				}
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(response)
+				return
+			}
+			config.Hosts = hosts
+		}
+
+		downloadHeaders.Store(&config)
+		log.Printf("Download headers updated: User-Agent %q, extra headers for %d host(s)", config.UserAgent, len(config.Hosts))
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Download headers retrieved",
+		Data:    downloadHeaders.Load().Summary(),
+	}
+	if r.Method == http.MethodPost {
+		response.Message = "Download headers updated"
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// chatReceiptMode returns the receipt rule of a chat, falling back to the global auto-read setting
+func chatReceiptMode(chat types.JID) string {
+	var mode string
+	err := db.QueryRow("SELECT mode FROM receipt_rules WHERE chat = $1", chat.String()).Scan(&mode)
+	if err == nil {
+		return mode
+	}
+	if err != sql.ErrNoRows {
+		log.Printf("Failed to look up receipt rule for %s: %v", chat.String(), err)
+	}
+	if autoRead.Load() {
+		return "read"
+	}
+	return "none"
+}
+
+// Receipt rules endpoint - list the per-chat read receipt rules (GET) or create/update one (POST)
+func receiptRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			Chat string `json:"chat"`
+			Mode string `json:"mode"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if _, known := receiptModes[req.Mode]; err != nil || req.Chat == "" || (!known && req.Mode != "none") {
+			response := APIResponse{
+				Success: false,
+				Message: "chat is required and mode must be read, read_self or none",
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		rule := ReceiptRule{Chat: normalizeChatJID(req.Chat), Mode: req.Mode}
+		err = db.QueryRow(`
+			INSERT INTO receipt_rules (chat, mode) VALUES ($1, $2)
+			ON CONFLICT (chat) DO UPDATE SET mode = EXCLUDED.mode, updated_at = NOW()
+			RETURNING created_at, updated_at`,
+			rule.Chat, rule.Mode).Scan(&rule.CreatedAt, &rule.UpdatedAt)
+		if err != nil {
+			log.Printf("Failed to save receipt rule: %v", err)
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to save receipt rule: %v", err),
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		log.Printf("Receipt rule saved: %s -> %s", rule.Chat, rule.Mode)
+		response := APIResponse{
+			Success: true,
+			Message: "Receipt rule saved",
+			Data:    rule,
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	rows, err := db.Query("SELECT chat, mode, created_at, updated_at FROM receipt_rules ORDER BY chat")
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to list receipt rules: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	defer rows.Close()
+
+	rules := []ReceiptRule{}
+	for rows.Next() {
+		var rule ReceiptRule
+		if err := rows.Scan(&rule.Chat, &rule.Mode, &rule.CreatedAt, &rule.UpdatedAt); err != nil {
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to list receipt rules: %v", err),
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		rules = append(rules, rule)
+	}
+
+	defaultMode := "none"
+	if autoRead.Load() {
+		defaultMode = "read"
+	}
+	response := APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Found %d receipt rule(s)", len(rules)),
+		Data: map[string]interface{}{
+			"default": defaultMode,
+			"rules":   rules,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Single receipt rule endpoint - delete a chat's rule so it follows the global setting again
+func receiptRuleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	chat := normalizeChatJID(mux.Vars(r)["chat"])
+	result, err := db.Exec("DELETE FROM receipt_rules WHERE chat = $1", chat)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to delete receipt rule: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		response := APIResponse{
+			Success: false,
+			Message: "Receipt rule not found",
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	log.Printf("Receipt rule deleted: %s", chat)
+	response := APIResponse{
+		Success: true,
+		Message: "Receipt rule deleted",
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// filterText is the text filter rules are matched against: the message body or a media caption
+func filterText(msg *waProto.Message) string {
+	switch {
+	case msg.GetConversation() != "":
+		return msg.GetConversation()
+	case msg.GetExtendedTextMessage().GetText() != "":
+		return msg.GetExtendedTextMessage().GetText()
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetCaption()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetCaption()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage().GetCaption()
+	}
+	return ""
+}
+
+// matchFilterRules returns the rules whose keyword (case-insensitive) or regex occurs in the text
+func matchFilterRules(text string) []FilterRule {
+	if text == "" {
+		return nil
+	}
+	filterRulesMu.RLock()
+	defer filterRulesMu.RUnlock()
+	var matched []FilterRule
+	lower := strings.ToLower(text)
+	for _, rule := range filterRules {
+		if rule.compiled != nil && rule.compiled.MatchString(text) ||
+			rule.compiled == nil && strings.Contains(lower, strings.ToLower(rule.Pattern)) {
+			matched = append(matched, rule)
+		}
+	}
+	return matched
+}
+
+// loadFilterRules refreshes the in-memory copy of filter_rules used by handleMessage
+func loadFilterRules() error {
+	rows, err := db.Query("SELECT id, pattern, is_regex, drop_webhook, skip_read, created_at FROM filter_rules ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	rules := []FilterRule{}
+	for rows.Next() {
+		var rule FilterRule
+		if err := rows.Scan(&rule.ID, &rule.Pattern, &rule.Regex, &rule.DropWebhook, &rule.SkipRead, &rule.CreatedAt); err != nil {
+			return err
+		}
+		if rule.Regex {
+			rule.compiled, err = regexp.Compile(rule.Pattern)
+			if err != nil {
+				log.Printf("Skipping filter rule %d with invalid regex %q: %v", rule.ID, rule.Pattern, err)
+				continue
+			}
+		}
+		rules = append(rules, rule)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	filterRulesMu.Lock()
+	filterRules = rules
+	filterRulesMu.Unlock()
+	return nil
+}
+
+// Filter rules endpoint - list the spam filter rules (GET) or add one (POST)
+func filterRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			Pattern     string `json:"pattern"`
+			Regex       bool   `json:"regex"`
+			DropWebhook *bool  `json:"drop_webhook"`
+			SkipRead    bool   `json:"skip_read"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || strings.TrimSpace(req.Pattern) == "" {
+			response := APIResponse{
+				Success: false,
+				Message: "pattern is required",
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		if req.Regex {
+			if _, err := regexp.Compile(req.Pattern); err != nil {
+				response := APIResponse{
+					Success: false,
+					Message: fmt.Sprintf("Invalid regex: %v", err),
+				}
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(response)
+				return
+			}
+		}
+
+		// Matching messages are kept out of the webhook unless asked otherwise
+		rule := FilterRule{Pattern: req.Pattern, Regex: req.Regex, DropWebhook: true, SkipRead: req.SkipRead}
+		if req.DropWebhook != nil {
+			rule.DropWebhook = *req.DropWebhook
+		}
+		err = db.QueryRow(`
+			INSERT INTO filter_rules (pattern, is_regex, drop_webhook, skip_read) VALUES ($1, $2, $3, $4)
+			RETURNING id, created_at`,
+			rule.Pattern, rule.Regex, rule.DropWebhook, rule.SkipRead).Scan(&rule.ID, &rule.CreatedAt)
+		if err == nil {
+			err = loadFilterRules()
+		}
+		if err != nil {
+			log.Printf("Failed to save filter rule: %v", err)
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to save filter rule: %v", err),
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		log.Printf("Filter rule %d saved: %q (regex: %v)", rule.ID, rule.Pattern, rule.Regex)
+		response := APIResponse{
+			Success: true,
+			Message: "Filter rule saved",
+			Data:    rule,
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	filterRulesMu.RLock()
+	rules := slices.Clone(filterRules)
+	filterRulesMu.RUnlock()
+	response := APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Found %d filter rule(s)", len(rules)),
+		Data: map[string]interface{}{
+			"rules": rules,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Single filter rule endpoint - delete a rule so matching messages are handled normally again
+func filterRuleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: "Invalid filter rule ID",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM filter_rules WHERE id = $1", id)
+	if err == nil {
+		err = loadFilterRules()
+	}
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to delete filter rule: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		response := APIResponse{
+			Success: false,
+			Message: "Filter rule not found",
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	log.Printf("Filter rule deleted: %d", id)
+	response := APIResponse{
+		Success: true,
+		Message: "Filter rule deleted",
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /config/webhook-secret endpoint - view signing status or rotate the secret without restarting
+func webhookSecretConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			Secret       *string `json:"secret"`
+			GraceSeconds int     `json:"grace_seconds"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.Secret == nil || req.GraceSeconds < 0 {
+			response := APIResponse{
+				Success: false,
+				Message: "secret is required (empty to disable signing) and grace_seconds must not be negative",
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		grace := time.Duration(req.GraceSeconds) * time.Second
+		webhookSecret.SetSecret(*req.Secret, grace)
+		if *req.Secret == "" {
+			log.Println("Webhook signing disabled")
+		} else {
+			log.Printf("Webhook secret rotated, previous secret accepted for %s", grace)
+		}
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Webhook signing status retrieved",
+		Data:    webhookSecret.Status(),
+	}
+	if r.Method == http.MethodPost {
+		response.Message = "Webhook secret updated"
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Message status endpoint - delivery/read state of a sent message, with per-participant receipts when detailed=true
+func messageStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	messageID := mux.Vars(r)["id"]
+	detailed, _ := strconv.ParseBool(r.URL.Query().Get("detailed"))
+
+	rows, err := db.Query(`SELECT chat, participant, type, timestamp FROM message_receipts
+		WHERE message_id = $1 ORDER BY timestamp`, messageID)
+	if err != nil {
+		log.Printf("Failed to load receipts for %s: %v", messageID, err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to load receipts: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	defer rows.Close()
+
+	chat := ""
+	receipts := map[string][]map[string]interface{}{
+		"delivered": {},
+		"read":      {},
+		"played":    {},
+	}
+	for rows.Next() {
+		var participant, status string
+		var timestamp time.Time
+		err := rows.Scan(&chat, &participant, &status, &timestamp)
+		if err != nil {
+			log.Printf("Failed to read receipt for %s: %v", messageID, err)
+			continue
+		}
+		receipts[status] = append(receipts[status], map[string]interface{}{
+			"participant": participant,
+			"timestamp":   timestamp,
+		})
+	}
+
+	// The overall status is the furthest any recipient has got
+	status := "sent"
+	for _, s := range []string{"delivered", "read", "played"} {
+		if len(receipts[s]) > 0 {
+			status = s
+		}
+	}
+
+	data := map[string]interface{}{
+		"message_id":      messageID,
+		"chat":            chat,
+		"status":          status,
+		"delivered_count": len(receipts["delivered"]),
+		"read_count":      len(receipts["read"]),
+		"played_count":    len(receipts["played"]),
+	}
+	if detailed {
+		data["delivered_to"] = receipts["delivered"]
+		data["read_by"] = receipts["read"]
+		data["played_by"] = receipts["played"]
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Message status retrieved successfully",
+		Data:    data,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /messages endpoint - page through the stored messages of a chat, newest first
+func messagesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	chat := r.URL.Query().Get("chat")
+	if chat == "" {
+		response := APIResponse{
+			Success: false,
+			Message: "chat is required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	chat = normalizeChatJID(chat)
+
+	limit, err := parseCountParam(r, "limit", 50, 500)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: err.Error(),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Pages continue below the oldest message of the previous page; one extra row tells whether there is more
+	var messages []StoredMessage
+	before := r.URL.Query().Get("before")
+	if before != "" {
+		var timestamp time.Time
+		err = db.QueryRow("SELECT timestamp FROM messages WHERE chat = $1 AND id = $2", chat, before).Scan(&timestamp)
+		if err == sql.ErrNoRows {
+			response := APIResponse{
+				Success: false,
+				Message: "before refers to a message that isn't stored in this chat",
+			}
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		if err == nil {
+			messages, err = queryStoredMessages(`SELECT `+storedMessageColumns+` FROM messages
+				WHERE chat = $1 AND (timestamp, id) < ($2, $3)
+				ORDER BY timestamp DESC, id DESC LIMIT $4`, chat, timestamp, before, limit+1)
+		}
+	} else {
+		messages, err = queryStoredMessages(`SELECT `+storedMessageColumns+` FROM messages
+			WHERE chat = $1
+			ORDER BY timestamp DESC, id DESC LIMIT $2`, chat, limit+1)
+	}
+	if err != nil {
+		log.Printf("Failed to load messages of %s: %v", chat, err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to load messages: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	data := map[string]interface{}{
+		"chat":     chat,
+		"messages": messages,
+		"has_more": hasMore,
+	}
+	if hasMore && len(messages) > 0 {
+		data["next_before"] = messages[len(messages)-1].ID
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Found %d message(s)", len(messages)),
+		Data:    data,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Message context endpoint - return stored messages around a given message
+func messageContextHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	chat := normalizeChatJID(vars["chat"])
+	messageID := vars["id"]
+
+	before, err := parseCountParam(r, "before", 5, 100)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: err.Error(),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	after, err := parseCountParam(r, "after", 5, 100)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: err.Error(),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	target, err := queryStoredMessages("SELECT "+storedMessageColumns+" FROM messages WHERE chat = $1 AND id = $2", chat, messageID)
+	if err != nil {
+		log.Printf("Failed to load message: %v", err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to load message: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if len(target) == 0 {
+		response := APIResponse{
+			Success: false,
+			Message: "Message not found",
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	beforeMsgs, err := queryStoredMessages(`SELECT `+storedMessageColumns+` FROM messages
+		WHERE chat = $1 AND (timestamp, id) < ($2, $3)
+		ORDER BY timestamp DESC, id DESC LIMIT $4`, chat, target[0].Timestamp, messageID, before)
+	if err == nil {
+		// Earlier messages were fetched newest-first; put them back in chronological order
+		for i, j := 0, len(beforeMsgs)-1; i < j; i, j = i+1, j-1 {
+			beforeMsgs[i], beforeMsgs[j] = beforeMsgs[j], beforeMsgs[i]
+		}
+	}
+	var afterMsgs []StoredMessage
+	if err == nil {
+		afterMsgs, err = queryStoredMessages(`SELECT `+storedMessageColumns+` FROM messages
+			WHERE chat = $1 AND (timestamp, id) > ($2, $3)
+			ORDER BY timestamp ASC, id ASC LIMIT $4`, chat, target[0].Timestamp, messageID, after)
+	}
+	if err != nil {
+		log.Printf("Failed to load message context: %v", err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to load message context: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Message context retrieved",
+		Data: map[string]interface{}{
+			"message": target[0],
+			"before":  beforeMsgs,
+			"after":   afterMsgs,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// templatePlaceholders lists the distinct placeholder names used in a template body
+func templatePlaceholders(body string) []string {
+	placeholders := []string{}
+	seen := map[string]bool{}
+	for _, match := range templatePlaceholderPattern.FindAllStringSubmatch(body, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			placeholders = append(placeholders, match[1])
+		}
+	}
+	return placeholders
+}
+
+// renderTemplate substitutes variables into a template body, failing if any placeholder has no value
+func renderTemplate(body string, variables map[string]string) (string, error) {
+	var missing []string
+	for _, name := range templatePlaceholders(body) {
+		if _, ok := variables[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing template variables: %s", strings.Join(missing, ", "))
+	}
+
+	return templatePlaceholderPattern.ReplaceAllStringFunc(body, func(placeholder string) string {
+		name := templatePlaceholderPattern.FindStringSubmatch(placeholder)[1]
+		return variables[name]
+	}), nil
+}
+
+func getTemplate(name string) (*MessageTemplate, error) {
+	var tmpl MessageTemplate
+	err := db.QueryRow("SELECT name, body, created_at, updated_at FROM templates WHERE name = $1", name).
+		Scan(&tmpl.Name, &tmpl.Body, &tmpl.CreatedAt, &tmpl.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.Placeholders = templatePlaceholders(tmpl.Body)
+	return &tmpl, nil
+}
+
+// Templates endpoint - list templates (GET) or create/update one (POST)
+func templatesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			Name string `json:"name"`
+			Body string `json:"body"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.Name == "" || req.Body == "" {
+			response := APIResponse{
+				Success: false,
+				Message: "Template name and body are required",
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		tmpl := MessageTemplate{
+			Name:         req.Name,
+			Body:         req.Body,
+			Placeholders: templatePlaceholders(req.Body),
+		}
+		err = db.QueryRow(`
+			INSERT INTO templates (name, body) VALUES ($1, $2)
+			ON CONFLICT (name) DO UPDATE SET body = EXCLUDED.body, updated_at = NOW()
+			RETURNING created_at, updated_at`,
+			req.Name, req.Body).Scan(&tmpl.CreatedAt, &tmpl.UpdatedAt)
+		if err != nil {
+			log.Printf("Failed to save template: %v", err)
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to save template: %v", err),
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		log.Printf("Template saved: %s", req.Name)
+		response := APIResponse{
+			Success: true,
+			Message: "Template saved",
+			Data:    tmpl,
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	rows, err := db.Query("SELECT name, body, created_at, updated_at FROM templates ORDER BY name")
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to list templates: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	defer rows.Close()
+
+	templates := []MessageTemplate{}
+	for rows.Next() {
+		var tmpl MessageTemplate
+		if err := rows.Scan(&tmpl.Name, &tmpl.Body, &tmpl.CreatedAt, &tmpl.UpdatedAt); err != nil {
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to list templates: %v", err),
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		tmpl.Placeholders = templatePlaceholders(tmpl.Body)
+		templates = append(templates, tmpl)
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Found %d template(s)", len(templates)),
+		Data:    templates,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Single template endpoint - get (GET) or delete (DELETE) a template by name
+func templateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	name := mux.Vars(r)["name"]
+
+	if r.Method == http.MethodDelete {
+		result, err := db.Exec("DELETE FROM templates WHERE name = $1", name)
+		if err != nil {
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to delete template: %v", err),
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			response := APIResponse{
+				Success: false,
+				Message: "Template not found",
+			}
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		log.Printf("Template deleted: %s", name)
+		response := APIResponse{
+			Success: true,
+			Message: "Template deleted",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	tmpl, err := getTemplate(name)
+	if err == sql.ErrNoRows {
+		response := APIResponse{
+			Success: false,
+			Message: "Template not found",
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	} else if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to load template: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Template retrieved",
+		Data:    tmpl,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Send template endpoint - render a stored template with variables and send it
+func sendTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req SendTemplateRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Number == "" || req.Template == "" {
+		response := APIResponse{
+			Success: false,
+			Message: "Number and template are required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	tmpl, err := getTemplate(req.Template)
+	if err == sql.ErrNoRows {
+		response := APIResponse{
+			Success: false,
+			Message: "Template not found",
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	} else if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to load template: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	text, err := renderTemplate(tmpl.Body, req.Variables)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: err.Error(),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	targetJID, err := resolveSendTarget(req.Number)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid phone number: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	stopTyping := sendTypingIndicator(targetJID)
+	defer stopTyping()
+
+	msg := &waProto.Message{Conversation: proto.String(text)}
+	applyFooter(msg, resolveFooter(req.Footer))
+
+	sendLimiter.Wait()
+	resp, err := sendMessage(context.Background(), targetJID, msg)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to send message: %v", err),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	log.Printf("Template %s sent to %s (ID: %s)", req.Template, targetJID.String(), resp.ID)
+
+	response := APIResponse{
+		Success: true,
+		Message: "Template message sent",
+		Data: map[string]interface{}{
+			"number":     req.Number,
+			"template":   req.Template,
+			"message":    text,
+			"message_id": resp.ID,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Keep message endpoint - keep (or un-keep) a disappearing message in the chat
+func keepMessageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req KeepMessageRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Chat == "" || req.MessageID == "" {
+		response := APIResponse{
+			Success: false,
+			Message: "Chat and message_id are required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chatJID, err := types.ParseJID(normalizeChatJID(req.Chat))
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid chat: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Keeping only makes sense in chats where messages disappear
+	chatTimersMu.RLock()
+	timer := chatTimers[chatJID.String()]
+	chatTimersMu.RUnlock()
+	if timer == 0 {
+		response := APIResponse{
+			Success: false,
+			Message: "Chat does not have disappearing messages enabled (no timer seen for this chat)",
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Fill in the sender when the caller didn't provide it. Our own messages are keyed with our
+	// own JID, so a message we sent in a 1:1 chat isn't mistaken for one from the other side.
+	sender := req.Sender
+	if sender == "" {
+		known, err := lookupKnownMessage(chatJID, req.MessageID)
+		if err != nil {
+			log.Printf("Failed to look up message %s in %s: %v", req.MessageID, chatJID.String(), err)
+		}
+		if known != nil && known.FromMe {
+			sender = client.Store.ID.ToNonAD().String()
+		} else if known != nil && known.Sender != "" {
+			sender = known.Sender
+		} else if chatJID.Server == types.DefaultUserServer {
+			sender = chatJID.String()
+		}
+	}
+	if sender == "" {
+		response := APIResponse{
+			Success: false,
+			Message: "Sender is required for group messages that are not in the message store",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	senderJID, err := types.ParseJID(normalizeChatJID(sender))
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid sender: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	keep := req.Keep == nil || *req.Keep
+	keepType := waProto.KeepType_KEEP_FOR_ALL
+	if !keep {
+		keepType = waProto.KeepType_UNDO_KEEP_FOR_ALL
+	}
+
+	message := &waProto.Message{
+		KeepInChatMessage: &waProto.KeepInChatMessage{
+			Key:         client.BuildMessageKey(chatJID, senderJID, req.MessageID),
+			KeepType:    keepType.Enum(),
+			TimestampMS: proto.Int64(time.Now().UnixMilli()),
+		},
+	}
+
+	resp, err := sendMessage(context.Background(), chatJID, message)
+	if err != nil {
+		log.Printf("Failed to send keep-in-chat: %v", err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to keep message: %v", err),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	log.Printf("Keep-in-chat (%s) sent for message %s in %s", keepType.String(), req.MessageID, chatJID.String())
+	_, err = db.Exec("UPDATE messages SET kept = $1 WHERE chat = $2 AND id = $3", keep, chatJID.String(), req.MessageID)
+	if err != nil {
+		log.Printf("Failed to update kept state of %s: %v", req.MessageID, err)
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Message kept in chat",
+		Data: map[string]interface{}{
+			"chat":       chatJID.String(),
+			"message_id": req.MessageID,
+			"kept":       keep,
+			"timestamp":  resp.Timestamp,
+		},
+	}
+	if !keep {
+		response.Message = "Message no longer kept in chat"
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Mark read before endpoint - send read receipts for every stored message in a chat older than a timestamp
+func markReadBeforeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req struct {
+		Chat   string    `json:"chat"`
+		Before time.Time `json:"before"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Chat == "" || req.Before.IsZero() {
+		response := APIResponse{
+			Success: false,
+			Message: "Chat and before (RFC 3339 timestamp) are required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chatJID, err := types.ParseJID(normalizeChatJID(req.Chat))
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid chat: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	messages, err := queryStoredMessages(`SELECT `+storedMessageColumns+` FROM messages
+		WHERE chat = $1 AND timestamp < $2 AND from_me = FALSE
+		ORDER BY timestamp`, chatJID.String(), req.Before)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to load messages: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Read receipts are addressed per sender (needed for groups), so batch IDs by sender
+	idsBySender := make(map[string][]types.MessageID)
+	for _, msg := range messages {
+		idsBySender[msg.Sender] = append(idsBySender[msg.Sender], msg.ID)
+	}
+
+	marked := 0
+	for sender, ids := range idsBySender {
+		senderJID, err := types.ParseJID(sender)
+		if err != nil {
+			log.Printf("Skipping messages with invalid sender %s: %v", sender, err)
+			continue
+		}
+		for start := 0; start < len(ids); start += 100 {
+			end := min(start+100, len(ids))
+			err = client.MarkRead(ids[start:end], time.Now(), chatJID, senderJID, types.ReceiptTypeRead)
+			if err != nil {
+				log.Printf("Failed to mark messages as read: %v", err)
+				response := APIResponse{
+					Success: false,
+					Message: fmt.Sprintf("Failed to mark messages as read after %d: %v", marked, err),
+					Data:    map[string]interface{}{"marked": marked},
+				}
+				json.NewEncoder(w).Encode(response)
+				return
+			}
+			marked += end - start
+		}
+	}
+
+	log.Printf("Marked %d message(s) in %s as read", marked, chatJID.String())
+
+	response := APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Marked %d message(s) as read", marked),
+		Data: map[string]interface{}{
+			"chat":   chatJID.String(),
+			"before": req.Before,
+			"marked": marked,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /dedup/stats endpoint - inspect the incoming message dedup cache
+func dedupStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	response := APIResponse{
+		Success: true,
+		Message: "Dedup cache stats retrieved successfully",
+		Data:    messageDedup.Stats(),
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /dedup/clear endpoint - flush the dedup cache so redelivered messages are processed again
+func dedupClearHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	cleared := messageDedup.Clear()
+	log.Printf("Dedup cache cleared (%d entries)", cleared)
+
+	response := APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Cleared %d entries from dedup cache", cleared),
+		Data: map[string]interface{}{
+			"cleared": cleared,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /groups endpoint - list the groups the paired account is a member of
+func groupsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Accounts in many groups get a large response, so don't let a slow reply hold the request forever
+	ctx, cancel := context.WithTimeout(r.Context(), groupListTimeout)
+	defer cancel()
+
+	groups, err := client.GetJoinedGroups(ctx)
+	if err != nil {
+		log.Printf("Failed to list joined groups: %v", err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("WhatsApp did not return the group list within %s - please try again", groupListTimeout),
+			}
+			w.WriteHeader(http.StatusGatewayTimeout)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to list groups: %v", err),
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// The full info came with the list, so later /groups/{jid} lookups don't need another fetch
+	groupCacheMu.Lock()
+	for _, info := range groups {
+		groupCache[info.JID] = info
+	}
+	groupCacheMu.Unlock()
+
+	list := make([]map[string]interface{}, 0, len(groups))
+	for _, info := range groups {
+		list = append(list, map[string]interface{}{
+			"jid":          info.JID.String(),
+			"name":         info.Name,
+			"topic":        info.Topic,
+			"participants": len(info.Participants),
+			"owner":        info.OwnerJID.String(),
+		})
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Found %d group(s)", len(list)),
+		Data: map[string]interface{}{
+			"groups": list,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /groups/{jid} endpoint - group metadata, served from the group cache
+func groupInfoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	groupJID, err := types.ParseJID(mux.Vars(r)["jid"])
+	if err != nil || groupJID.Server != types.GroupServer {
+		response := APIResponse{
+			Success: false,
+			Message: "Invalid group JID",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	info, err := getGroupInfo(groupJID)
+	if err != nil {
+		log.Printf("Failed to get group info for %s: %v", groupJID.String(), err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to get group info: %v", err),
+		}
+		switch {
+		case errors.Is(err, whatsmeow.ErrGroupNotFound):
+			response.Message = "Group not found"
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, whatsmeow.ErrNotInGroup):
+			response.Message = "Not a member of this group"
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	groupCacheMu.RLock()
+	participants := make([]map[string]interface{}, 0, len(info.Participants))
+	for _, participant := range info.Participants {
+		participants = append(participants, map[string]interface{}{
+			"jid":            participant.JID.String(),
+			"is_admin":       participant.IsAdmin,
+			"is_super_admin": participant.IsSuperAdmin,
+		})
+	}
+	data := map[string]interface{}{
+		"jid":          info.JID.String(),
+		"subject":      info.Name,
+		"description":  info.Topic,
+		"owner":        info.OwnerJID.String(),
+		"announce":     info.IsAnnounce,
+		"locked":       info.IsLocked,
+		"participants": participants,
+	}
+	groupCacheMu.RUnlock()
+
+	response := APIResponse{
+		Success: true,
+		Message: "Group info retrieved successfully",
+		Data:    data,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /groups/{jid}/picture endpoint - get the group icon URL, or the image itself with ?download=true
+func groupPictureHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	groupJID, err := types.ParseJID(mux.Vars(r)["jid"])
+	if err != nil || groupJID.Server != types.GroupServer {
+		response := APIResponse{
+			Success: false,
+			Message: "Invalid group JID",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	preview, _ := strconv.ParseBool(r.URL.Query().Get("preview"))
+	download, _ := strconv.ParseBool(r.URL.Query().Get("download"))
+
+	picture, err := client.GetProfilePictureInfo(groupJID, &whatsmeow.GetProfilePictureParams{Preview: preview})
+	if errors.Is(err, whatsmeow.ErrProfilePictureNotSet) {
+		picture, err = nil, nil
+	}
+	if errors.Is(err, whatsmeow.ErrProfilePictureUnauthorized) {
+		response := APIResponse{
+			Success: false,
+			Message: "Not allowed to see this group's picture",
+		}
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get picture of group %s: %v", groupJID.String(), err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to get group picture: %v", err),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if picture == nil {
+		if download {
+			response := APIResponse{
+				Success: false,
+				Message: "Group has no picture",
+			}
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		response := APIResponse{
+			Success: true,
+			Message: "Group has no picture",
+			Data: map[string]interface{}{
+				"jid": groupJID.String(),
+				"url": nil,
+			},
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if download {
+		data, contentType, err := downloadFile(picture.URL)
+		if err != nil {
+			log.Printf("Failed to download picture of group %s: %v", groupJID.String(), err)
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to download group picture: %v", err),
+			}
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Write(data)
+		return
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Group picture retrieved successfully",
+		Data: map[string]interface{}{
+			"jid":  groupJID.String(),
+			"url":  picture.URL,
+			"id":   picture.ID,
+			"type": picture.Type,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /forward endpoint - forward a stored message, reusing the original media reference when it is still valid
+func forwardHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req ForwardRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Chat == "" || req.MessageID == "" || req.To == "" {
+		response := APIResponse{
+			Success: false,
+			Message: "Chat, message_id and to are required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	targetJID, err := resolveSendTarget(req.To, targetUser, targetGroup)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid destination: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var raw []byte
+	err = db.QueryRow("SELECT raw FROM messages WHERE chat = $1 AND id = $2", normalizeChatJID(req.Chat), req.MessageID).Scan(&raw)
+	if err == sql.ErrNoRows || (err == nil && len(raw) == 0) {
+		response := APIResponse{
+			Success: false,
+			Message: "Message not found in the message store",
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load message %s: %v", req.MessageID, err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to load message: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	msg := &waProto.Message{}
+	err = proto.Unmarshal(raw, msg)
+	if err != nil {
+		log.Printf("Failed to decode stored message %s: %v", req.MessageID, err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to decode stored message: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	// The message secret belongs to the original message and must not be reused
+	msg.MessageContextInfo = nil
+
+	// Reuse the original upload unless its reference has expired
+	mode := "none"
+	if media, _ := messageMedia(msg); media != nil {
+		mode = "reused"
+		if mediaReferenceExpired(media) {
+			log.Printf("Media reference for %s has expired, re-uploading", req.MessageID)
+			err = reuploadMedia(msg)
+			if err != nil {
+				log.Printf("Failed to re-upload media for %s: %v", req.MessageID, err)
+				response := APIResponse{
+					Success: false,
+					Message: fmt.Sprintf("Media reference expired and re-upload failed: %v", err),
+				}
+				json.NewEncoder(w).Encode(response)
+				return
+			}
+			mode = "reuploaded"
+		}
+	}
+
+	// Replace the original context (quotes, mentions, timer) with forwarding info
+	score := messageContextInfo(msg).GetForwardingScore() + 1
+	ctx := ensureContextInfo(msg)
+	proto.Reset(ctx)
+	ctx.IsForwarded = proto.Bool(true)
+	ctx.ForwardingScore = proto.Uint32(score)
+	applyChatTimer(msg, targetJID)
+
+	sendLimiter.Wait()
+	resp, err := sendMessage(context.Background(), targetJID, msg)
+	if err != nil {
+		log.Printf("Failed to forward message %s to %s: %v", req.MessageID, targetJID.String(), err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to forward message: %v", err),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	log.Printf("Forwarded message %s to %s (media: %s)", req.MessageID, targetJID.String(), mode)
+
+	response := APIResponse{
+		Success: true,
+		Message: "Message forwarded successfully",
+		Data: map[string]interface{}{
+			"message_id": resp.ID,
+			"to":         targetJID.String(),
+			"media":      mode,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /delete endpoint - delete a message for everyone (revoke) or only on this account's devices
+func deleteMessageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req DeleteMessageRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Chat == "" || req.MessageID == "" {
+		response := APIResponse{
+			Success: false,
+			Message: "Chat and message_id are required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chatJID, err := resolveSendTarget(req.Chat, targetUser, targetGroup)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid chat: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Without a sender the message is taken to be our own, unless the store knows better
+	known, err := lookupKnownMessage(chatJID, req.MessageID)
+	if err != nil {
+		log.Printf("Failed to look up message %s: %v", req.MessageID, err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to look up message: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	sender := req.Sender
+	if sender == "" && known != nil && !known.FromMe {
+		sender = known.Sender
+	}
+	senderJID := types.EmptyJID
+	if sender != "" {
+		senderJID, err = types.ParseJID(normalizeChatJID(sender))
+		if err != nil {
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Invalid sender: %v", err),
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		senderJID = senderJID.ToNonAD()
+	}
+	fromMe := senderJID.IsEmpty() || senderJID.User == client.Store.ID.User
+
+	if req.ForEveryone {
+		// Only group admins can delete someone else's message for everyone
+		if !fromMe && chatJID.Server != types.GroupServer {
+			response := APIResponse{
+				Success: false,
+				Message: "Only your own messages can be deleted for everyone in a private chat",
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		// WhatsApp ignores revocations it doesn't accept, so the age has to be known
+		if known == nil {
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Message %s is unknown: only stored messages (see WA_STORE_OUTGOING) and messages sent through this API in the last hour can be deleted for everyone", req.MessageID),
+			}
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		if time.Since(known.SentAt) > revokeWindow {
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Message was sent %s ago; WhatsApp only deletes messages for everyone within %s",
+					time.Since(known.SentAt).Round(time.Minute), revokeWindow),
+			}
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		sendLimiter.Wait()
+		resp, err := sendMessage(context.Background(), chatJID, client.BuildRevoke(chatJID, senderJID, req.MessageID))
+		if err != nil {
+			log.Printf("Failed to delete %s in %s for everyone: %v", req.MessageID, chatJID.String(), err)
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to delete message: %v", err),
+			}
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		// Our own revocations aren't echoed back, so record the deletion here
+		if _, err := db.Exec("UPDATE messages SET deleted_at = $1 WHERE chat = $2 AND id = $3 AND deleted_at IS NULL",
+			resp.Timestamp, chatJID.String(), req.MessageID); err != nil {
+			log.Printf("Failed to mark %s as deleted: %v", req.MessageID, err)
+		}
+		log.Printf("🗑️ Message %s in %s deleted for everyone", req.MessageID, chatJID.String())
+
+		response := APIResponse{
+			Success: true,
+			Message: "Message deleted for everyone",
+			Data: map[string]interface{}{
+				"chat":         chatJID.String(),
+				"message_id":   req.MessageID,
+				"for_everyone": true,
+				"id":           resp.ID,
+				"timestamp":    resp.Timestamp,
+			},
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Deleting for me is an app state change that the phone and other linked devices apply too
+	var messageTimestamp int64
+	if known != nil {
+		messageTimestamp = known.SentAt.Unix()
+	}
+	err = client.SendAppState(context.Background(), buildDeleteForMe(chatJID, senderJID, req.MessageID, fromMe, messageTimestamp))
+	if err != nil {
+		log.Printf("Failed to delete %s in %s for me: %v", req.MessageID, chatJID.String(), err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to delete message: %v", err),
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	log.Printf("🗑️ Message %s in %s deleted for me", req.MessageID, chatJID.String())
+
+	response := APIResponse{
+		Success: true,
+		Message: "Message deleted for me",
+		Data: map[string]interface{}{
+			"chat":         chatJID.String(),
+			"message_id":   req.MessageID,
+			"for_everyone": false,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// buildDeleteForMe builds the app state patch that deletes a message on our own devices only.
+// whatsmeow has no builder for it; the index follows the one of appstate.BuildStar.
+func buildDeleteForMe(chat, sender types.JID, messageID types.MessageID, fromMe bool, messageTimestamp int64) appstate.PatchInfo {
+	isFromMe, senderJID := "0", sender.String()
+	if fromMe {
+		isFromMe = "1"
+	}
+	if fromMe || chat.Server != types.GroupServer {
+		senderJID = "0"
+	}
+	return appstate.PatchInfo{
+		Type: appstate.WAPatchRegularHigh,
+		Mutations: []appstate.MutationInfo{{
+			Index:   []string{appstate.IndexDeleteMessageForMe, chat.String(), messageID, isFromMe, senderJID},
+			Version: 3,
+			Value: &waSyncAction.SyncActionValue{
+				DeleteMessageForMeAction: &waSyncAction.DeleteMessageForMeAction{
+					DeleteMedia:      proto.Bool(true),
+					MessageTimestamp: proto.Int64(messageTimestamp),
+				},
+			},
+		}},
+	}
+}
+
+// /edit endpoint - change the text of a message we sent
+func editMessageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req EditMessageRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Chat == "" || req.MessageID == "" || strings.TrimSpace(req.Message) == "" {
+		response := APIResponse{
+			Success: false,
+			Message: "Chat, message_id and message are required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chatJID, err := resolveSendTarget(req.Chat, targetUser, targetGroup)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid chat: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// WhatsApp ignores edits it doesn't accept, so ownership and age are checked here
+	known, err := lookupKnownMessage(chatJID, req.MessageID)
+	if err != nil {
+		log.Printf("Failed to look up message %s: %v", req.MessageID, err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to look up message: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if known == nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Message %s is unknown: only stored messages (see WA_STORE_OUTGOING) and messages sent through this API in the last hour can be edited", req.MessageID),
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if !known.FromMe {
+		response := APIResponse{
+			Success: false,
+			Message: "Only messages sent by this account can be edited",
+		}
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if age := time.Since(known.SentAt); age > whatsmeow.EditWindow {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Message was sent %s ago; WhatsApp only allows edits within %s", age.Round(time.Minute), whatsmeow.EditWindow),
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	edit := client.BuildEdit(chatJID, req.MessageID, &waProto.Message{Conversation: proto.String(req.Message)})
+	sendLimiter.Wait()
+	resp, err := sendMessage(context.Background(), chatJID, edit)
+	if err != nil {
+		log.Printf("Failed to edit %s in %s: %v", req.MessageID, chatJID.String(), err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to edit message: %v", err),
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if _, err := db.Exec("UPDATE messages SET content = $1 WHERE chat = $2 AND id = $3 AND from_me",
+		req.Message, chatJID.String(), req.MessageID); err != nil {
+		log.Printf("Failed to update stored message %s: %v", req.MessageID, err)
+	}
+	log.Printf("✏️ Message %s in %s edited", req.MessageID, chatJID.String())
+
+	response := APIResponse{
+		Success: true,
+		Message: "Message edited successfully",
+		Data: map[string]interface{}{
+			"chat":       chatJID.String(),
+			"message_id": req.MessageID,
+			"message":    req.Message,
+			"timestamp":  resp.Timestamp,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /star-message endpoint - star or unstar a message through an app state patch, as the phone does
+func starMessageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req StarMessageRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Chat == "" || req.MessageID == "" {
+		response := APIResponse{
+			Success: false,
+			Message: "Chat and message_id are required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chatJID, err := types.ParseJID(normalizeChatJID(req.Chat))
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid chat: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// The sender identifies the message within the chat; our own messages and 1:1 messages use the chat itself
+	sender := req.Sender
+	fromMe := req.FromMe
+	if sender == "" && !fromMe {
+		stored, err := queryStoredMessages("SELECT "+storedMessageColumns+" FROM messages WHERE chat = $1 AND id = $2", chatJID.String(), req.MessageID)
+		if err == nil && len(stored) > 0 {
+			sender = stored[0].Sender
+			fromMe = stored[0].FromMe
+		} else if chatJID.Server == types.DefaultUserServer {
+			sender = chatJID.String()
+		}
+	}
+	if fromMe {
+		sender = chatJID.String()
+	}
+	if sender == "" {
+		response := APIResponse{
+			Success: false,
+			Message: "Sender is required for group messages that are not in the message store",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	senderJID, err := types.ParseJID(normalizeChatJID(sender))
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid sender: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	starred := req.Starred == nil || *req.Starred
+	err = client.SendAppState(context.Background(), appstate.BuildStar(chatJID, senderJID.ToNonAD(), req.MessageID, fromMe, starred))
+	if err != nil {
+		log.Printf("Failed to update star for %s: %v", req.MessageID, err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to update star: %v", err),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	log.Printf("Message %s in %s starred: %t", req.MessageID, chatJID.String(), starred)
+
+	message := "Message starred successfully"
+	if !starred {
+		message = "Message unstarred successfully"
+	}
+	response := APIResponse{
+		Success: true,
+		Message: message,
+		Data: map[string]interface{}{
+			"chat":       chatJID.String(),
+			"message_id": req.MessageID,
+			"starred":    starred,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /groups/{jid}/broadcast-location endpoint - send a location to every group member in a private chat
+func broadcastLocationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	groupJID, err := types.ParseJID(mux.Vars(r)["jid"])
+	if err != nil || groupJID.Server != types.GroupServer {
+		response := APIResponse{
+			Success: false,
+			Message: "Invalid group JID",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req BroadcastLocationRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Latitude == nil || req.Longitude == nil ||
+		*req.Latitude < -90 || *req.Latitude > 90 || *req.Longitude < -180 || *req.Longitude > 180 {
+		response := APIResponse{
+			Success: false,
+			Message: "latitude (-90 to 90) and longitude (-180 to 180) are required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	info, err := getGroupInfo(groupJID)
+	if err != nil {
+		log.Printf("Failed to get group info for %s: %v", groupJID.String(), err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to get group info: %v", err),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Everyone except ourselves, preferring phone number JIDs for the private chats
+	groupCacheMu.RLock()
+	var recipients []types.JID
+	for _, participant := range info.Participants {
+		if (client.Store.ID != nil && sameParticipant(participant, *client.Store.ID)) || sameParticipant(participant, client.Store.LID) {
+			continue
+		}
+		recipient := participant.JID
+		if !participant.PhoneNumber.IsEmpty() {
+			recipient = participant.PhoneNumber
+		}
+		recipients = append(recipients, recipient)
+	}
+	groupCacheMu.RUnlock()
+
+	location := &waProto.Message{
+		LocationMessage: &waProto.LocationMessage{
+			DegreesLatitude:  req.Latitude,
+			DegreesLongitude: req.Longitude,
+			Name:             proto.String(req.Name),
+			Address:          proto.String(req.Address),
+		},
+	}
+
+	log.Printf("Broadcasting location to %d member(s) of %s", len(recipients), groupJID.String())
+	results := make([]BroadcastLocationResult, 0, len(recipients))
+	sent, failed := 0, 0
+	for _, recipient := range recipients {
+		result := BroadcastLocationResult{Participant: recipient.String()}
+
+		// Each recipient gets its own copy since the disappearing timer is per chat
+		msg := proto.Clone(location).(*waProto.Message)
+		if !req.Persist {
+			applyChatTimer(msg, recipient)
+		}
+
+		sendLimiter.Wait()
+		resp, err := sendMessage(context.Background(), recipient, msg)
+		if err != nil {
+			log.Printf("Failed to send location to %s: %v", recipient.String(), err)
+			result.Status = "failed"
+			result.Error = err.Error()
+			failed++
+		} else {
+			result.Status = "sent"
+			result.MessageID = resp.ID
+			sent++
+		}
+		results = append(results, result)
+	}
+
+	log.Printf("Location broadcast to %s complete: %d sent, %d failed", groupJID.String(), sent, failed)
+
+	response := APIResponse{
+		Success: failed == 0,
+		Message: fmt.Sprintf("Sent location to %d of %d member(s)", sent, len(recipients)),
+		Data: map[string]interface{}{
+			"group":   groupJID.String(),
+			"sent":    sent,
+			"failed":  failed,
+			"results": results,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /groups/{jid}/join-requests endpoint - GET lists pending join requests, POST approves or rejects them
+func groupJoinRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	groupJID, err := types.ParseJID(mux.Vars(r)["jid"])
+	if err != nil || groupJID.Server != types.GroupServer {
+		response := APIResponse{
+			Success: false,
+			Message: "Invalid group JID",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		requests, err := client.GetGroupRequestParticipants(groupJID)
+		if err != nil {
+			log.Printf("Failed to get join requests for %s: %v", groupJID.String(), err)
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to get join requests: %v", err),
+			}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		pending := make([]map[string]interface{}, 0, len(requests))
+		for _, request := range requests {
+			pending = append(pending, map[string]interface{}{
+				"requester":    request.JID.String(),
+				"requested_at": request.RequestedAt,
+			})
+		}
+
+		response := APIResponse{
+			Success: true,
+			Message: fmt.Sprintf("Found %d pending join request(s)", len(pending)),
+			Data: map[string]interface{}{
+				"group":    groupJID.String(),
+				"requests": pending,
+			},
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req struct {
+		Participants []string `json:"participants"`
+		Action       string   `json:"action"` // approve or reject
+	}
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || len(req.Participants) == 0 || (req.Action != "approve" && req.Action != "reject") {
+		response := APIResponse{
+			Success: false,
+			Message: "participants and action (approve or reject) are required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	participants := make([]types.JID, 0, len(req.Participants))
+	for _, participant := range req.Participants {
+		jid, err := types.ParseJID(normalizeChatJID(participant))
+		if err != nil {
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Invalid participant %q: %v", participant, err),
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		participants = append(participants, jid)
+	}
+
+	results, err := client.UpdateGroupRequestParticipants(groupJID, participants, whatsmeow.ParticipantRequestChange(req.Action))
+	if err != nil {
+		log.Printf("Failed to %s join requests for %s: %v", req.Action, groupJID.String(), err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to %s join requests: %v", req.Action, err),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	updated := make([]map[string]interface{}, 0, len(results))
+	for _, result := range results {
+		updated = append(updated, map[string]interface{}{
+			"participant": result.JID.String(),
+			"error":       result.Error,
+		})
+	}
+	log.Printf("Join requests for %s: %s %d participant(s)", groupJID.String(), req.Action, len(participants))
+
+	response := APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Join requests %sd", req.Action),
+		Data: map[string]interface{}{
+			"group":   groupJID.String(),
+			"action":  req.Action,
+			"results": updated,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /groups/{jid}/add-from-vcard endpoint - add the phone numbers of a contact card to a group
+func groupAddFromVCardHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	groupJID, err := types.ParseJID(mux.Vars(r)["jid"])
+	if err != nil || groupJID.Server != types.GroupServer {
+		response := APIResponse{
+			Success: false,
+			Message: "Invalid group JID",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var req struct {
+		VCard string `json:"vcard"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.VCard == "" {
+		response := APIResponse{
+			Success: false,
+			Message: "vcard is required",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// The waid= parameter is the number WhatsApp itself put on the card, so prefer it over the display number
+	contact := parseVCard(req.VCard)
+	var numbers []string
+	for _, phone := range contact.Phones {
+		number := phone.WaID
+		if number == "" {
+			number = normalizePhone(phone.Number)
+		}
+		if number != "" && !slices.Contains(numbers, number) {
+			numbers = append(numbers, number)
+		}
+	}
+	if len(numbers) == 0 {
+		response := APIResponse{
+			Success: false,
+			Message: "The vCard has no phone numbers",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	phones := make([]string, len(numbers))
+	for i, number := range numbers {
+		phones[i] = "+" + number
+	}
+	resolved, err := client.IsOnWhatsApp(phones)
+	if err != nil {
+		log.Printf("Failed to resolve numbers: %v", err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to resolve numbers: %v", err),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	jidByPhone := make(map[string]types.JID)
+	for _, res := range resolved {
+		if res.IsIn {
+			jidByPhone[normalizePhone(res.Query)] = res.JID
+		}
+	}
+
+	results := make([]map[string]interface{}, 0, len(numbers))
+	resultByJID := make(map[types.JID]map[string]interface{})
+	var participants []types.JID
+	for _, number := range numbers {
+		result := map[string]interface{}{"number": number}
+		results = append(results, result)
+
+		jid, ok := jidByPhone[number]
+		if !ok {
+			result["status"] = "not_on_whatsapp"
+			continue
+		}
+		result["jid"] = jid.String()
+		resultByJID[jid] = result
+		participants = append(participants, jid)
+	}
+
+	if len(participants) > 0 {
+		added, err := client.UpdateGroupParticipants(groupJID, participants, whatsmeow.ParticipantChangeAdd)
+		if err != nil {
+			log.Printf("Failed to add participants to %s: %v", groupJID.String(), err)
+			response := APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to add participants: %v", err),
+			}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		for _, participant := range added {
+			result, ok := resultByJID[participant.JID]
+			if !ok {
+				result, ok = resultByJID[participant.PhoneNumber]
+			}
+			if !ok {
+				continue
+			}
+			switch {
+			case participant.Error == 0:
+				result["status"] = "added"
+			case participant.AddRequest != nil:
+				// Their privacy settings only allow being added by contacts, so WhatsApp asks for an invite instead
+				result["status"] = "invite_required"
+			case participant.Error == 409:
+				result["status"] = "already_member"
+			default:
+				result["status"] = "failed"
+				result["error"] = participant.Error
+			}
+		}
+	}
+
+	addedCount := 0
+	for _, result := range results {
+		if result["status"] == "added" {
+			addedCount++
+		}
+	}
+	log.Printf("Added %d of %d number(s) from %s's vCard to %s", addedCount, len(numbers), contact.Name, groupJID.String())
+
+	response := APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Added %d of %d number(s) to the group", addedCount, len(numbers)),
+		Data: map[string]interface{}{
+			"group":   groupJID.String(),
+			"contact": contact,
+			"results": results,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /chats/{jid}/download-media endpoint - download every stored media message of a chat in the background
+func chatDownloadMediaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chatJID, err := types.ParseJID(normalizeChatJID(mux.Vars(r)["jid"]))
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid chat: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	job := newJob("download_media", chatJID.String())
+	go func() {
+		job.finish(downloadChatMedia(job, chatJID))
+	}()
+	log.Printf("Started media download job %s for chat %s", job.ID, chatJID.String())
+
+	response := APIResponse{
+		Success: true,
+		Message: "Media download started",
+		Data:    job.Snapshot(),
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+// downloadChatMedia saves the media of every stored message in chat that isn't in downloadDir yet
+func downloadChatMedia(job *backgroundJob, chat types.JID) error {
+	rows, err := db.Query(`SELECT id, sender, timestamp, raw FROM messages
+		WHERE chat = $1 AND raw IS NOT NULL AND type IN ('image', 'video', 'audio', 'document', 'sticker')
+		ORDER BY timestamp`, chat.String())
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %v", err)
+	}
+
+	type storedMedia struct {
+		info types.MessageInfo
+		raw  []byte
+	}
+	var items []storedMedia
+	for rows.Next() {
+		var item storedMedia
+		var sender string
+		if err := rows.Scan(&item.info.ID, &sender, &item.info.Timestamp, &item.raw); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read messages: %v", err)
+		}
+		item.info.Chat = chat
+		item.info.Sender, _ = types.ParseJID(sender)
+		items = append(items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read messages: %v", err)
+	}
+	job.update(func(j *backgroundJob) { j.Total = len(items) })
+
+	if err := os.MkdirAll(downloadDir, 0755); err != nil {
+		return fmt.Errorf("failed to create downloads directory: %v", err)
+	}
+
+	for _, item := range items {
+		fail := func(err error) {
+			log.Printf("Failed to download media of %s: %v", item.info.ID, err)
+			job.update(func(j *backgroundJob) {
+				j.Failed++
+				j.Errors = append(j.Errors, fmt.Sprintf("%s: %v", item.info.ID, err))
+			})
+		}
+
+		msg := &waProto.Message{}
+		if err := proto.Unmarshal(item.raw, msg); err != nil {
+			fail(fmt.Errorf("failed to decode stored message: %v", err))
+			continue
+		}
+		media, _ := messageMedia(msg)
+		if media == nil {
+			job.update(func(j *backgroundJob) { j.Skipped++ })
+			continue
+		}
+
+		filename := filepath.Join(downloadDir, downloadFilename(item.info, mediaFileExtension(msg)))
+		if _, err := os.Stat(filename); err == nil {
+			job.update(func(j *backgroundJob) { j.Skipped++ })
+			continue
+		}
+
+		data, err := client.Download(context.Background(), media)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		recordDownload(len(data))
+
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			fail(err)
+			continue
+		}
+		job.update(func(j *backgroundJob) { j.Downloaded++ })
+	}
+
+	job.update(func(j *backgroundJob) {
+		log.Printf("Media download job %s finished: %d downloaded, %d skipped, %d failed", j.ID, j.Downloaded, j.Skipped, j.Failed)
+	})
+	return nil
+}
+
+// /media/export endpoint - stream the saved media of a chat as a zip archive, optionally limited to a period
+func mediaExportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	var chatJID types.JID
+	var from, to time.Time
+	var err error
+	if query.Get("chat") == "" {
+		err = fmt.Errorf("chat is required")
+	} else {
+		chatJID, err = types.ParseJID(normalizeChatJID(query.Get("chat")))
+	}
+	if value := query.Get("from"); value != "" && err == nil {
+		from, err = parseStatsTime(value, false)
+	}
+	if value := query.Get("to"); value != "" && err == nil {
+		to, err = parseStatsTime(value, true)
+	}
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid parameters: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+
+	rows, err := db.Query(`SELECT id, sender, timestamp, raw FROM messages
+		WHERE chat = $1 AND timestamp >= $2 AND timestamp < $3 AND raw IS NOT NULL
+		AND type IN ('image', 'video', 'audio', 'document', 'sticker')
+		ORDER BY timestamp`, chatJID.String(), from, to)
+	if err != nil {
+		log.Printf("Failed to query media for export: %v", err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to query messages: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Only files already in the downloads folder are exported; nothing is downloaded here
+	type exportFile struct {
+		path     string
+		name     string
+		modified time.Time
+		store    bool
+	}
+	var files []exportFile
+	used := make(map[string]bool)
+	for rows.Next() {
+		var info types.MessageInfo
+		var sender string
+		var raw []byte
+		if err := rows.Scan(&info.ID, &sender, &info.Timestamp, &raw); err != nil {
+			log.Printf("Failed to read message for export: %v", err)
+			continue
+		}
+		info.Chat = chatJID
+		info.Sender, _ = types.ParseJID(sender)
+
+		msg := &waProto.Message{}
+		if err := proto.Unmarshal(raw, msg); err != nil {
+			continue
+		}
+		ext := mediaFileExtension(msg)
+		filePath := filepath.Join(downloadDir, downloadFilename(info, ext))
+		if _, err := os.Stat(filePath); err != nil {
+			continue
+		}
+
+		// Named by time and sender so the archive sorts chronologically; documents keep their own name
+		name := fmt.Sprintf("%s_%s_%s.%s", info.Timestamp.UTC().Format("20060102-150405"), info.Sender.User, info.ID, ext)
+		if original := filepath.Base(msg.GetDocumentMessage().GetFileName()); msg.DocumentMessage != nil && original != "." && original != "/" {
+			name = fmt.Sprintf("%s_%s_%s", info.Timestamp.UTC().Format("20060102-150405"), info.Sender.User, original)
+		}
+		if used[name] {
+			name = fmt.Sprintf("%s_%s", info.ID, name)
+		}
+		used[name] = true
+
+		files = append(files, exportFile{
+			path:     filePath,
+			name:     name,
+			modified: info.Timestamp,
+			store:    msg.DocumentMessage == nil, // images, video and audio are compressed already
+		})
+	}
+	rows.Close()
+
+	if len(files) == 0 {
+		response := APIResponse{
+			Success: false,
+			Message: "No saved media found for this chat and period",
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// The archive is written straight to the response, one file at a time
+	archiveName := fmt.Sprintf("media_%s_%s.zip", chatJID.User, time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": archiveName}))
+	log.Printf("Exporting %d media file(s) of %s", len(files), chatJID.String())
+
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		f, err := os.Open(file.path)
+		if err != nil {
+			log.Printf("Skipping %s in media export: %v", file.path, err)
+			continue
+		}
+		header := &zip.FileHeader{Name: file.name, Modified: file.modified, Method: zip.Deflate}
+		if file.store {
+			header.Method = zip.Store
+		}
+		entry, err := zw.CreateHeader(header)
+		if err == nil {
+			_, err = io.Copy(entry, f)
+		}
+		f.Close()
+		if err != nil {
+			log.Printf("Media export of %s aborted: %v", chatJID.String(), err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Failed to finish media export of %s: %v", chatJID.String(), err)
+	}
+}
+
+// MediaReindexEntry describes a stored media message whose link to its downloaded file was checked
+type MediaReindexEntry struct {
+	MessageID    string `json:"message_id"`
+	Chat         string `json:"chat"`
+	File         string `json:"file"`
+	Size         int64  `json:"size,omitempty"`
+	ExpectedSize uint64 `json:"expected_size,omitempty"`
+}
+
+// /media/reindex endpoint - match the stored media messages with the files in the downloads folder,
+// relinking found files, unlinking missing ones and reporting files no message refers to
+func mediaReindexHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// ?dry_run=true only reports what would change
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	files := make(map[string]int64)
+	entries, err := os.ReadDir(downloadDir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to read downloads directory: %v", err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to read downloads directory: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.Mode().IsRegular() {
+			files[entry.Name()] = info.Size()
+		}
+	}
+
+	rows, err := db.Query(`SELECT id, chat, sender, timestamp, attachment, raw FROM messages
+		WHERE raw IS NOT NULL AND type IN ('image', 'video', 'audio', 'document', 'sticker')`)
+	if err != nil {
+		log.Printf("Failed to query media for reindex: %v", err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to query messages: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	type attachmentUpdate struct {
+		id         string
+		chat       string
+		attachment map[string]interface{}
+	}
+	var updates []attachmentUpdate
+	linked := []MediaReindexEntry{}
+	missing := []MediaReindexEntry{}
+	incomplete := []MediaReindexEntry{}
+	claimed := make(map[string]bool)
+	scanned := 0
+	for rows.Next() {
+		var info types.MessageInfo
+		var chat, sender string
+		var attachmentJSON, raw []byte
+		if err := rows.Scan(&info.ID, &chat, &sender, &info.Timestamp, &attachmentJSON, &raw); err != nil {
+			log.Printf("Failed to read message for reindex: %v", err)
+			continue
+		}
+		msg := &waProto.Message{}
+		if err := proto.Unmarshal(raw, msg); err != nil {
+			continue
+		}
+		scanned++
+		info.Chat, _ = types.ParseJID(chat)
+		info.Sender, _ = types.ParseJID(sender)
+
+		name := downloadFilename(info, mediaFileExtension(msg))
+		claimed[name] = true
+		if msg.StickerMessage != nil {
+			claimed[downloadFilename(info, "png")] = true
+		}
+
+		attachment := map[string]interface{}{}
+		if len(attachmentJSON) > 0 {
+			json.Unmarshal(attachmentJSON, &attachment)
+		}
+		url, _ := attachment["url"].(string)
+		entry := MediaReindexEntry{MessageID: info.ID, Chat: chat, File: name}
+
+		size, exists := files[name]
+		var expected uint64
+		if media, _ := messageMedia(msg); media != nil {
+			if sized, ok := media.(interface{ GetFileLength() uint64 }); ok {
+				expected = sized.GetFileLength()
+			}
+		}
+		switch {
+		case exists && expected > 0 && uint64(size) < expected:
+			// Cut short by a crash while the file was written; the stored link stays
+			// so the file can be replaced after it's removed and downloaded again
+			entry.Size, entry.ExpectedSize = size, expected
+			incomplete = append(incomplete, entry)
+		case exists && url != mediaURL(msg, name):
+			attachment["url"] = mediaURL(msg, name)
+			delete(attachment, "download_skipped")
+			updates = append(updates, attachmentUpdate{id: info.ID, chat: chat, attachment: attachment})
+			linked = append(linked, entry)
+		case !exists && url != "":
+			delete(attachment, "url")
+			delete(attachment, "preview_url")
+			updates = append(updates, attachmentUpdate{id: info.ID, chat: chat, attachment: attachment})
+			missing = append(missing, entry)
+		}
+	}
+	rows.Close()
+
+	orphaned := []string{}
+	for name := range files {
+		if !claimed[name] {
+			orphaned = append(orphaned, name)
+		}
+	}
+	sort.Strings(orphaned)
+
+	if !dryRun {
+		for _, update := range updates {
+			attachmentJSON, err := json.Marshal(update.attachment)
+			if err == nil {
+				_, err = db.Exec("UPDATE messages SET attachment = $1 WHERE chat = $2 AND id = $3", attachmentJSON, update.chat, update.id)
+			}
+			if err != nil {
+				log.Printf("Failed to update media link of %s: %v", update.id, err)
+				response := APIResponse{
+					Success: false,
+					Message: fmt.Sprintf("Failed to update message %s: %v", update.id, err),
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(response)
+				return
+			}
+		}
+	}
+	log.Printf("Media reindex (dry run: %t): %d message(s), %d linked, %d missing, %d incomplete, %d orphaned file(s)",
+		dryRun, scanned, len(linked), len(missing), len(incomplete), len(orphaned))
+
+	response := APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Checked %d media message(s) against %d file(s)", scanned, len(files)),
+		Data: map[string]interface{}{
+			"dry_run":    dryRun,
+			"messages":   scanned,
+			"files":      len(files),
+			"linked":     linked,
+			"missing":    missing,
+			"incomplete": incomplete,
+			"orphaned":   orphaned,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// mediaFileExtension picks the file extension used when saving the media of msg.
+// Images and videos use the same extensions as the automatic downloads so those are recognized.
+func mediaFileExtension(msg *waProto.Message) string {
+	var mimetype string
+	switch {
+	case msg.ImageMessage != nil:
+		return "jpg"
+	case msg.VideoMessage != nil:
+		return "mp4"
+	case msg.StickerMessage != nil:
+		return "webp"
+	case msg.AudioMessage != nil:
+		mimetype = msg.AudioMessage.GetMimetype()
+		if strings.Contains(mimetype, "ogg") {
+			return "ogg"
+		}
+	case msg.DocumentMessage != nil:
+		if ext := filepath.Ext(msg.DocumentMessage.GetFileName()); ext != "" {
+			return strings.TrimPrefix(ext, ".")
+		}
+		mimetype = msg.DocumentMessage.GetMimetype()
+	}
+
+	if ext := mimeExtension(mimetype); ext != "" {
+		return ext
+	}
+	return "bin"
+}
+
+// preferredExtensions overrides the system mime table for common types, which can list
+// rarely used extensions first (e.g. .jfif for image/jpeg)
+var preferredExtensions = map[string]string{
+	"image/jpeg": "jpg",
+	"audio/mpeg": "mp3",
+	"audio/mp4":  "m4a",
+	"video/mp4":  "mp4",
+	"text/plain": "txt",
+}
+
+// mimeExtension returns the file extension (without dot) for a mimetype, or "" if unknown
+func mimeExtension(mimetype string) string {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(mimetype, ";")[0]))
+	if ext, ok := preferredExtensions[mediaType]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+		return strings.TrimPrefix(exts[0], ".")
+	}
+	return ""
+}
+
+// /jobs/{id} endpoint - report the progress of a background job
+func jobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	jobsMu.Lock()
+	job, ok := jobs[mux.Vars(r)["id"]]
+	jobsMu.Unlock()
+	if !ok {
+		response := APIResponse{
+			Success: false,
+			Message: "Job not found",
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Job status retrieved",
+		Data:    job.Snapshot(),
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// parseStatsTime reads a /stats bound given as RFC 3339 or a plain date (UTC). A plain date used as
+// the end of the period includes that whole day.
+func parseStatsTime(value string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a date (2006-01-02) or RFC 3339 time", value)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// /stats endpoint - message counts and media volume over a period, from the message store
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Defaults to the last 7 days
+	to := time.Now()
+	from := to.AddDate(0, 0, -7)
+	var err error
+	if value := r.URL.Query().Get("from"); value != "" {
+		from, err = parseStatsTime(value, false)
+	}
+	if value := r.URL.Query().Get("to"); value != "" && err == nil {
+		to, err = parseStatsTime(value, true)
+	}
+	groupBy := r.URL.Query().Get("group_by")
+	if err == nil && groupBy != "" && groupBy != "day" {
+		err = fmt.Errorf("group_by must be \"day\"")
+	}
+	if err == nil && !from.Before(to) {
+		err = fmt.Errorf("from must be before to")
+	}
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid parameters: %v", err),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	fail := func(err error) {
+		log.Printf("Failed to compute stats: %v", err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to compute stats: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+	}
+
+	// Per direction and type; file_length is only set on media messages
+	rows, err := db.Query(`SELECT from_me, type, COUNT(*), COALESCE(SUM((attachment->>'file_length')::BIGINT), 0)
+		FROM messages WHERE timestamp >= $1 AND timestamp < $2
+		GROUP BY from_me, type`, from, to)
+	if err != nil {
+		fail(err)
+		return
+	}
+	sentByType := map[string]int64{}
+	receivedByType := map[string]int64{}
+	var sent, received, mediaBytes int64
+	for rows.Next() {
+		var fromMe bool
+		var msgType string
+		var count, size int64
+		if err := rows.Scan(&fromMe, &msgType, &count, &size); err != nil {
+			rows.Close()
+			fail(err)
+			return
+		}
+		if fromMe {
+			sentByType[msgType] = count
+			sent += count
+		} else {
+			receivedByType[msgType] = count
+			received += count
+		}
+		mediaBytes += size
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		fail(err)
+		return
+	}
+
+	var uniqueChats int64
+	err = db.QueryRow("SELECT COUNT(DISTINCT chat) FROM messages WHERE timestamp >= $1 AND timestamp < $2", from, to).Scan(&uniqueChats)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	data := map[string]interface{}{
+		"from":         from,
+		"to":           to,
+		"sent":         map[string]interface{}{"total": sent, "by_type": sentByType},
+		"received":     map[string]interface{}{"total": received, "by_type": receivedByType},
+		"unique_chats": uniqueChats,
+		"media_bytes":  mediaBytes,
+	}
+
+	if groupBy == "day" {
+		rows, err := db.Query(`SELECT TO_CHAR(timestamp AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day,
+			COUNT(*) FILTER (WHERE from_me), COUNT(*) FILTER (WHERE NOT from_me),
+			COUNT(DISTINCT chat), COALESCE(SUM((attachment->>'file_length')::BIGINT), 0)
+			FROM messages WHERE timestamp >= $1 AND timestamp < $2
+			GROUP BY day ORDER BY day`, from, to)
+		if err != nil {
+			fail(err)
+			return
+		}
+		days := []map[string]interface{}{}
+		for rows.Next() {
+			var day string
+			var daySent, dayReceived, dayChats, dayBytes int64
+			if err := rows.Scan(&day, &daySent, &dayReceived, &dayChats, &dayBytes); err != nil {
+				rows.Close()
+				fail(err)
+				return
+			}
+			days = append(days, map[string]interface{}{
+				"date":         day,
+				"sent":         daySent,
+				"received":     dayReceived,
+				"unique_chats": dayChats,
+				"media_bytes":  dayBytes,
+			})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			fail(err)
+			return
+		}
+		data["days"] = days
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Stats retrieved",
+		Data:    data,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Image endpoint - serve downloaded images and other media (also mounted at /media/{filename})
+func imageHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	filename := vars["filename"]
+
+	if filename == "" {
 		http.Error(w, "Filename is required", http.StatusBadRequest)
 		return
 	}
 
-	// Security check: ensure filename doesn't contain path traversal
-	if strings.Contains(filename, "..") || strings.Contains(filename, "/") || strings.Contains(filename, "\\") {
-		http.Error(w, "Invalid filename", http.StatusBadRequest)
+	// Security check: ensure filename doesn't contain path traversal
+	if strings.Contains(filename, "..") || strings.Contains(filename, "/") || strings.Contains(filename, "\\") {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	// Construct file path
+	filePath := fmt.Sprintf("%s/%s", downloadDir, filename)
+
+	// Check if file exists
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// Determine content type
+	ext := strings.ToLower(filepath.Ext(filename))
+	var contentType string
+	switch ext {
+	case ".jpg", ".jpeg":
+		contentType = "image/jpeg"
+	case ".png":
+		contentType = "image/png"
+	case ".gif":
+		contentType = "image/gif"
+	case ".webp":
+		contentType = "image/webp"
+	case ".mp4":
+		contentType = "video/mp4"
+	case ".ogg", ".opus":
+		contentType = "audio/ogg"
+	case ".mp3":
+		contentType = "audio/mpeg"
+	case ".m4a":
+		contentType = "audio/mp4"
+	default:
+		// Document extensions come from the sender's filename, so only media is shown inline;
+		// anything else (e.g. .html or .svg) is a download, not a page on our origin
+		contentType = mime.TypeByExtension(ext)
+		if !strings.HasPrefix(contentType, "audio/") && !strings.HasPrefix(contentType, "video/") {
+			contentType = "application/octet-stream"
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+		}
+	}
+
+	// Set headers
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=3600") // Cache for 1 hour
+
+	// Serve file
+	http.ServeFile(w, r, filePath)
+}
+
+// Swagger documentation endpoint
+func swaggerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	swaggerInfo := map[string]interface{}{
+		"title":       "WhatsApp Web API",
+		"description": "REST API for WhatsApp Web integration",
+		"version":     "1.0.0",
+		"endpoints": map[string]string{
+			"pair":    "GET  /pair   - Generate QR code for pairing (?method=code&number=... for a pairing code)",
+			"send":    "POST /send   - Send message with attachments (requires pairing)",
+			"health":  "GET  /health - Check service status",
+			"images":  "GET  /images/{filename} - Serve downloaded images",
+			"swagger": "GET  /swagger - API documentation info",
+			"docs":    "GET  /swagger.yaml - Full OpenAPI specification",
+		},
+		"documentation": "Full API documentation available at /swagger.yaml",
+		"swagger_ui":    "Use Swagger UI with the yaml file: https://editor.swagger.io/",
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "WhatsApp Web API Documentation",
+		Data:    swaggerInfo,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func handler(rawEvt interface{}) {
+	switch evt := rawEvt.(type) {
+	case *events.Message:
+		handleMessage(evt)
+	case *events.Receipt:
+		handleReceipt(evt)
+	case *events.Star:
+		handleStar(evt)
+	case *events.UndecryptableMessage:
+		handleUndecryptable(evt)
+	case *events.ChatPresence:
+		handleChatPresence(evt)
+	case *events.Presence:
+		handleContactPresence(evt)
+	case *events.ClearChat:
+		handleChatRemoved("chat_cleared", evt.JID, evt.Action.GetMessageRange(), evt.FromFullSync)
+	case *events.DeleteChat:
+		handleChatRemoved("chat_deleted", evt.JID, evt.Action.GetMessageRange(), evt.FromFullSync)
+	case *events.GroupInfo:
+		handleGroupInfo(evt)
+	case *events.Picture:
+		handleGroupPicture(evt)
+	case *events.Connected:
+		log.Println("🟢 Connected to WhatsApp!")
+		if client.Store.ID != nil {
+			log.Printf("Device ID: %s", client.Store.ID.String())
+		}
+		// Catch up on contacts, mutes, pins etc. changed while we were offline
+		for _, name := range appstate.AllPatchNames {
+			go syncAppState(name, appStateResumeRetries(name))
+		}
+		go sendAccountPresence()
+		go resubscribeChatPresence()
+		go subscribeOwnNewsletters()
+		go checkLatestVersion()
+		clientVersionMu.Lock()
+		clientOutdatedAt = time.Time{}
+		clientVersionMu.Unlock()
+		if webhookURL != "" {
+			attachment := map[string]interface{}{"type": "connected", "jid": ""}
+			if client.Store.ID != nil {
+				attachment["jid"] = client.Store.ID.String()
+			}
+			sendToWebhook("connected", "Connected to WhatsApp", "", "", attachment)
+		}
+	case *events.ClientOutdated:
+		handleClientOutdated()
+	case *events.NewsletterLiveUpdate:
+		handleNewsletterLiveUpdate(evt)
+	case *events.OfflineSyncPreview:
+		handleOfflineSyncPreview(evt)
+	case *events.OfflineSyncCompleted:
+		handleOfflineSyncCompleted(evt)
+	case *events.PushNameSetting:
+		// Presence can't be sent before the push name is known, which on a fresh pairing only
+		// happens once the app state has synced
+		go sendAccountPresence()
+	case *events.AppStateSyncComplete:
+		recordAppStateSync(evt.Name, nil, 0)
+	case *events.Disconnected:
+		log.Println("🔴 Disconnected from WhatsApp")
+		isPaired = false
+		presenceMu.Lock()
+		presenceSentAt = time.Time{}
+		presenceMu.Unlock()
+		offlineSyncMu.Lock()
+		if offlineSync.State == "syncing" {
+			offlineSync.State = "interrupted"
+		}
+		offlineSyncMu.Unlock()
+		if webhookURL != "" {
+			sendToWebhook("disconnected", "Disconnected from WhatsApp", "", "", map[string]interface{}{"type": "disconnected"})
+		}
+	case *events.PairSuccess:
+		log.Printf("🎉 Successfully paired! Device: %s", evt.ID)
+		isPaired = true
+	case *events.LoggedOut:
+		log.Println("🔒 Logged out from WhatsApp")
+		log.Println("💡 This may happen if another device connects or if you log out from WhatsApp mobile app")
+		isPaired = false
+	case *events.StreamError:
+		log.Printf("🚫 Stream error occurred: %s", evt.Code)
+		log.Println("💡 This may indicate connection issues or device limit problems")
+		defaultCooldown.Observe(evt)
+	case *events.ConnectFailure:
+		log.Printf("❌ Connection failed: %v", evt.Reason)
+		log.Println("💡 Check your internet connection and WhatsApp device limits")
+		defaultCooldown.Observe(evt)
+	case *events.TemporaryBan:
+		log.Printf("⛔ %s", evt.String())
+		defaultCooldown.Observe(evt)
+	}
+}
+
+func logMessageDetails(evt *events.Message) {
+	// Log basic message information
+	log.Printf("=== MESSAGE RECEIVED ===")
+	log.Printf("Message ID: %s", evt.Info.ID)
+	log.Printf("From: %s", evt.Info.Sender.String())
+	log.Printf("Chat: %s", evt.Info.Chat.String())
+	log.Printf("Timestamp: %s", evt.Info.Timestamp)
+	log.Printf("Push Name: %s", evt.Info.PushName)
+	log.Printf("Is From Me: %t", evt.Info.IsFromMe)
+	log.Printf("Is Group: %t", evt.Info.Chat.Server == "g.us")
+
+	// Log message type information
+	if evt.Message != nil {
+		log.Printf("Message Type Analysis:")
+		if evt.Message.Conversation != nil && *evt.Message.Conversation != "" {
+			log.Printf("  - Text message: %s", *evt.Message.Conversation)
+		}
+		if evt.Message.ExtendedTextMessage != nil {
+			log.Printf("  - Extended text message")
+		}
+		if evt.Message.ImageMessage != nil {
+			log.Printf("  - Image message")
+		}
+		if evt.Message.DocumentMessage != nil {
+			log.Printf("  - Document message")
+		}
+		if evt.Message.AudioMessage != nil {
+			log.Printf("  - Audio message")
+		}
+		if evt.Message.VideoMessage != nil {
+			log.Printf("  - Video message")
+		}
+		if evt.Message.StickerMessage != nil {
+			log.Printf("  - Sticker message")
+		}
+		if evt.Message.ContactMessage != nil {
+			log.Printf("  - Contact message")
+		}
+		if evt.Message.ContactsArrayMessage != nil {
+			log.Printf("  - Contacts array message")
+		}
+		if evt.Message.LocationMessage != nil {
+			log.Printf("  - Location message")
+		}
+		if evt.Message.ReactionMessage != nil {
+			log.Printf("  - Reaction message")
+		}
+		if evt.Message.ButtonsResponseMessage != nil {
+			log.Printf("  - Button response message")
+		}
+		if evt.Message.ListResponseMessage != nil {
+			log.Printf("  - List response message")
+		}
+		if evt.Message.PollCreationMessage != nil {
+			log.Printf("  - Poll creation message")
+		}
+		if evt.Message.PollUpdateMessage != nil {
+			log.Printf("  - Poll update message")
+		}
+		if evt.Message.AlbumMessage != nil {
+			log.Printf("  - Album message")
+		}
+		if albumID := albumParentID(evt.Message); albumID != "" {
+			log.Printf("  - Part of album %s", albumID)
+		}
+	} else {
+		log.Printf("  - Message content is nil")
+	}
+
+	log.Printf("========================")
+}
+
+func handleMessage(evt *events.Message) {
+	countOfflineSyncMessage()
+
+	// Keeping a message matters whoever did it, including us on the phone
+	if keep := evt.Message.GetKeepInChatMessage(); keep != nil {
+		handleKeepInChat(evt, keep)
+		return
+	}
+
+	// Deletions count the same whether someone else or we (e.g. from the phone) deleted the message
+	if protocolMsg := evt.Message.GetProtocolMessage(); protocolMsg.GetType() == waProto.ProtocolMessage_REVOKE {
+		handleRevoke(evt, protocolMsg)
+		return
+	}
+
+	// Messages from ourselves are kept in the history when asked to, and reported only if sent outside the API
+	if evt.Info.IsFromMe {
+		content, attachment := outgoingMessageDetails(evt.Info.Chat, evt.Message)
+		if storeOutgoing.Load() {
+			err := storeMessage(evt, content, attachment)
+			if err != nil {
+				log.Printf("Failed to store outgoing message: %v", err)
+			}
+		}
+		handleSentMessage(evt, content, attachment)
+		return
+	}
+
+	// Album items may arrive wrapped as an associated child message
+	if child := evt.Message.GetAssociatedChildMessage().GetMessage(); child != nil {
+		if child.MessageContextInfo == nil {
+			child.MessageContextInfo = evt.Message.MessageContextInfo
+		}
+		evt.Message = child
+	}
+
+	// Skip messages WhatsApp delivered more than once (e.g. after a reconnect)
+	if messageDedup.Seen(evt.Info.Chat.String() + "/" + evt.Info.ID) {
+		log.Printf("Skipping duplicate message %s from %s", evt.Info.ID, evt.Info.Chat.String())
+		return
+	}
+
+	// A resent copy of a message that couldn't be decrypted before
+	if evt.RetryCount > 0 || evt.UnavailableRequestID != "" {
+		undecryptableRecovered.Add(1)
+		log.Printf("♻️ Message %s from %s recovered after a decryption failure", evt.Info.ID, evt.Info.Sender.String())
+	}
+
+	// Log comprehensive message information
+	logMessageDetails(evt)
+
+	// Typing notifications of a contact only arrive after subscribing to their presence
+	if !evt.Info.IsGroup {
+		go subscribeChatPresence(evt.Info.Chat)
+	}
+
+	// Remember the chat's disappearing timer so replies can honor it
+	trackChatTimer(evt)
+
+	// Spam filter rules decide whether the message is marked read and forwarded
+	dropWebhook, skipRead := false, false
+	for _, rule := range matchFilterRules(filterText(evt.Message)) {
+		log.Printf("🚫 Message %s from %s matched filter rule %d (%q)", evt.Info.ID, evt.Info.Sender.String(), rule.ID, rule.Pattern)
+		dropWebhook = dropWebhook || rule.DropWebhook
+		skipRead = skipRead || rule.SkipRead
+	}
+
+	// Mark message as read FIRST, unless consumers send read receipts themselves
+	var err error
+	if receipt, ok := receiptModes[chatReceiptMode(evt.Info.Chat)]; ok && !skipRead {
+		err = client.MarkRead(
+			[]types.MessageID{evt.Info.ID},
+			time.Now(),
+			evt.Info.Chat,
+			evt.Info.Sender,
+			receipt,
+		)
+		if err != nil {
+			log.Printf("Failed to mark message as read: %v", err)
+		} else {
+			log.Printf("Message marked as read successfully (%s)", receipt)
+		}
+	}
+
+	// Extract message content and handle automatic image download
+	event := "message"
+	var messageContent string
+	var attachmentInfo map[string]interface{}
+
+	if evt.Message != nil {
+		if evt.Message.ReactionMessage != nil {
+			// A reaction with an empty emoji means the sender removed their reaction
+			reactionMsg := evt.Message.ReactionMessage
+			emoji := reactionMsg.GetText()
+			removed := emoji == ""
+			event = "reaction"
+			if removed {
+				messageContent = "Reaction removed"
+			} else {
+				messageContent = fmt.Sprintf("Reaction received: %s", emoji)
+			}
+			attachmentInfo = map[string]interface{}{
+				"type":       "reaction",
+				"emoji":      emoji,
+				"removed":    removed,
+				"message_id": reactionMsg.GetKey().GetID(),
+			}
+		} else if evt.Message.AlbumMessage != nil {
+			// The album header announces how many items follow; they are forwarded together once received
+			albumMsg := evt.Message.AlbumMessage
+			expected := int(albumMsg.GetExpectedImageCount() + albumMsg.GetExpectedVideoCount())
+			messageContent = fmt.Sprintf("Album received (%d items)", expected)
+			attachmentInfo = map[string]interface{}{
+				"type":     "album",
+				"expected": expected,
+			}
+		} else if evt.Message.Conversation != nil && *evt.Message.Conversation != "" {
+			messageContent = *evt.Message.Conversation
+		} else if evt.Message.ExtendedTextMessage != nil && evt.Message.ExtendedTextMessage.Text != nil {
+			messageContent = *evt.Message.ExtendedTextMessage.Text
+		} else if evt.Message.ImageMessage != nil {
+			// Handle image message
+			imgMsg := evt.Message.ImageMessage
+			caption := ""
+			if imgMsg.Caption != nil {
+				caption = *imgMsg.Caption
+			}
+			messageContent = fmt.Sprintf("Image received%s", func() string {
+				if caption != "" {
+					return fmt.Sprintf(": %s", caption)
+				}
+				return ""
+			}())
+
+			// Store image info for webhook and logging
+			attachmentInfo = map[string]interface{}{
+				"type":        "image",
+				"caption":     caption,
+				"mimetype":    imgMsg.Mimetype,
+				"file_length": imgMsg.FileLength,
+				"width":       imgMsg.Width,
+				"height":      imgMsg.Height,
+			}
+
+			// Automatically download the image
+			if skip := autoDownloadSkip(evt.Info.ID, imgMsg.GetFileLength()); skip == "" {
+				filename := downloadFilename(evt.Info, "jpg")
+				queueDownload(evt.Info.ID, func() {
+					err := downloadAndSaveImage(evt.Info.ID, filename, imgMsg)
+					if err != nil {
+						log.Printf("Failed to download image: %v", err)
+					} else {
+						log.Printf("Image downloaded successfully")
+					}
+				})
+				attachmentInfo["url"] = mediaURL(evt.Message, filename)
+			} else {
+				attachmentInfo["download_skipped"] = skip
+			}
+		} else if evt.Message.DocumentMessage != nil {
+			docMsg := evt.Message.DocumentMessage
+			title := ""
+			if docMsg.Title != nil {
+				title = *docMsg.Title
+			}
+			messageContent = fmt.Sprintf("Document received: %s", title)
+			attachmentInfo = map[string]interface{}{
+				"type":        "document",
+				"title":       title,
+				"mimetype":    docMsg.Mimetype,
+				"file_length": docMsg.FileLength,
+				"page_count":  docMsg.PageCount,
+			}
+			autoDownloadMedia(evt, docMsg, docMsg.GetFileLength(), attachmentInfo)
+		} else if evt.Message.AudioMessage != nil {
+			audioMsg := evt.Message.AudioMessage
+			messageContent = "Audio message received"
+			attachmentInfo = map[string]interface{}{
+				"type":        "audio",
+				"mimetype":    audioMsg.Mimetype,
+				"file_length": audioMsg.FileLength,
+				"seconds":     audioMsg.Seconds,
+			}
+			autoDownloadMedia(evt, audioMsg, audioMsg.GetFileLength(), attachmentInfo)
+		} else if evt.Message.VideoMessage != nil {
+			vidMsg := evt.Message.VideoMessage
+			caption := ""
+			if vidMsg.Caption != nil {
+				caption = *vidMsg.Caption
+			}
+			messageContent = fmt.Sprintf("Video received%s", func() string {
+				if caption != "" {
+					return fmt.Sprintf(": %s", caption)
+				}
+				return ""
+			}())
+			attachmentInfo = map[string]interface{}{
+				"type":        "video",
+				"caption":     caption,
+				"mimetype":    vidMsg.Mimetype,
+				"file_length": vidMsg.FileLength,
+				"seconds":     vidMsg.Seconds,
+				"width":       vidMsg.Width,
+				"height":      vidMsg.Height,
+			}
+			autoDownloadMedia(evt, vidMsg, vidMsg.GetFileLength(), attachmentInfo)
+		} else if evt.Message.StickerMessage != nil {
+			stickerMsg := evt.Message.StickerMessage
+			messageContent = "Sticker received"
+			attachmentInfo = map[string]interface{}{
+				"type":        "sticker",
+				"mimetype":    stickerMsg.Mimetype,
+				"file_length": stickerMsg.FileLength,
+				"width":       stickerMsg.Width,
+				"height":      stickerMsg.Height,
+				"is_animated": stickerMsg.GetIsAnimated(),
+			}
+
+			// Stickers are downloaded as-is plus a PNG rendition most clients can preview
+			if skip := autoDownloadSkip(evt.Info.ID, stickerMsg.GetFileLength()); skip == "" {
+				filename := downloadFilename(evt.Info, "webp")
+				previewName := downloadFilename(evt.Info, "png")
+				queueDownload(evt.Info.ID, func() {
+					err := downloadAndSaveSticker(evt.Info.ID, filename, previewName, stickerMsg)
+					if err != nil {
+						log.Printf("Failed to download sticker: %v", err)
+					}
+				})
+				attachmentInfo["url"] = mediaURL(evt.Message, filename)
+				attachmentInfo["preview_url"] = mediaURL(evt.Message, previewName)
+			} else {
+				attachmentInfo["download_skipped"] = skip
+			}
+		} else if evt.Message.ContactMessage != nil {
+			contactMsg := evt.Message.ContactMessage
+			messageContent = fmt.Sprintf("Contact received: %s", contactMsg.GetDisplayName())
+			attachmentInfo = map[string]interface{}{
+				"type":         "contact",
+				"display_name": contactMsg.DisplayName,
+				"vcard":        contactMsg.Vcard,
+				"contact":      parseVCard(contactMsg.GetVcard()),
+			}
+		} else if evt.Message.ContactsArrayMessage != nil {
+			contactsMsg := evt.Message.ContactsArrayMessage
+			var contacts []VCardContact
+			var vcards []string
+			for _, c := range contactsMsg.GetContacts() {
+				contacts = append(contacts, parseVCard(c.GetVcard()))
+				vcards = append(vcards, c.GetVcard())
+			}
+			messageContent = fmt.Sprintf("Contacts received: %d contact(s)", len(contacts))
+			attachmentInfo = map[string]interface{}{
+				"type":         "contacts",
+				"display_name": contactsMsg.GetDisplayName(),
+				"vcards":       vcards,
+				"contacts":     contacts,
+			}
+		} else if evt.Message.LocationMessage != nil {
+			locMsg := evt.Message.LocationMessage
+			messageContent = fmt.Sprintf("Location received: %s", locMsg.GetName())
+			attachmentInfo = map[string]interface{}{
+				"type":      "location",
+				"name":      locMsg.Name,
+				"address":   locMsg.Address,
+				"latitude":  locMsg.DegreesLatitude,
+				"longitude": locMsg.DegreesLongitude,
+			}
+
+			// A location shared after /request-location answers that request
+			if requestID := takeLocationRequest(evt.Info.Chat); requestID != "" {
+				event = "location_response"
+				attachmentInfo["request_id"] = requestID
+				log.Printf("Location from %s answers request %s", evt.Info.Chat.String(), requestID)
+			}
+		} else if payment, content := paymentDetails(evt.Info.Chat, evt.Message); payment != nil {
+			event = "payment"
+			messageContent = content
+			attachmentInfo = payment
+			log.Printf("💰 Payment %s from %s (reference %s)", payment["status"], evt.Info.Sender.String(), payment["reference"])
+		} else {
+			messageContent = "Non-text message received"
+			attachmentInfo = map[string]interface{}{
+				"type": "unknown",
+			}
+		}
+	}
+
+	// Log the processed message content and attachment details
+	log.Printf("Processed message - Content: %s", messageContent)
+	if attachmentInfo != nil {
+		log.Printf("Attachment details: %+v", attachmentInfo)
+	}
+
+	// Persist the message so it can be queried later
+	err = storeMessage(evt, messageContent, attachmentInfo)
+	if err != nil {
+		log.Printf("Failed to store message: %v", err)
+	}
+
+	if dropWebhook {
+		log.Printf("Not forwarding filtered message %s to the webhook", evt.Info.ID)
+		return
+	}
+
+	// Album header and items are held back and forwarded as a single album event
+	if evt.Message.GetAlbumMessage() != nil {
+		expectAlbum(evt, attachmentInfo["expected"].(int))
+		return
+	}
+	if albumID := albumParentID(evt.Message); albumID != "" && attachmentInfo != nil {
+		addAlbumItem(evt, albumID, attachmentInfo)
+		return
+	}
+
+	// Send to webhook if configured
+	if webhookURL != "" {
+		isVerified, verifiedName := lookupVerifiedBusiness(evt)
+		postWebhook(WebhookPayload{
+			Event:              event,
+			Message:            messageContent,
+			Sender:             evt.Info.Sender.String(),
+			Chat:               evt.Info.Chat.String(),
+			Time:               time.Now(),
+			Attachment:         attachmentInfo,
+			IsVerifiedBusiness: &isVerified,
+			VerifiedName:       verifiedName,
+		})
+	}
+}
+
+func verifiedBusinessName(verifiedName *types.VerifiedName) string {
+	if verifiedName == nil {
+		return ""
+	}
+	return verifiedName.Details.GetVerifiedName()
+}
+
+type businessCacheEntry struct {
+	verifiedName string
+	checkedAt    time.Time
+	failed       bool // the lookup failed; retried after businessLookupRetry
+}
+
+// lookupVerifiedBusiness reports whether the sender of a message is a verified business and its verified name.
+// The name comes from the message itself when present, otherwise from a cached user info lookup.
+func lookupVerifiedBusiness(evt *events.Message) (bool, string) {
+	sender := evt.Info.Sender.ToNonAD()
+
+	if name := verifiedBusinessName(evt.Info.VerifiedName); name != "" {
+		businessCacheMu.Lock()
+		businessCache[sender] = businessCacheEntry{verifiedName: name, checkedAt: time.Now()}
+		businessCacheMu.Unlock()
+		return true, name
+	}
+
+	businessCacheMu.Lock()
+	entry, ok := businessCache[sender]
+	businessCacheMu.Unlock()
+	ttl := businessCacheTTL
+	if entry.failed {
+		ttl = businessLookupRetry
+	}
+	if ok && time.Since(entry.checkedAt) < ttl {
+		return entry.verifiedName != "", entry.verifiedName
+	}
+
+	// The lookup blocks event handling, so a failing one isn't repeated for every message of the sender
+	info, err := client.GetUserInfo([]types.JID{sender})
+	if err != nil {
+		log.Printf("Failed to look up business details for %s: %v", sender.String(), err)
+		businessCacheMu.Lock()
+		businessCache[sender] = businessCacheEntry{verifiedName: entry.verifiedName, checkedAt: time.Now(), failed: true}
+		businessCacheMu.Unlock()
+		return false, ""
+	}
+	name := verifiedBusinessName(info[sender].VerifiedName)
+
+	businessCacheMu.Lock()
+	businessCache[sender] = businessCacheEntry{verifiedName: name, checkedAt: time.Now()}
+	businessCacheMu.Unlock()
+	if name != "" {
+		log.Printf("Sender %s is verified business %q", sender.String(), name)
+	}
+	return name != "", name
+}
+
+// pendingAlbum collects the items of an incoming album until all of them have arrived
+type pendingAlbum struct {
+	chat     string
+	sender   string
+	expected int // 0 until the album header has been received
+	items    []map[string]interface{}
+	timer    *time.Timer
+}
+
+// albumParentID returns the ID of the album message this message belongs to, or "" if it isn't an album item
+func albumParentID(msg *waProto.Message) string {
+	association := msg.GetMessageContextInfo().GetMessageAssociation()
+	if association.GetAssociationType() != waE2E.MessageAssociation_MEDIA_ALBUM {
+		return ""
+	}
+	return association.GetParentMessageKey().GetID()
+}
+
+// getPendingAlbum returns the album being collected for key, starting a new one if needed.
+// Callers must hold pendingAlbumsMu.
+func getPendingAlbum(key string, evt *events.Message) *pendingAlbum {
+	album, ok := pendingAlbums[key]
+	if !ok {
+		album = &pendingAlbum{
+			chat:   evt.Info.Chat.String(),
+			sender: evt.Info.Sender.String(),
+		}
+		// Forward whatever arrived if the rest of the album never shows up
+		album.timer = time.AfterFunc(albumWaitTimeout, func() {
+			flushAlbum(key)
+		})
+		pendingAlbums[key] = album
+	}
+	return album
+}
+
+// expectAlbum records how many items an album announced
+func expectAlbum(evt *events.Message, expected int) {
+	key := evt.Info.Chat.String() + "/" + evt.Info.ID
+	pendingAlbumsMu.Lock()
+	album := getPendingAlbum(key, evt)
+	album.expected = expected
+	complete := len(album.items) >= expected
+	pendingAlbumsMu.Unlock()
+
+	log.Printf("Album %s announced with %d item(s)", evt.Info.ID, expected)
+	if complete {
+		flushAlbum(key)
+	}
+}
+
+// handleSentMessage reports a message we sent from the phone or another linked device.
+// Messages sent through the API echo back the same way and are skipped by their ID.
+func handleSentMessage(evt *events.Message, content string, attachment map[string]interface{}) {
+	if webhookURL == "" || evt.Message.GetProtocolMessage() != nil {
+		return
+	}
+	if sentMessages.Seen(evt.Info.ID) {
+		log.Printf("Skipping message_sent for %s: sent through the API", evt.Info.ID)
+		return
+	}
+	if attachment == nil {
+		attachment = map[string]interface{}{"type": "text"}
+	} else {
+		attachment = maps.Clone(attachment)
+	}
+	attachment["message_id"] = evt.Info.ID
+	sendToWebhook("message_sent", content, evt.Info.Sender.String(), evt.Info.Chat.String(), attachment)
+}
+
+// addAlbumItem adds a received media item to its album
+func addAlbumItem(evt *events.Message, albumID string, attachment map[string]interface{}) {
+	key := evt.Info.Chat.String() + "/" + albumID
+	attachment["message_id"] = evt.Info.ID
+	attachment["index"] = evt.Message.GetMessageContextInfo().GetMessageAssociation().GetMessageIndex()
+
+	pendingAlbumsMu.Lock()
+	album := getPendingAlbum(key, evt)
+	album.items = append(album.items, attachment)
+	complete := album.expected > 0 && len(album.items) >= album.expected
+	pendingAlbumsMu.Unlock()
+
+	log.Printf("Album %s: received item %s", albumID, evt.Info.ID)
+	if complete {
+		flushAlbum(key)
+	}
+}
+
+// flushAlbum forwards the collected album items as one album event
+func flushAlbum(key string) {
+	pendingAlbumsMu.Lock()
+	album, ok := pendingAlbums[key]
+	if ok {
+		delete(pendingAlbums, key)
+		album.timer.Stop()
+	}
+	pendingAlbumsMu.Unlock()
+	if !ok || len(album.items) == 0 {
+		return
+	}
+
+	sort.SliceStable(album.items, func(i, j int) bool {
+		return album.items[i]["index"].(int32) < album.items[j]["index"].(int32)
+	})
+
+	albumID := key[strings.LastIndex(key, "/")+1:]
+	log.Printf("Album %s complete: %d of %d item(s)", albumID, len(album.items), album.expected)
+
+	if webhookURL != "" {
+		attachment := map[string]interface{}{
+			"type":     "album",
+			"album_id": albumID,
+			"count":    len(album.items),
+			"expected": album.expected,
+			"items":    album.items,
+		}
+		sendToWebhook("album", fmt.Sprintf("Album received (%d items)", len(album.items)), album.sender, album.chat, attachment)
+	}
+}
+
+// messageContextInfo returns the ContextInfo of the message's content, or nil if it has none
+func messageContextInfo(msg *waProto.Message) *waProto.ContextInfo {
+	switch {
+	case msg.ExtendedTextMessage != nil:
+		return msg.ExtendedTextMessage.ContextInfo
+	case msg.ImageMessage != nil:
+		return msg.ImageMessage.ContextInfo
+	case msg.VideoMessage != nil:
+		return msg.VideoMessage.ContextInfo
+	case msg.AudioMessage != nil:
+		return msg.AudioMessage.ContextInfo
+	case msg.DocumentMessage != nil:
+		return msg.DocumentMessage.ContextInfo
+	case msg.StickerMessage != nil:
+		return msg.StickerMessage.ContextInfo
+	case msg.ContactMessage != nil:
+		return msg.ContactMessage.ContextInfo
+	case msg.ContactsArrayMessage != nil:
+		return msg.ContactsArrayMessage.ContextInfo
+	case msg.LocationMessage != nil:
+		return msg.LocationMessage.ContextInfo
+	}
+	return nil
+}
+
+// ensureContextInfo returns the outgoing message's ContextInfo, creating it if needed.
+// Plain Conversation messages can't carry context, so they are converted to ExtendedTextMessage.
+func ensureContextInfo(msg *waProto.Message) *waProto.ContextInfo {
+	if msg.Conversation != nil {
+		msg.ExtendedTextMessage = &waProto.ExtendedTextMessage{Text: msg.Conversation}
+		msg.Conversation = nil
+	}
+
+	if ctx := messageContextInfo(msg); ctx != nil {
+		return ctx
+	}
+
+	ctx := &waProto.ContextInfo{}
+	switch {
+	case msg.ExtendedTextMessage != nil:
+		msg.ExtendedTextMessage.ContextInfo = ctx
+	case msg.ImageMessage != nil:
+		msg.ImageMessage.ContextInfo = ctx
+	case msg.VideoMessage != nil:
+		msg.VideoMessage.ContextInfo = ctx
+	case msg.AudioMessage != nil:
+		msg.AudioMessage.ContextInfo = ctx
+	case msg.DocumentMessage != nil:
+		msg.DocumentMessage.ContextInfo = ctx
+	case msg.StickerMessage != nil:
+		msg.StickerMessage.ContextInfo = ctx
+	case msg.ContactMessage != nil:
+		msg.ContactMessage.ContextInfo = ctx
+	case msg.ContactsArrayMessage != nil:
+		msg.ContactsArrayMessage.ContextInfo = ctx
+	case msg.LocationMessage != nil:
+		msg.LocationMessage.ContextInfo = ctx
+	}
+	return ctx
+}
+
+// mediaReference is the part of a media message that points at the encrypted file on WhatsApp's servers
+type mediaReference interface {
+	whatsmeow.DownloadableMessage
+	GetURL() string
+	GetMediaKeyTimestamp() int64
+}
+
+// messageMedia returns the media reference of a media message and its upload type, or nil for non-media messages
+func messageMedia(msg *waProto.Message) (mediaReference, whatsmeow.MediaType) {
+	switch {
+	case msg.ImageMessage != nil:
+		return msg.ImageMessage, whatsmeow.MediaImage
+	case msg.VideoMessage != nil:
+		return msg.VideoMessage, whatsmeow.MediaVideo
+	case msg.AudioMessage != nil:
+		return msg.AudioMessage, whatsmeow.MediaAudio
+	case msg.DocumentMessage != nil:
+		return msg.DocumentMessage, whatsmeow.MediaDocument
+	case msg.StickerMessage != nil:
+		return msg.StickerMessage, whatsmeow.MediaImage
+	}
+	return nil, ""
+}
+
+// uploadDebugInfo describes the upload behind a media message for troubleshooting, or returns nil
+// for messages without media. The fields are copied from whatsmeow's UploadResponse when the
+// message is built, so they are what WhatsApp returned. The media key itself is never included.
+func uploadDebugInfo(msg *waProto.Message) map[string]interface{} {
+	media, mediaType := messageMedia(msg)
+	if media == nil {
+		return nil
+	}
+
+	info := map[string]interface{}{
+		"media_type":          mediaType,
+		"url":                 media.GetURL(),
+		"direct_path":         media.GetDirectPath(),
+		"media_key_present":   len(media.GetMediaKey()) > 0,
+		"media_key_length":    len(media.GetMediaKey()),
+		"media_key_timestamp": media.GetMediaKeyTimestamp(),
+		"file_sha256":         hex.EncodeToString(media.GetFileSHA256()),
+		"file_enc_sha256":     hex.EncodeToString(media.GetFileEncSHA256()),
+	}
+	if sized, ok := media.(interface{ GetFileLength() uint64 }); ok {
+		info["file_length"] = sized.GetFileLength()
+	}
+	return info
+}
+
+// mediaReferenceExpired reports whether the media URL of a message can no longer be used.
+// Media URLs carry their expiry as a hex unix timestamp in the "oe" query parameter.
+func mediaReferenceExpired(media mediaReference) bool {
+	if media.GetDirectPath() == "" || len(media.GetMediaKey()) == 0 {
+		return true
+	}
+
+	mediaURL, err := url.Parse(media.GetURL())
+	if err != nil {
+		return false
+	}
+	expiry, err := strconv.ParseInt(mediaURL.Query().Get("oe"), 16, 64)
+	if err != nil {
+		return false
+	}
+	return time.Now().Unix() >= expiry
+}
+
+// reuploadMedia downloads the media of msg and uploads it again, pointing msg at the fresh copy
+func reuploadMedia(msg *waProto.Message) error {
+	media, mediaType := messageMedia(msg)
+	if media == nil {
+		return nil
+	}
+
+	data, err := client.Download(context.Background(), media)
+	if err != nil {
+		return fmt.Errorf("failed to download media: %v", err)
+	}
+	recordDownload(len(data))
+
+	uploaded, err := client.Upload(context.Background(), data, mediaType)
+	if err != nil {
+		return fmt.Errorf("failed to upload media: %v", err)
+	}
+	recordUpload(len(data))
+
+	now := time.Now().Unix()
+	switch {
+	case msg.ImageMessage != nil:
+		m := msg.ImageMessage
+		m.URL, m.DirectPath, m.MediaKey, m.MediaKeyTimestamp = &uploaded.URL, &uploaded.DirectPath, uploaded.MediaKey, &now
+		m.FileEncSHA256, m.FileSHA256, m.FileLength = uploaded.FileEncSHA256, uploaded.FileSHA256, proto.Uint64(uploaded.FileLength)
+	case msg.VideoMessage != nil:
+		m := msg.VideoMessage
+		m.URL, m.DirectPath, m.MediaKey, m.MediaKeyTimestamp = &uploaded.URL, &uploaded.DirectPath, uploaded.MediaKey, &now
+		m.FileEncSHA256, m.FileSHA256, m.FileLength = uploaded.FileEncSHA256, uploaded.FileSHA256, proto.Uint64(uploaded.FileLength)
+	case msg.AudioMessage != nil:
+		m := msg.AudioMessage
+		m.URL, m.DirectPath, m.MediaKey, m.MediaKeyTimestamp = &uploaded.URL, &uploaded.DirectPath, uploaded.MediaKey, &now
+		m.FileEncSHA256, m.FileSHA256, m.FileLength = uploaded.FileEncSHA256, uploaded.FileSHA256, proto.Uint64(uploaded.FileLength)
+	case msg.DocumentMessage != nil:
+		m := msg.DocumentMessage
+		m.URL, m.DirectPath, m.MediaKey, m.MediaKeyTimestamp = &uploaded.URL, &uploaded.DirectPath, uploaded.MediaKey, &now
+		m.FileEncSHA256, m.FileSHA256, m.FileLength = uploaded.FileEncSHA256, uploaded.FileSHA256, proto.Uint64(uploaded.FileLength)
+	case msg.StickerMessage != nil:
+		m := msg.StickerMessage
+		m.URL, m.DirectPath, m.MediaKey, m.MediaKeyTimestamp = &uploaded.URL, &uploaded.DirectPath, uploaded.MediaKey, &now
+		m.FileEncSHA256, m.FileSHA256, m.FileLength = uploaded.FileEncSHA256, uploaded.FileSHA256, proto.Uint64(uploaded.FileLength)
+	}
+	return nil
+}
+
+// trackChatTimer records the disappearing timer of a chat from an incoming message
+func trackChatTimer(evt *events.Message) {
+	if evt.Message == nil {
+		return
+	}
+
+	var timer uint32
+	if protocolMsg := evt.Message.ProtocolMessage; protocolMsg != nil && protocolMsg.GetType() == waProto.ProtocolMessage_EPHEMERAL_SETTING {
+		timer = protocolMsg.GetEphemeralExpiration()
+	} else if ctx := messageContextInfo(evt.Message); ctx != nil {
+		timer = ctx.GetExpiration()
+	} else {
+		return
+	}
+
+	chat := evt.Info.Chat.String()
+	chatTimersMu.Lock()
+	defer chatTimersMu.Unlock()
+	if chatTimers[chat] != timer {
+		log.Printf("Disappearing timer for %s is now %d seconds", chat, timer)
+	}
+	if timer == 0 {
+		delete(chatTimers, chat)
+	} else {
+		chatTimers[chat] = timer
+	}
+}
+
+// applyChatTimer makes an outgoing message disappear according to the chat's timer, if one is known
+func applyChatTimer(msg *waProto.Message, chat types.JID) {
+	chatTimersMu.RLock()
+	timer := chatTimers[chat.String()]
+	chatTimersMu.RUnlock()
+
+	if timer > 0 {
+		ensureContextInfo(msg).Expiration = proto.Uint32(timer)
+	}
+}
+
+// getGroupInfo returns the group's metadata from the cache, fetching it from WhatsApp on a miss
+func getGroupInfo(jid types.JID) (*types.GroupInfo, error) {
+	groupCacheMu.RLock()
+	info, ok := groupCache[jid]
+	groupCacheMu.RUnlock()
+	if ok {
+		return info, nil
+	}
+
+	info, err := client.GetGroupInfo(jid)
+	if err != nil {
+		return nil, err
+	}
+
+	groupCacheMu.Lock()
+	groupCache[jid] = info
+	groupCacheMu.Unlock()
+	return info, nil
+}
+
+// sameParticipant reports whether jid refers to participant by either its phone number or LID
+func sameParticipant(participant types.GroupParticipant, jid types.JID) bool {
+	jid = jid.ToNonAD()
+	return participant.JID == jid || participant.PhoneNumber == jid || participant.LID == jid
+}
+
+// invalidateGroupCache drops a changed group from the cache, so the next lookup fetches it again.
+// Events only carry what changed (and participants in whichever JID form WhatsApp used), so
+// patching the cached copy could leave it subtly out of date.
+func invalidateGroupCache(jid types.JID) {
+	groupCacheMu.Lock()
+	delete(groupCache, jid)
+	groupCacheMu.Unlock()
+}
+
+func jidStrings(jids []types.JID) []string {
+	result := make([]string, len(jids))
+	for i, jid := range jids {
+		result[i] = jid.String()
+	}
+	return result
+}
+
+// receiptStatuses maps the receipt types we track to the status they represent
+var receiptStatuses = map[types.ReceiptType]string{
+	types.ReceiptTypeDelivered: "delivered",
+	types.ReceiptTypeRead:      "read",
+	types.ReceiptTypePlayed:    "played",
+}
+
+// handleReceipt records delivery, read and played receipts for messages we sent, per participant
+func handleReceipt(evt *events.Receipt) {
+	// Receipts from our own other devices say nothing about the recipients
+	if evt.IsFromMe {
+		return
+	}
+	status, ok := receiptStatuses[evt.Type]
+	if !ok {
+		return
+	}
+
+	participant := evt.Sender.ToNonAD().String()
+	for _, id := range evt.MessageIDs {
+		_, err := db.Exec(`INSERT INTO message_receipts (message_id, chat, participant, type, timestamp)
+			VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING`,
+			id, evt.Chat.String(), participant, status, evt.Timestamp)
+		if err != nil {
+			log.Printf("Failed to store %s receipt for %s: %v", status, id, err)
+		}
+	}
+	log.Printf("Receipt: %d message(s) %s by %s in %s", len(evt.MessageIDs), status, participant, evt.Chat.String())
+
+	if webhookURL != "" {
+		attachment := map[string]interface{}{
+			"type":        "receipt",
+			"status":      status,
+			"message_ids": evt.MessageIDs,
+		}
+		sendToWebhook("receipt", fmt.Sprintf("%d message(s) %s", len(evt.MessageIDs), status), participant, evt.Chat.String(), attachment)
+	}
+}
+
+// handleStar forwards messages starred or unstarred on the phone to the webhook
+func handleStar(evt *events.Star) {
+	starred := evt.Action.GetStarred()
+	log.Printf("Message %s in %s starred: %t", evt.MessageID, evt.ChatJID.String(), starred)
+
+	// A full app state sync replays every starred message, which is not a change
+	if evt.FromFullSync || webhookURL == "" {
+		return
+	}
+
+	sender := evt.SenderJID.String()
+	if evt.SenderJID.IsEmpty() {
+		sender = ""
+	}
+	attachment := map[string]interface{}{
+		"type":       "star",
+		"message_id": evt.MessageID,
+		"starred":    starred,
+		"from_me":    evt.IsFromMe,
+	}
+	message := "Message starred"
+	if !starred {
+		message = "Message unstarred"
+	}
+	sendToWebhook("message_starred", message, sender, evt.ChatJID.String(), attachment)
+}
+
+// sendCooldown pauses one account's sending and reconnecting for a while after WhatsApp signalled
+// a temporary ban or rate limiting, so retries don't make it worse. Each account has its own, so a
+// ban on one number doesn't stop the others.
+type sendCooldown struct {
+	mu      sync.Mutex
+	account string
+	client  func() *whatsmeow.Client // reconnected once the cool-down ends
+	until   time.Time
+	reason  string
+	timer   *time.Timer
+}
+
+// Start pauses the account for duration, unless a longer cool-down is already running
+func (c *sendCooldown) Start(reason string, duration time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	until := time.Now().Add(duration)
+	if until.Before(c.until) {
+		return
+	}
+	c.until = until
+	c.reason = reason
+	log.Printf("⏸️ Cool-down (%s) of account %s until %s, sends and reconnects are paused", reason, c.account, until.Format(time.RFC3339))
+
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.timer = time.AfterFunc(duration, c.end)
+}
+
+// Observe starts a cool-down when evt is WhatsApp signalling rate limiting or a temporary ban
+func (c *sendCooldown) Observe(evt interface{}) {
+	switch evt := evt.(type) {
+	case *events.StreamError:
+		if evt.Code == "429" {
+			c.Start("rate_limited", rateLimitCooldown)
+		}
+	case *events.ConnectFailure:
+		if evt.Reason == 429 {
+			c.Start("rate_limited", rateLimitCooldown)
+		}
+	case *events.TemporaryBan:
+		duration := evt.Expire
+		if duration <= 0 {
+			duration = defaultBanCooldown
+		}
+		c.Start("temporary_ban", duration)
+	}
+}
+
+// end lifts the cool-down and reconnects if the connection was dropped in the meantime
+func (c *sendCooldown) end() {
+	c.mu.Lock()
+	reason := c.reason
+	c.until = time.Time{}
+	c.reason = ""
+	c.timer = nil
+	c.mu.Unlock()
+	log.Printf("▶️ Cool-down (%s) of account %s over", reason, c.account)
+
+	if cli := c.client(); cli != nil && cli.Store.ID != nil && !cli.IsConnected() {
+		if err := cli.Connect(); err != nil {
+			log.Printf("Failed to reconnect account %s after cool-down: %v", c.account, err)
+		}
+	}
+}
+
+// Status reports whether a cool-down is active, why and until when
+func (c *sendCooldown) Status() (time.Time, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.until, c.reason, time.Now().Before(c.until)
+}
+
+// AllowReconnect is an AutoReconnectHook that holds off reconnecting during a cool-down
+func (c *sendCooldown) AllowReconnect(err error) bool {
+	if until, reason, active := c.Status(); active {
+		log.Printf("Not reconnecting account %s during %s cool-down (until %s)", c.account, reason, until.Format(time.RFC3339))
+		return false
+	}
+	return true
+}
+
+// requiresAPIKey reports whether a request needs the API key. Reads expose messages, media and account
+// data too, so everything needs it except /health for liveness probes, the API docs and CORS preflights.
+// Only the spec itself is open under /swagger/, which serves the working directory (including .env).
+func requiresAPIKey(r *http.Request) bool {
+	if r.Method == http.MethodOptions {
+		return false
+	}
+	switch r.URL.Path {
+	case "/health", "/swagger", "/swagger/swagger.yaml":
+		return false
+	}
+	return true
+}
+
+// apiKeyMiddleware answers 401 unless the request carries API_KEY as a Bearer token or X-API-Key
+// header. Without API_KEY every request is let through.
+func apiKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiKey == "" || !requiresAPIKey(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := r.Header.Get("X-API-Key")
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			key = strings.TrimSpace(bearer)
+		}
+		if key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		log.Printf("🔒 Rejected %s %s from %s: missing or wrong API key", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="whatsapp-web-api"`)
+		response := APIResponse{
+			Success: false,
+			Message: "Missing or invalid API key. Send it as Authorization: Bearer <key> or X-API-Key: <key>",
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+// refuseDuringCooldown wraps a sending endpoint of the default account so it answers 503 while
+// its cool-down is active
+func refuseDuringCooldown(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !writeCooldown(w, defaultCooldown) {
+			next(w, r)
+		}
+	}
+}
+
+// writeCooldown answers 503 and returns true while the account's cool-down is active
+func writeCooldown(w http.ResponseWriter, cooldown *sendCooldown) bool {
+	until, reason, active := cooldown.Status()
+	if !active {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+	response := APIResponse{
+		Success: false,
+		Message: fmt.Sprintf("Paused until %s because WhatsApp signalled %s", until.Format(time.RFC3339), strings.ReplaceAll(reason, "_", " ")),
+		Data: map[string]interface{}{
+			"reason": reason,
+			"until":  until,
+		},
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(response)
+	return true
+}
+
+// sendAccountPresence announces the configured presence. While available WhatsApp treats this
+// device like an open app: contacts' presence and typing updates are pushed to it and receipts are
+// sent as active. While unavailable the phone keeps getting notifications as usual.
+func sendAccountPresence() error {
+	if client == nil || !client.IsConnected() {
+		return fmt.Errorf("not connected to WhatsApp")
+	}
+
+	presenceMu.Lock()
+	presence := accountPresence
+	presenceMu.Unlock()
+
+	err := client.SendPresence(presence)
+
+	presenceMu.Lock()
+	defer presenceMu.Unlock()
+	if err != nil {
+		presenceError = err.Error()
+		if errors.Is(err, whatsmeow.ErrNoPushName) {
+			log.Printf("Presence not sent yet, waiting for the push name to sync")
+		} else {
+			log.Printf("❌ Failed to send presence %s: %v", presence, err)
+		}
+		return err
+	}
+	presenceError = ""
+	presenceSentAt = time.Now()
+	log.Printf("📡 Presence sent: %s", presence)
+	return nil
+}
+
+// presenceStatus reports the configured presence and whether it has been announced since connecting
+func presenceStatus() map[string]interface{} {
+	presenceMu.Lock()
+	defer presenceMu.Unlock()
+
+	status := map[string]interface{}{
+		"presence": accountPresence,
+	}
+	if !presenceSentAt.IsZero() {
+		status["sent_at"] = presenceSentAt
+	}
+	if presenceError != "" {
+		status["error"] = presenceError
+	}
+	return status
+}
+
+// appStateSyncState is the outcome of the last sync of one app state patch type
+type appStateSyncState struct {
+	Status      string // synced, waiting_for_keys or failed
+	Error       string
+	Retries     int
+	LastAttempt time.Time
+	LastSuccess time.Time
+	retry       *time.Timer
+	resume      bool // a retry came due while disconnected and continues on the next connect
+}
+
+// syncAppState fetches the latest app state patches of one type. After a long time offline the
+// patches can be encrypted with keys this device doesn't have yet; whatsmeow then asks the phone to
+// share them, and the sync is retried until they arrive. A corrupted local state is rebuilt with a
+// full sync.
+func syncAppState(name appstate.WAPatchName, retries int) {
+	if client == nil || !client.IsConnected() {
+		// Keep a pending retry for the next connect rather than dropping it
+		appStateSyncMu.Lock()
+		if state, ok := appStateSync[name]; ok && state.Status != "synced" {
+			state.retry = nil
+			state.resume = true
+			log.Printf("App state %s retry postponed until WhatsApp is connected again", name)
+		}
+		appStateSyncMu.Unlock()
+		return
+	}
+
+	err := client.FetchAppState(context.Background(), name, false, false)
+	if errors.Is(err, appstate.ErrMismatchingLTHash) || errors.Is(err, appstate.ErrMismatchingPatchMAC) ||
+		errors.Is(err, appstate.ErrMismatchingContentMAC) || errors.Is(err, appstate.ErrMismatchingIndexMAC) {
+		log.Printf("App state %s doesn't match the server (%v), doing a full resync", name, err)
+		err = client.FetchAppState(context.Background(), name, true, false)
+	}
+	recordAppStateSync(name, err, retries)
+}
+
+// recordAppStateSync stores the result of a sync attempt and schedules a retry when it failed
+func recordAppStateSync(name appstate.WAPatchName, err error, retries int) {
+	appStateSyncMu.Lock()
+	defer appStateSyncMu.Unlock()
+
+	state, ok := appStateSync[name]
+	if !ok {
+		state = &appStateSyncState{}
+		appStateSync[name] = state
+	}
+	if state.retry != nil {
+		state.retry.Stop()
+		state.retry = nil
+	}
+
+	now := time.Now()
+	state.LastAttempt = now
+	state.Retries = retries
+	if err == nil {
+		if state.Status != "" && state.Status != "synced" {
+			log.Printf("✅ App state %s recovered after %d retries", name, retries)
+		}
+		state.Status = "synced"
+		state.Error = ""
+		state.LastSuccess = now
+		return
+	}
+
+	state.Status = "failed"
+	if errors.Is(err, appstate.ErrKeyNotFound) {
+		state.Status = "waiting_for_keys"
+	}
+	state.Error = err.Error()
+
+	if retries >= appStateMaxRetries {
+		log.Printf("❌ App state %s sync failed, giving up after %d retries: %v", name, retries, err)
+		return
+	}
+	log.Printf("⚠️ App state %s sync failed (%s), retrying in %s: %v", name, state.Status, appStateRetryDelay, err)
+	state.retry = time.AfterFunc(appStateRetryDelay, func() {
+		syncAppState(name, retries+1)
+	})
+}
+
+// appStateResumeRetries returns the retry count the sync on connect starts with: a retry postponed
+// while disconnected carries on where it left off, so a flapping connection can't retry forever
+func appStateResumeRetries(name appstate.WAPatchName) int {
+	appStateSyncMu.Lock()
+	defer appStateSyncMu.Unlock()
+
+	state, ok := appStateSync[name]
+	if !ok || !state.resume {
+		return 0
+	}
+	state.resume = false
+	return state.Retries + 1
+}
+
+// appStateSyncStatus reports the last sync of every app state patch type
+func appStateSyncStatus() map[string]interface{} {
+	appStateSyncMu.Lock()
+	defer appStateSyncMu.Unlock()
+
+	status := make(map[string]interface{}, len(appStateSync))
+	for name, state := range appStateSync {
+		entry := map[string]interface{}{
+			"status":       state.Status,
+			"retries":      state.Retries,
+			"last_attempt": state.LastAttempt,
+		}
+		if !state.LastSuccess.IsZero() {
+			entry["last_success"] = state.LastSuccess
+		}
+		if state.Error != "" {
+			entry["error"] = state.Error
+		}
+		if state.resume {
+			entry["waiting_for_connection"] = true
+		}
+		status[string(name)] = entry
+	}
+	return status
+}
+
+// handleKeepInChat records a disappearing message being kept (or un-kept) and forwards it
+func handleKeepInChat(evt *events.Message, keep *waProto.KeepInChatMessage) {
+	messageID := keep.GetKey().GetID()
+	kept := keep.GetKeepType() == waProto.KeepType_KEEP_FOR_ALL
+	log.Printf("Message %s in %s kept: %t (by %s)", messageID, evt.Info.Chat.String(), kept, evt.Info.Sender.String())
+
+	stored := false
+	result, err := db.Exec("UPDATE messages SET kept = $1 WHERE chat = $2 AND id = $3", kept, evt.Info.Chat.String(), messageID)
+	if err != nil {
+		log.Printf("Failed to update kept state of %s: %v", messageID, err)
+	} else if n, _ := result.RowsAffected(); n > 0 {
+		stored = true
+	}
+
+	if webhookURL == "" {
+		return
+	}
+	attachment := map[string]interface{}{
+		"type":       "message_kept",
+		"message_id": messageID,
+		"kept":       kept,
+		"from_me":    evt.Info.IsFromMe,
+		"stored":     stored,
+	}
+	message := "Message kept in chat"
+	if !kept {
+		message = "Message no longer kept in chat"
+	}
+	sendToWebhook("message_kept", message, evt.Info.Sender.String(), evt.Info.Chat.String(), attachment)
+}
+
+// handleRevoke records a message being deleted for everyone and forwards it
+func handleRevoke(evt *events.Message, protocolMsg *waProto.ProtocolMessage) {
+	key := protocolMsg.GetKey()
+	messageID := key.GetID()
+	log.Printf("🗑️ Message %s in %s deleted by %s (from me: %t)", messageID, evt.Info.Chat.String(), evt.Info.Sender.String(), evt.Info.IsFromMe)
+
+	stored := false
+	result, err := db.Exec("UPDATE messages SET deleted_at = $1 WHERE chat = $2 AND id = $3 AND deleted_at IS NULL",
+		evt.Info.Timestamp, evt.Info.Chat.String(), messageID)
+	if err != nil {
+		log.Printf("Failed to mark %s as deleted: %v", messageID, err)
+	} else if n, _ := result.RowsAffected(); n > 0 {
+		stored = true
+	}
+
+	if webhookURL == "" {
+		return
+	}
+	attachment := map[string]interface{}{
+		"type":       "message_deleted",
+		"message_id": messageID,
+		"from_me":    evt.Info.IsFromMe,
+		"stored":     stored,
+	}
+	// In groups an admin can delete someone else's message; the key names the original sender
+	if participant := key.GetParticipant(); participant != "" && participant != evt.Info.Sender.String() {
+		attachment["original_sender"] = participant
+	}
+	sendToWebhook("message_deleted", "Message deleted", evt.Info.Sender.String(), evt.Info.Chat.String(), attachment)
+}
+
+// expireMessages marks stored disappearing messages whose timer ran out and that nobody kept as expired.
+// WhatsApp doesn't announce expiry, so this is checked periodically from the stored expiry time.
+func expireMessages() {
+	for range time.Tick(time.Minute) {
+		rows, err := db.Query(`UPDATE messages SET expired = TRUE
+			WHERE expires_at <= NOW() AND NOT kept AND NOT expired AND deleted_at IS NULL
+			RETURNING id, chat, sender, expires_at`)
+		if err != nil {
+			log.Printf("Failed to expire messages: %v", err)
+			continue
+		}
+
+		type expiredMessage struct {
+			id, chat, sender string
+			expiresAt        time.Time
+		}
+		var expired []expiredMessage
+		for rows.Next() {
+			var msg expiredMessage
+			if err := rows.Scan(&msg.id, &msg.chat, &msg.sender, &msg.expiresAt); err != nil {
+				log.Printf("Failed to read expired message: %v", err)
+				continue
+			}
+			expired = append(expired, msg)
+		}
+		rows.Close()
+
+		if len(expired) == 0 {
+			continue
+		}
+		log.Printf("%d disappearing message(s) expired", len(expired))
+		if webhookURL == "" {
+			continue
+		}
+		for _, msg := range expired {
+			attachment := map[string]interface{}{
+				"type":       "message_expired",
+				"message_id": msg.id,
+				"expired_at": msg.expiresAt,
+			}
+			sendToWebhook("message_expired", "Disappearing message expired", msg.sender, msg.chat, attachment)
+		}
+	}
+}
+
+// handleChatPresence forwards a contact starting or stopping to type or record a voice message
+func handleChatPresence(evt *events.ChatPresence) {
+	if evt.IsFromMe || webhookURL == "" {
+		return
+	}
+
+	state := string(evt.State)
+	if evt.State == types.ChatPresenceComposing && evt.Media == types.ChatPresenceMediaAudio {
+		state = "recording"
+	}
+	attachment := map[string]interface{}{
+		"type":     "chat_presence",
+		"state":    state,
+		"is_group": evt.IsGroup,
+	}
+	sendToWebhook("chat_presence", "Chat presence: "+state, evt.Sender.String(), evt.Chat.String(), attachment)
+}
+
+// handleContactPresence remembers a contact's online state and last seen time
+func handleContactPresence(evt *events.Presence) {
+	jid := evt.From.ToNonAD()
+
+	contactPresencesMu.Lock()
+	contactPresences[jid] = contactPresence{
+		Online:   !evt.Unavailable,
+		LastSeen: evt.LastSeen,
+	}
+	waiters := contactPresenceWaiters[jid]
+	delete(contactPresenceWaiters, jid)
+	contactPresencesMu.Unlock()
+
+	for _, waiter := range waiters {
+		close(waiter)
+	}
+}
+
+// waitForContactPresence returns the known presence of a contact, waiting up to timeout for the
+// first update after subscribing. ok is false if none arrived, e.g. because of privacy settings.
+func waitForContactPresence(jid types.JID, timeout time.Duration) (presence contactPresence, ok bool) {
+	contactPresencesMu.Lock()
+	if presence, ok = contactPresences[jid]; ok {
+		contactPresencesMu.Unlock()
+		return presence, true
+	}
+	waiter := make(chan struct{})
+	contactPresenceWaiters[jid] = append(contactPresenceWaiters[jid], waiter)
+	contactPresencesMu.Unlock()
+
+	select {
+	case <-waiter:
+	case <-time.After(timeout):
+	}
+
+	contactPresencesMu.Lock()
+	defer contactPresencesMu.Unlock()
+	presence, ok = contactPresences[jid]
+	return presence, ok
+}
+
+// subscribeChatPresence asks WhatsApp to send us the presence of a contact, which includes
+// their typing notifications. It only works while our own presence is available, and the
+// contact's privacy settings can still withhold it.
+func subscribeChatPresence(jid types.JID) {
+	presenceSubscriptionsMu.Lock()
+	subscribed := presenceSubscriptions[jid]
+	presenceSubscriptions[jid] = true
+	presenceSubscriptionsMu.Unlock()
+	if subscribed {
+		return
+	}
+
+	if err := client.SubscribePresence(jid); err != nil {
+		log.Printf("Failed to subscribe to presence of %s: %v", jid.String(), err)
+		presenceSubscriptionsMu.Lock()
+		delete(presenceSubscriptions, jid)
+		presenceSubscriptionsMu.Unlock()
+	}
+}
+
+// resubscribeChatPresence renews the presence subscriptions, which the server forgets on disconnect
+func resubscribeChatPresence() {
+	presenceSubscriptionsMu.Lock()
+	jids := make([]types.JID, 0, len(presenceSubscriptions))
+	for jid := range presenceSubscriptions {
+		jids = append(jids, jid)
+	}
+	presenceSubscriptionsMu.Unlock()
+
+	for _, jid := range jids {
+		if err := client.SubscribePresence(jid); err != nil {
+			log.Printf("Failed to renew presence subscription of %s: %v", jid.String(), err)
+		}
+	}
+	if len(jids) > 0 {
+		log.Printf("Renewed %d presence subscription(s)", len(jids))
+	}
+}
+
+// handleNewsletterLiveUpdate stores and forwards the view and reaction counts of channel posts
+func handleNewsletterLiveUpdate(evt *events.NewsletterLiveUpdate) {
+	for _, post := range storeNewsletterMetrics(evt.JID, evt.Messages, evt.Time) {
+		if webhookURL == "" {
+			continue
+		}
+		attachment := map[string]interface{}{
+			"type":       "newsletter_metrics",
+			"server_id":  post.ServerID,
+			"message_id": post.MessageID,
+			"views":      post.Views,
+			"reactions":  post.Reactions,
+		}
+		sendToWebhook("newsletter_metrics", fmt.Sprintf("Channel post metrics: %d views", post.Views), "", evt.JID.String(), attachment)
+	}
+}
+
+// storeNewsletterMetrics merges updated counts into the stored metrics and returns the posts that changed
+func storeNewsletterMetrics(jid types.JID, messages []*types.NewsletterMessage, at time.Time) []NewsletterPostMetrics {
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	newsletterMetricsMu.Lock()
+	defer newsletterMetricsMu.Unlock()
+	posts := newsletterMetrics[jid]
+	if posts == nil {
+		posts = make(map[types.MessageServerID]*NewsletterPostMetrics)
+		newsletterMetrics[jid] = posts
+	}
+
+	var changed []NewsletterPostMetrics
+	for _, msg := range messages {
+		post := posts[msg.MessageServerID]
+		if post == nil {
+			post = &NewsletterPostMetrics{ServerID: msg.MessageServerID, Reactions: map[string]int{}}
+			posts[msg.MessageServerID] = post
+		}
+		if msg.MessageID != "" {
+			post.MessageID = msg.MessageID
+		}
+		// An update only carries the counts that changed
+		if msg.ViewsCount > 0 {
+			post.Views = msg.ViewsCount
+		}
+		if msg.ReactionCounts != nil {
+			post.Reactions = msg.ReactionCounts
+		}
+		post.UpdatedAt = at
+		changed = append(changed, *post)
+	}
+	return changed
+}
+
+// subscribeNewsletterUpdates asks WhatsApp for live view and reaction counts of a channel. The
+// subscription only lasts a few minutes, so it's renewed shortly before it runs out.
+func subscribeNewsletterUpdates(jid types.JID) error {
+	duration, err := client.NewsletterSubscribeLiveUpdates(context.Background(), jid)
+	if err != nil {
+		return err
+	}
+	renewIn := duration - 30*time.Second
+	if renewIn < 30*time.Second {
+		renewIn = 30 * time.Second
+	}
+
+	newsletterSubscriptionsMu.Lock()
+	defer newsletterSubscriptionsMu.Unlock()
+	if timer := newsletterSubscriptions[jid]; timer != nil {
+		timer.Stop()
+	}
+	newsletterSubscriptions[jid] = time.AfterFunc(renewIn, func() {
+		if client == nil || !client.IsConnected() {
+			// Renewed by subscribeOwnNewsletters after the next connect
+			return
+		}
+		if err := subscribeNewsletterUpdates(jid); err != nil {
+			log.Printf("Failed to renew live updates of channel %s: %v", jid.String(), err)
+		}
+	})
+	return nil
+}
+
+// subscribeOwnNewsletters subscribes to the live updates of every channel we own or administer,
+// plus any other channel whose metrics were requested through the API
+func subscribeOwnNewsletters() {
+	jids := make(map[types.JID]bool)
+	newsletterSubscriptionsMu.Lock()
+	for jid := range newsletterSubscriptions {
+		jids[jid] = true
+	}
+	newsletterSubscriptionsMu.Unlock()
+
+	newsletters, err := client.GetSubscribedNewsletters()
+	if err != nil {
+		log.Printf("Failed to list subscribed channels: %v", err)
+	}
+	for _, newsletter := range newsletters {
+		if newsletter.ViewerMeta == nil {
+			continue
+		}
+		if role := newsletter.ViewerMeta.Role; role == types.NewsletterRoleOwner || role == types.NewsletterRoleAdmin {
+			jids[newsletter.ID] = true
+		}
+	}
+
+	for jid := range jids {
+		if err := subscribeNewsletterUpdates(jid); err != nil {
+			log.Printf("Failed to subscribe to live updates of channel %s: %v", jid.String(), err)
+		}
+	}
+	if len(jids) > 0 {
+		log.Printf("Subscribed to live updates of %d channel(s)", len(jids))
+	}
+}
+
+// /newsletter/{jid}/metrics endpoint - latest view and reaction counts of a channel's posts
+func newsletterMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if paired
+	if !isPaired || !client.IsConnected() {
+		response := APIResponse{
+			Success: false,
+			Message: "Not paired with WhatsApp. Please use /pair endpoint first",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	jid, err := types.ParseJID(mux.Vars(r)["jid"])
+	if err != nil || jid.Server != types.NewsletterServer {
+		response := APIResponse{
+			Success: false,
+			Message: "Invalid newsletter JID",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
 		return
 	}
 
-	// Construct file path
-	filePath := fmt.Sprintf("downloads/%s", filename)
+	// Refresh the recent posts, then keep them current through live updates
+	messages, err := client.GetNewsletterMessageUpdates(jid, &whatsmeow.GetNewsletterUpdatesParams{Count: 100})
+	if err != nil {
+		log.Printf("Failed to get metrics of channel %s: %v", jid.String(), err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to get channel metrics: %v", err),
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	storeNewsletterMetrics(jid, messages, time.Now())
+	if err := subscribeNewsletterUpdates(jid); err != nil {
+		log.Printf("Failed to subscribe to live updates of channel %s: %v", jid.String(), err)
+	}
 
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		http.Error(w, "Image not found", http.StatusNotFound)
+	newsletterMetricsMu.Lock()
+	posts := make([]NewsletterPostMetrics, 0, len(newsletterMetrics[jid]))
+	for _, post := range newsletterMetrics[jid] {
+		posts = append(posts, *post)
+	}
+	newsletterMetricsMu.Unlock()
+	// Newest post first
+	sort.Slice(posts, func(i, j int) bool { return posts[i].ServerID > posts[j].ServerID })
+
+	response := APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Metrics of %d channel post(s) retrieved", len(posts)),
+		Data: map[string]interface{}{
+			"jid":   jid.String(),
+			"posts": posts,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleOfflineSyncPreview announces how many missed events the server is about to deliver after a reconnect
+func handleOfflineSyncPreview(evt *events.OfflineSyncPreview) {
+	log.Printf("📥 Catching up on %d missed event(s): %d message(s), %d notification(s), %d receipt(s), %d app state change(s)",
+		evt.Total, evt.Messages, evt.Notifications, evt.Receipts, evt.AppDataChanges)
+
+	offlineSyncMu.Lock()
+	offlineSync = offlineSyncState{State: "syncing", Expected: *evt, StartedAt: time.Now()}
+	offlineSyncMu.Unlock()
+
+	if webhookURL != "" {
+		attachment := map[string]interface{}{
+			"type":             "offline_sync_started",
+			"total":            evt.Total,
+			"messages":         evt.Messages,
+			"notifications":    evt.Notifications,
+			"receipts":         evt.Receipts,
+			"app_data_changes": evt.AppDataChanges,
+		}
+		sendToWebhook("offline_sync_started", fmt.Sprintf("Catching up on %d missed event(s)", evt.Total), "", "", attachment)
+	}
+}
+
+// handleOfflineSyncCompleted reports that the backlog of missed events has been delivered. Events are
+// handled in order, so every missed message has been processed by the time this arrives.
+func handleOfflineSyncCompleted(evt *events.OfflineSyncCompleted) {
+	offlineSyncMu.Lock()
+	// The server skips the preview when there was little to catch up on
+	if offlineSync.State != "syncing" {
+		offlineSync = offlineSyncState{StartedAt: time.Now()}
+	}
+	offlineSync.State = "completed"
+	offlineSync.Delivered = evt.Count
+	offlineSync.CompletedAt = time.Now()
+	state := offlineSync
+	offlineSyncMu.Unlock()
+
+	log.Printf("📥 Caught up on missed events: %d delivered, %d message(s) processed", evt.Count, state.Messages)
+	if webhookURL != "" {
+		attachment := map[string]interface{}{
+			"type":        "offline_sync_completed",
+			"expected":    state.Expected.Total,
+			"delivered":   evt.Count,
+			"messages":    state.Messages,
+			"duration_ms": state.CompletedAt.Sub(state.StartedAt).Milliseconds(),
+		}
+		sendToWebhook("offline_sync_completed", fmt.Sprintf("Caught up on %d missed event(s)", evt.Count), "", "", attachment)
+	}
+}
+
+// countOfflineSyncMessage counts a message handled while missed events are being delivered
+func countOfflineSyncMessage() {
+	offlineSyncMu.Lock()
+	if offlineSync.State == "syncing" {
+		offlineSync.Messages++
+	}
+	offlineSyncMu.Unlock()
+}
+
+// handleClientOutdated records that WhatsApp refused our client version and warns the webhook,
+// since nothing can connect or pair until whatsmeow (and with it this service) is upgraded
+func handleClientOutdated() {
+	clientVersionMu.Lock()
+	clientOutdatedAt = time.Now()
+	clientVersionMu.Unlock()
+
+	version := store.GetWAVersion().String()
+	log.Printf("🔄 WhatsApp rejected client version %s as outdated", version)
+	log.Println("💡 Solution: Upgrade to a release built with a newer whatsmeow")
+	go checkLatestVersion()
+
+	if webhookURL != "" {
+		attachment := map[string]interface{}{
+			"type":    "client_outdated",
+			"version": version,
+		}
+		sendToWebhook("client_outdated", "WhatsApp rejected client version "+version+" as outdated", "", "", attachment)
+	}
+}
+
+// checkLatestVersion looks up the current WhatsApp Web version, at most once per latestVersionCacheTTL
+func checkLatestVersion() {
+	clientVersionMu.Lock()
+	fresh := time.Since(latestVersionChecked) < latestVersionCacheTTL
+	clientVersionMu.Unlock()
+	if fresh {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	latest, err := whatsmeow.GetLatestVersion(ctx, nil)
+
+	clientVersionMu.Lock()
+	defer clientVersionMu.Unlock()
+	latestVersionChecked = time.Now()
+	if err != nil {
+		log.Printf("Failed to look up the latest WhatsApp Web version: %v", err)
+		latestVersionError = err.Error()
+		return
+	}
+	latestVersion = *latest
+	latestVersionError = ""
+	if current := store.GetWAVersion(); versionBefore(current, latestVersion) {
+		log.Printf("⚠️ Client version %s is behind WhatsApp Web %s; pairing fails once WhatsApp stops accepting it", current, latestVersion)
+	}
+}
+
+// versionBefore reports whether version a is older than b
+func versionBefore(a, b store.WAVersionContainer) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// clientVersionStatus reports the client version we connect with and how it compares to WhatsApp Web
+func clientVersionStatus() map[string]interface{} {
+	clientVersionMu.Lock()
+	defer clientVersionMu.Unlock()
+
+	current := store.GetWAVersion()
+	status := map[string]interface{}{
+		"version":  current.String(),
+		"outdated": !clientOutdatedAt.IsZero(),
+	}
+	if !clientOutdatedAt.IsZero() {
+		status["outdated_at"] = clientOutdatedAt
+	}
+	if !latestVersionChecked.IsZero() {
+		status["checked_at"] = latestVersionChecked
+	}
+	if !latestVersion.IsZero() {
+		status["latest"] = latestVersion.String()
+		status["behind"] = versionBefore(current, latestVersion)
+	}
+	if latestVersionError != "" {
+		status["check_error"] = latestVersionError
+	}
+	return status
+}
+
+// offlineSyncStatus reports the last catch-up after a reconnect, or nil if there was none since startup
+func offlineSyncStatus() map[string]interface{} {
+	offlineSyncMu.Lock()
+	defer offlineSyncMu.Unlock()
+	if offlineSync.State == "" {
+		return nil
+	}
+	status := map[string]interface{}{
+		"state":      offlineSync.State,
+		"expected":   offlineSync.Expected.Total,
+		"messages":   offlineSync.Messages,
+		"started_at": offlineSync.StartedAt,
+	}
+	if offlineSync.State == "completed" {
+		status["delivered"] = offlineSync.Delivered
+		status["completed_at"] = offlineSync.CompletedAt
+	}
+	return status
+}
+
+// handleUndecryptable reports a message that couldn't be decrypted. whatsmeow has already asked the
+// sender to resend it (and our phone, if that doesn't arrive in time); a recovered copy comes in as
+// a normal message with the same ID.
+func handleUndecryptable(evt *events.UndecryptableMessage) {
+	undecryptableCount.Add(1)
+	log.Printf("⚠️ Could not decrypt message %s from %s in %s (unavailable: %t %s)",
+		evt.Info.ID, evt.Info.Sender.String(), evt.Info.Chat.String(), evt.IsUnavailable, evt.UnavailableType)
+
+	if webhookURL == "" {
+		return
+	}
+	attachment := map[string]interface{}{
+		"type":           "undecryptable",
+		"message_id":     evt.Info.ID,
+		"from_me":        evt.Info.IsFromMe,
+		"is_unavailable": evt.IsUnavailable,
+	}
+	if evt.UnavailableType != "" {
+		attachment["unavailable_type"] = evt.UnavailableType
+	}
+	if evt.DecryptFailMode != "" {
+		attachment["decrypt_fail_mode"] = evt.DecryptFailMode
+	}
+	sendToWebhook("undecryptable", "Message could not be decrypted", evt.Info.Sender.String(), evt.Info.Chat.String(), attachment)
+}
+
+// handleChatRemoved forwards a chat being cleared or deleted on another device, purging the stored copy if enabled
+func handleChatRemoved(event string, chat types.JID, messageRange *waSyncAction.SyncActionMessageRange, fromFullSync bool) {
+	log.Printf("Chat %s: %s", strings.TrimPrefix(event, "chat_"), chat.String())
+
+	// A full app state sync replays old actions, which are not changes
+	if fromFullSync {
+		return
+	}
+
+	// Only messages up to the last one the phone had are removed, anything newer arrived afterwards
+	var before time.Time
+	if ts := messageRange.GetLastMessageTimestamp(); ts > 0 {
+		before = time.Unix(ts, 0)
+	}
+
+	purged := 0
+	if purgeClearedChats {
+		var err error
+		purged, err = purgeChatMessages(chat, before)
+		if err != nil {
+			log.Printf("Failed to purge stored messages of %s: %v", chat.String(), err)
+		} else {
+			log.Printf("Purged %d stored message(s) of %s", purged, chat.String())
+		}
+	}
+
+	if webhookURL == "" {
+		return
+	}
+	attachment := map[string]interface{}{
+		"type":   event,
+		"purged": purged,
+	}
+	if !before.IsZero() {
+		attachment["last_message_timestamp"] = before
+	}
+	message := "Chat cleared"
+	if event == "chat_deleted" {
+		message = "Chat deleted"
+	}
+	sendToWebhook(event, message, "", chat.String(), attachment)
+}
+
+// purgeChatMessages removes the stored messages of chat sent up to before (all when zero), along with their downloaded media
+func purgeChatMessages(chat types.JID, before time.Time) (int, error) {
+	if before.IsZero() {
+		before = time.Now()
+	}
+
+	rows, err := db.Query(`SELECT id, sender, timestamp, raw FROM messages
+		WHERE chat = $1 AND timestamp <= $2 AND raw IS NOT NULL AND type IN ('image', 'video', 'audio', 'document', 'sticker')`,
+		chat.String(), before)
+	if err != nil {
+		return 0, err
+	}
+	var files []string
+	for rows.Next() {
+		var info types.MessageInfo
+		info.Chat = chat
+		var sender string
+		var raw []byte
+		if err := rows.Scan(&info.ID, &sender, &info.Timestamp, &raw); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		info.Sender, _ = types.ParseJID(sender)
+		msg := &waProto.Message{}
+		if proto.Unmarshal(raw, msg) == nil {
+			files = append(files, filepath.Join(downloadDir, downloadFilename(info, mediaFileExtension(msg))))
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, file := range files {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove %s: %v", file, err)
+		}
+	}
+
+	result, err := db.Exec("DELETE FROM messages WHERE chat = $1 AND timestamp <= $2", chat.String(), before)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := result.RowsAffected()
+	return int(n), nil
+}
+
+// handleGroupInfo drops the group from the cache and forwards what changed to the webhook
+func handleGroupInfo(evt *events.GroupInfo) {
+	log.Printf("=== GROUP INFO CHANGED ===")
+	log.Printf("Group: %s", evt.JID.String())
+
+	changes := make(map[string]interface{})
+	if evt.Name != nil {
+		log.Printf("  - New subject: %s", evt.Name.Name)
+		changes["subject"] = evt.Name.Name
+	}
+	if evt.Topic != nil {
+		log.Printf("  - New description: %s", evt.Topic.Topic)
+		changes["description"] = evt.Topic.Topic
+	}
+	if evt.Locked != nil {
+		changes["locked"] = evt.Locked.IsLocked
+	}
+	if evt.Announce != nil {
+		changes["announce"] = evt.Announce.IsAnnounce
+	}
+	if evt.Ephemeral != nil {
+		changes["disappearing_timer"] = evt.Ephemeral.DisappearingTimer
+
+		// Keep replies to this group in line with its new timer
+		chatTimersMu.Lock()
+		if evt.Ephemeral.IsEphemeral {
+			chatTimers[evt.JID.String()] = evt.Ephemeral.DisappearingTimer
+		} else {
+			delete(chatTimers, evt.JID.String())
+		}
+		chatTimersMu.Unlock()
+	}
+	if evt.Delete != nil {
+		log.Printf("  - Group deleted")
+		changes["deleted"] = true
+	}
+	if len(evt.Join) > 0 {
+		log.Printf("  - Added participants: %v", evt.Join)
+		changes["added"] = jidStrings(evt.Join)
+	}
+	if len(evt.Leave) > 0 {
+		log.Printf("  - Removed participants: %v", evt.Leave)
+		changes["removed"] = jidStrings(evt.Leave)
+	}
+	if len(evt.Promote) > 0 {
+		log.Printf("  - Promoted to admin: %v", evt.Promote)
+		changes["promoted"] = jidStrings(evt.Promote)
+	}
+	if len(evt.Demote) > 0 {
+		log.Printf("  - Demoted from admin: %v", evt.Demote)
+		changes["demoted"] = jidStrings(evt.Demote)
+	}
+	log.Printf("========================")
+
+	invalidateGroupCache(evt.JID)
+	handleJoinRequestChanges(evt)
+	sendParticipantChanges(evt)
+
+	if len(changes) == 0 {
+		return
+	}
+	changes["type"] = "group_update"
+
+	sender := ""
+	if evt.Sender != nil {
+		sender = evt.Sender.String()
+	}
+	if webhookURL != "" {
+		sendToWebhook("group_update", "", sender, evt.JID.String(), changes)
+	}
+}
+
+// sendParticipantChanges sends a participant_joined or participant_left event for every member who
+// joined or left the group, with who added or removed them when that was someone else
+func sendParticipantChanges(evt *events.GroupInfo) {
+	if webhookURL == "" || (len(evt.Join) == 0 && len(evt.Leave) == 0) {
+		return
+	}
+
+	// The change notification names whoever made it; for someone joining or leaving on their own that is themselves
+	actor := func(participant types.JID) string {
+		for _, sender := range []*types.JID{evt.Sender, evt.SenderPN} {
+			if sender != nil && sender.ToNonAD() == participant.ToNonAD() {
+				return ""
+			}
+		}
+		if evt.SenderPN != nil {
+			return evt.SenderPN.String()
+		}
+		if evt.Sender != nil {
+			return evt.Sender.String()
+		}
+		return ""
+	}
+
+	for _, participant := range evt.Join {
+		by := actor(participant)
+		reason := "joined"
+		switch {
+		case evt.JoinReason == "invite":
+			reason = "invite_link"
+		case by != "":
+			reason = "added"
+		}
+		attachment := map[string]interface{}{
+			"type":        "participant_joined",
+			"participant": participant.String(),
+			"reason":      reason,
+			"actor":       by,
+		}
+		log.Printf("👤 %s joined group %s (%s)", participant.String(), evt.JID.String(), reason)
+		sendToWebhook("participant_joined", "Participant joined", by, evt.JID.String(), attachment)
+	}
+
+	for _, participant := range evt.Leave {
+		by := actor(participant)
+		reason := "left"
+		if by != "" {
+			reason = "removed"
+		}
+		attachment := map[string]interface{}{
+			"type":        "participant_left",
+			"participant": participant.String(),
+			"reason":      reason,
+			"actor":       by,
+		}
+		log.Printf("👤 %s left group %s (%s)", participant.String(), evt.JID.String(), reason)
+		sendToWebhook("participant_left", "Participant left", by, evt.JID.String(), attachment)
+	}
+}
+
+// handleJoinRequestChanges forwards requests to join a group that needs admin approval.
+// whatsmeow has no dedicated event for these, they arrive as unrecognized group info changes.
+func handleJoinRequestChanges(evt *events.GroupInfo) {
+	for _, change := range evt.UnknownChanges {
+		switch change.Tag {
+		case "created_membership_requests":
+			// The notification's participant is the user asking to join
+			if evt.Sender == nil {
+				continue
+			}
+			requester := *evt.Sender
+			pushName := evt.Notify
+			if pushName == "" {
+				if contact, err := client.Store.Contacts.GetContact(context.Background(), requester); err == nil {
+					pushName = contact.PushName
+				}
+			}
+
+			log.Printf("👋 %s (%s) asked to join group %s", requester.String(), pushName, evt.JID.String())
+			if webhookURL == "" {
+				continue
+			}
+			attachment := map[string]interface{}{
+				"type":           "group_join_request",
+				"status":         "pending",
+				"group":          evt.JID.String(),
+				"requester":      requester.String(),
+				"push_name":      pushName,
+				"request_method": change.AttrGetter().OptionalString("request_method"),
+			}
+			if evt.SenderPN != nil {
+				attachment["requester_pn"] = evt.SenderPN.String()
+			}
+			sendToWebhook("group_join_request", "Group join request received", requester.String(), evt.JID.String(), attachment)
+		case "revoked_membership_requests":
+			// The requester cancelled, or an admin rejected the request
+			for _, participant := range change.GetChildrenByTag("participant") {
+				requester, ok := participant.Attrs["jid"].(types.JID)
+				if !ok {
+					continue
+				}
+				log.Printf("Join request from %s for group %s was revoked", requester.String(), evt.JID.String())
+				if webhookURL == "" {
+					continue
+				}
+				attachment := map[string]interface{}{
+					"type":      "group_join_request",
+					"status":    "revoked",
+					"group":     evt.JID.String(),
+					"requester": requester.String(),
+				}
+				sendToWebhook("group_join_request", "Group join request revoked", requester.String(), evt.JID.String(), attachment)
+			}
+		}
+	}
+}
+
+// handleGroupPicture forwards group icon changes to the webhook
+func handleGroupPicture(evt *events.Picture) {
+	if evt.JID.Server != types.GroupServer {
 		return
 	}
 
-	// Determine content type
-	ext := strings.ToLower(filepath.Ext(filename))
-	var contentType string
-	switch ext {
-	case ".jpg", ".jpeg":
-		contentType = "image/jpeg"
-	case ".png":
-		contentType = "image/png"
-	case ".gif":
-		contentType = "image/gif"
-	case ".webp":
-		contentType = "image/webp"
-	default:
-		contentType = "application/octet-stream"
+	log.Printf("Group icon changed for %s (removed: %t)", evt.JID.String(), evt.Remove)
+	if webhookURL != "" {
+		changes := map[string]interface{}{
+			"type":         "group_update",
+			"icon_changed": true,
+			"icon_removed": evt.Remove,
+			"picture_id":   evt.PictureID,
+		}
+		sendToWebhook("group_update", "", evt.Author.String(), evt.JID.String(), changes)
+	}
+}
+
+const storedMessageColumns = "id, chat, sender, push_name, timestamp, from_me, type, content, attachment, expires_at, kept, expired, deleted_at"
+
+// storeMessage saves a received or sent message in the messages table, ignoring replays of the same ID
+func storeMessage(evt *events.Message, content string, attachment map[string]interface{}) error {
+	msgType := "text"
+	if attachment != nil {
+		if t, ok := attachment["type"].(string); ok {
+			msgType = t
+		}
+	}
+
+	var attachmentJSON []byte
+	if attachment != nil {
+		var err error
+		attachmentJSON, err = json.Marshal(attachment)
+		if err != nil {
+			return fmt.Errorf("failed to encode attachment: %v", err)
+		}
+	}
+
+	var raw []byte
+	if evt.Message != nil {
+		var err error
+		raw, err = proto.Marshal(evt.Message)
+		if err != nil {
+			return fmt.Errorf("failed to encode message: %v", err)
+		}
 	}
 
-	// Set headers
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Cache-Control", "public, max-age=3600") // Cache for 1 hour
+	// Disappearing messages carry their timer; without context info fall back to the chat's known timer
+	var expiresAt *time.Time
+	var timer uint32
+	if evt.Message != nil {
+		if ctx := messageContextInfo(evt.Message); ctx != nil {
+			timer = ctx.GetExpiration()
+		} else {
+			chatTimersMu.RLock()
+			timer = chatTimers[evt.Info.Chat.String()]
+			chatTimersMu.RUnlock()
+		}
+	}
+	if timer > 0 {
+		at := evt.Info.Timestamp.Add(time.Duration(timer) * time.Second)
+		expiresAt = &at
+	}
 
-	// Serve file
-	http.ServeFile(w, r, filePath)
+	_, err := db.Exec(`
+		INSERT INTO messages (id, chat, sender, push_name, timestamp, from_me, type, content, attachment, raw, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (chat, id) DO NOTHING`,
+		evt.Info.ID, evt.Info.Chat.String(), evt.Info.Sender.String(), evt.Info.PushName,
+		evt.Info.Timestamp, evt.Info.IsFromMe, msgType, content, attachmentJSON, raw, expiresAt)
+	return err
 }
 
-// Swagger documentation endpoint
-func swaggerHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+// knownMessage is what is known about a message before editing or deleting it
+type knownMessage struct {
+	FromMe bool
+	Sender string // empty for messages only known as sent through the API
+	SentAt time.Time
+}
 
-	swaggerInfo := map[string]interface{}{
-		"title":       "WhatsApp Web API",
-		"description": "REST API for WhatsApp Web integration",
-		"version":     "1.0.0",
-		"endpoints": map[string]string{
-			"pair":    "GET  /pair   - Generate QR code for pairing",
-			"send":    "POST /send   - Send message with attachments (requires pairing)",
-			"health":  "GET  /health - Check service status",
-			"images":  "GET  /images/{filename} - Serve downloaded images",
-			"swagger": "GET  /swagger - API documentation info",
-			"docs":    "GET  /swagger.yaml - Full OpenAPI specification",
-		},
-		"documentation": "Full API documentation available at /swagger.yaml",
-		"swagger_ui":    "Use Swagger UI with the yaml file: https://editor.swagger.io/",
+// lookupKnownMessage finds a message in the message store, the IDs sent through the API in the
+// last hour, or the client_message_id records. It returns nil if none of them has it.
+func lookupKnownMessage(chat types.JID, messageID string) (*knownMessage, error) {
+	stored, err := queryStoredMessages("SELECT "+storedMessageColumns+" FROM messages WHERE chat = $1 AND id = $2", chat.String(), messageID)
+	if err != nil {
+		return nil, err
 	}
-
-	response := APIResponse{
-		Success: true,
-		Message: "WhatsApp Web API Documentation",
-		Data:    swaggerInfo,
+	if len(stored) > 0 {
+		return &knownMessage{FromMe: stored[0].FromMe, Sender: stored[0].Sender, SentAt: stored[0].Timestamp}, nil
 	}
-	json.NewEncoder(w).Encode(response)
+	if at, ok := sentMessages.SeenAt(messageID); ok {
+		return &knownMessage{FromMe: true, SentAt: at}, nil
+	}
+	var createdAt time.Time
+	err = db.QueryRow("SELECT created_at FROM client_messages WHERE chat = $1 AND message_id = $2", chat.String(), messageID).Scan(&createdAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &knownMessage{FromMe: true, SentAt: createdAt}, nil
 }
 
-func handler(rawEvt interface{}) {
-	switch evt := rawEvt.(type) {
-	case *events.Message:
-		handleMessage(evt)
-	case *events.Connected:
-		log.Println("🟢 Connected to WhatsApp!")
-		if client.Store.ID != nil {
-			log.Printf("Device ID: %s", client.Store.ID.String())
-		}
-	case *events.Disconnected:
-		log.Println("🔴 Disconnected from WhatsApp")
-		isPaired = false
-	case *events.PairSuccess:
-		log.Printf("🎉 Successfully paired! Device: %s", evt.ID)
-		isPaired = true
-	case *events.LoggedOut:
-		log.Println("🔒 Logged out from WhatsApp")
-		log.Println("💡 This may happen if another device connects or if you log out from WhatsApp mobile app")
-		isPaired = false
-	case *events.StreamError:
-		log.Printf("🚫 Stream error occurred")
-		log.Println("💡 This may indicate connection issues or device limit problems")
-	case *events.ConnectFailure:
-		log.Printf("❌ Connection failed: %v", evt.Reason)
-		log.Println("💡 Check your internet connection and WhatsApp device limits")
+// sendMessage sends msg with the default client and remembers its ID as sent by us. The ID is
+// registered before sending, as the copy our phone syncs back can arrive before SendMessage returns.
+func sendMessage(ctx context.Context, to types.JID, msg *waProto.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error) {
+	return sendMessageAs(ctx, client, to, msg, extra...)
+}
+
+// sendMessageAs is sendMessage for any account's client. Only the default account's messages are
+// stored, as the message store holds its chats alone.
+func sendMessageAs(ctx context.Context, c *whatsmeow.Client, to types.JID, msg *waProto.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error) {
+	var req whatsmeow.SendRequestExtra
+	if len(extra) > 0 {
+		req = extra[0]
+	}
+	if req.ID == "" {
+		req.ID = c.GenerateMessageID()
+	}
+	sentMessages.Add(req.ID)
+	resp, err := c.SendMessage(ctx, to, msg, req)
+	if err != nil {
+		sentMessages.Forget(req.ID)
+		return resp, err
+	}
+	if c == client {
+		storeSentMessage(to, resp, msg)
 	}
+	return resp, nil
 }
 
-func logMessageDetails(evt *events.Message) {
-	// Log basic message information
-	log.Printf("=== MESSAGE RECEIVED ===")
-	log.Printf("Message ID: %s", evt.Info.ID)
-	log.Printf("From: %s", evt.Info.Sender.String())
-	log.Printf("Chat: %s", evt.Info.Chat.String())
-	log.Printf("Timestamp: %s", evt.Info.Timestamp)
-	log.Printf("Push Name: %s", evt.Info.PushName)
-	log.Printf("Is From Me: %t", evt.Info.IsFromMe)
-	log.Printf("Is Group: %t", evt.Info.Chat.Server == "g.us")
+// storeSentMessage saves a message sent through the API when outgoing messages are stored.
+// Edits, deletions and keep-in-chat change another message instead, so they aren't stored.
+func storeSentMessage(chat types.JID, resp whatsmeow.SendResponse, msg *waProto.Message) {
+	if !storeOutgoing.Load() || msg.GetProtocolMessage() != nil || msg.GetKeepInChatMessage() != nil {
+		return
+	}
+	sent := &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{Chat: chat, Sender: client.Store.ID.ToNonAD(), IsFromMe: true},
+			ID:            resp.ID,
+			Timestamp:     resp.Timestamp,
+		},
+		Message: msg,
+	}
+	content, attachment := outgoingMessageDetails(chat, msg)
+	err := storeMessage(sent, content, attachment)
+	if err != nil {
+		log.Printf("Failed to store sent message %s: %v", resp.ID, err)
+	}
+}
 
-	// Log message type information
-	if evt.Message != nil {
-		log.Printf("Message Type Analysis:")
-		if evt.Message.Conversation != nil && *evt.Message.Conversation != "" {
-			log.Printf("  - Text message: %s", *evt.Message.Conversation)
+// outgoingMessageDetails describes a message we sent in chat for the message store, like handleMessage
+// does for incoming ones but without downloading anything
+func outgoingMessageDetails(chat types.JID, msg *waProto.Message) (string, map[string]interface{}) {
+	if msg == nil {
+		return "", nil
+	}
+	if payment, content := paymentDetails(chat, msg); payment != nil {
+		return content, payment
+	}
+	switch {
+	case msg.GetConversation() != "":
+		return msg.GetConversation(), nil
+	case msg.GetExtendedTextMessage().GetText() != "":
+		return msg.GetExtendedTextMessage().GetText(), nil
+	case msg.ImageMessage != nil:
+		img := msg.ImageMessage
+		return img.GetCaption(), map[string]interface{}{
+			"type":        "image",
+			"caption":     img.GetCaption(),
+			"mimetype":    img.GetMimetype(),
+			"file_length": img.GetFileLength(),
+			"width":       img.GetWidth(),
+			"height":      img.GetHeight(),
 		}
-		if evt.Message.ExtendedTextMessage != nil {
-			log.Printf("  - Extended text message")
+	case msg.VideoMessage != nil:
+		vid := msg.VideoMessage
+		return vid.GetCaption(), map[string]interface{}{
+			"type":        "video",
+			"caption":     vid.GetCaption(),
+			"mimetype":    vid.GetMimetype(),
+			"file_length": vid.GetFileLength(),
+			"seconds":     vid.GetSeconds(),
 		}
-		if evt.Message.ImageMessage != nil {
-			log.Printf("  - Image message")
+	case msg.AudioMessage != nil:
+		audio := msg.AudioMessage
+		return "Audio message sent", map[string]interface{}{
+			"type":        "audio",
+			"mimetype":    audio.GetMimetype(),
+			"file_length": audio.GetFileLength(),
+			"seconds":     audio.GetSeconds(),
 		}
-		if evt.Message.DocumentMessage != nil {
-			log.Printf("  - Document message")
+	case msg.DocumentMessage != nil:
+		doc := msg.DocumentMessage
+		return fmt.Sprintf("Document sent: %s", doc.GetTitle()), map[string]interface{}{
+			"type":        "document",
+			"title":       doc.GetTitle(),
+			"mimetype":    doc.GetMimetype(),
+			"file_length": doc.GetFileLength(),
 		}
-		if evt.Message.AudioMessage != nil {
-			log.Printf("  - Audio message")
+	case msg.StickerMessage != nil:
+		return "Sticker sent", map[string]interface{}{
+			"type":        "sticker",
+			"mimetype":    msg.StickerMessage.GetMimetype(),
+			"file_length": msg.StickerMessage.GetFileLength(),
 		}
-		if evt.Message.VideoMessage != nil {
-			log.Printf("  - Video message")
+	case msg.ContactMessage != nil:
+		contact := msg.ContactMessage
+		return fmt.Sprintf("Contact sent: %s", contact.GetDisplayName()), map[string]interface{}{
+			"type":         "contact",
+			"display_name": contact.GetDisplayName(),
+			"contact":      parseVCard(contact.GetVcard()),
 		}
-		if evt.Message.StickerMessage != nil {
-			log.Printf("  - Sticker message")
+	case msg.ContactsArrayMessage != nil:
+		var contacts []VCardContact
+		for _, c := range msg.ContactsArrayMessage.GetContacts() {
+			contacts = append(contacts, parseVCard(c.GetVcard()))
 		}
-		if evt.Message.ContactMessage != nil {
-			log.Printf("  - Contact message")
+		return fmt.Sprintf("Contacts sent: %d contact(s)", len(contacts)), map[string]interface{}{
+			"type":         "contacts",
+			"display_name": msg.ContactsArrayMessage.GetDisplayName(),
+			"contacts":     contacts,
 		}
-		if evt.Message.LocationMessage != nil {
-			log.Printf("  - Location message")
+	case msg.LocationMessage != nil:
+		loc := msg.LocationMessage
+		return fmt.Sprintf("Location sent: %s", loc.GetName()), map[string]interface{}{
+			"type":      "location",
+			"name":      loc.GetName(),
+			"address":   loc.GetAddress(),
+			"latitude":  loc.GetDegreesLatitude(),
+			"longitude": loc.GetDegreesLongitude(),
 		}
-		if evt.Message.ReactionMessage != nil {
-			log.Printf("  - Reaction message")
+	case msg.ReactionMessage != nil:
+		return fmt.Sprintf("Reaction sent: %s", msg.ReactionMessage.GetText()), map[string]interface{}{
+			"type":       "reaction",
+			"emoji":      msg.ReactionMessage.GetText(),
+			"removed":    msg.ReactionMessage.GetText() == "",
+			"message_id": msg.ReactionMessage.GetKey().GetID(),
 		}
-		if evt.Message.ButtonsResponseMessage != nil {
-			log.Printf("  - Button response message")
+	}
+	return "Non-text message sent", map[string]interface{}{"type": "unknown"}
+}
+
+// scanStoredMessages reads rows selected with storedMessageColumns
+func scanStoredMessages(rows *sql.Rows) ([]StoredMessage, error) {
+	messages := []StoredMessage{}
+	for rows.Next() {
+		var msg StoredMessage
+		var attachmentJSON []byte
+		var expiresAt, deletedAt sql.NullTime
+		err := rows.Scan(&msg.ID, &msg.Chat, &msg.Sender, &msg.PushName, &msg.Timestamp, &msg.FromMe, &msg.Type, &msg.Content, &attachmentJSON,
+			&expiresAt, &msg.Kept, &msg.Expired, &deletedAt)
+		if err != nil {
+			return nil, err
 		}
-		if evt.Message.ListResponseMessage != nil {
-			log.Printf("  - List response message")
+		if len(attachmentJSON) > 0 {
+			if err := json.Unmarshal(attachmentJSON, &msg.Attachment); err != nil {
+				return nil, err
+			}
 		}
-		if evt.Message.PollCreationMessage != nil {
-			log.Printf("  - Poll creation message")
+		if expiresAt.Valid {
+			msg.ExpiresAt = &expiresAt.Time
 		}
-		if evt.Message.PollUpdateMessage != nil {
-			log.Printf("  - Poll update message")
+		if deletedAt.Valid {
+			msg.DeletedAt = &deletedAt.Time
 		}
-	} else {
-		log.Printf("  - Message content is nil")
+		msg.Direction = "incoming"
+		if msg.FromMe {
+			msg.Direction = "outgoing"
+		}
+		messages = append(messages, msg)
 	}
+	return messages, rows.Err()
+}
 
-	log.Printf("========================")
+func queryStoredMessages(query string, args ...interface{}) ([]StoredMessage, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanStoredMessages(rows)
 }
 
-func handleMessage(evt *events.Message) {
-	// Ignore messages from ourselves
-	if evt.Info.IsFromMe {
-		return
+// parseCountParam reads an optional non-negative integer query parameter
+func parseCountParam(r *http.Request, name string, defaultValue, maxValue int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
 	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || n > maxValue {
+		return 0, fmt.Errorf("%s must be a number between 0 and %d", name, maxValue)
+	}
+	return n, nil
+}
 
-	// Log comprehensive message information
-	logMessageDetails(evt)
+// resolveSendTarget turns the recipient given to a send endpoint into the JID to send to. A bare
+// phone number (+, spaces, dashes and parentheses are ignored) is a user, "status" is the status
+// broadcast and anything with an @ is taken as a JID. When kinds are given, other kinds of
+// destinations are refused.
+func resolveSendTarget(target string, kinds ...string) (types.JID, error) {
+	target = strings.TrimSpace(target)
 
-	// Mark message as read FIRST
-	err := client.MarkRead(
-		[]types.MessageID{evt.Info.ID},
-		time.Now(),
-		evt.Info.Chat,
-		evt.Info.Sender,
-		types.ReceiptTypeRead,
-	)
-	if err != nil {
-		log.Printf("Failed to mark message as read: %v", err)
-	} else {
-		log.Printf("Message marked as read successfully")
+	var jid types.JID
+	switch {
+	case target == "":
+		return types.EmptyJID, fmt.Errorf("recipient is required")
+	case strings.EqualFold(target, "status"):
+		jid = types.StatusBroadcastJID
+	case strings.Contains(target, "@"):
+		var err error
+		jid, err = types.ParseJID(target)
+		if err != nil {
+			return types.EmptyJID, err
+		}
+	default:
+		phone := strings.NewReplacer("+", "", " ", "", "-", "", "(", "", ")", "").Replace(target)
+		if phone == "" || normalizePhone(phone) != phone {
+			return types.EmptyJID, fmt.Errorf("%q is not a phone number or JID", target)
+		}
+		jid = types.NewJID(phone, types.DefaultUserServer)
 	}
 
-	// Extract message content and handle automatic image download
-	var messageContent string
-	var attachmentInfo map[string]interface{}
+	kind := sendTargetKind(jid)
+	if kind == "" {
+		return types.EmptyJID, fmt.Errorf("can't send messages to %s addresses", jid.Server)
+	}
+	if len(kinds) > 0 && !slices.Contains(kinds, kind) {
+		return types.EmptyJID, fmt.Errorf("this endpoint can't send to a %s", kind)
+	}
+	return jid, nil
+}
 
-	if evt.Message != nil {
-		if evt.Message.Conversation != nil && *evt.Message.Conversation != "" {
-			messageContent = *evt.Message.Conversation
-		} else if evt.Message.ExtendedTextMessage != nil && evt.Message.ExtendedTextMessage.Text != nil {
-			messageContent = *evt.Message.ExtendedTextMessage.Text
-		} else if evt.Message.ImageMessage != nil {
-			// Handle image message
-			imgMsg := evt.Message.ImageMessage
-			caption := ""
-			if imgMsg.Caption != nil {
-				caption = *imgMsg.Caption
-			}
-			messageContent = fmt.Sprintf("Image received%s", func() string {
-				if caption != "" {
-					return fmt.Sprintf(": %s", caption)
-				}
-				return ""
-			}())
+// sendTargetKind tells what kind of destination a JID is, or "" if messages can't be sent there.
+// whatsmeow picks the envelope from the server: group and broadcast messages use sender keys,
+// newsletters are sent unencrypted.
+func sendTargetKind(jid types.JID) string {
+	switch jid.Server {
+	case types.DefaultUserServer, types.HiddenUserServer:
+		return targetUser
+	case types.GroupServer:
+		return targetGroup
+	case types.BroadcastServer:
+		if jid.User == types.StatusBroadcastJID.User {
+			return targetStatus
+		}
+		return targetBroadcast
+	case types.NewsletterServer:
+		return targetNewsletter
+	}
+	return ""
+}
 
-			// Automatically download the image
-			go func() {
-				err := downloadAndSaveImage(evt.Info.ID, imgMsg)
-				if err != nil {
-					log.Printf("Failed to download image: %v", err)
-				} else {
-					log.Printf("Image downloaded successfully")
-				}
-			}()
+// normalizeChatJID accepts either a full JID or a bare phone number
+func normalizeChatJID(chat string) string {
+	if !strings.Contains(chat, "@") {
+		return chat + "@s.whatsapp.net"
+	}
+	return chat
+}
 
-			// Store image info for webhook and logging
-			attachmentInfo = map[string]interface{}{
-				"type":        "image",
-				"caption":     caption,
-				"mimetype":    imgMsg.Mimetype,
-				"file_length": imgMsg.FileLength,
-				"width":       imgMsg.Width,
-				"height":      imgMsg.Height,
-				"url":         fmt.Sprintf("/images/%s.jpg", evt.Info.ID),
-			}
-		} else if evt.Message.DocumentMessage != nil {
-			docMsg := evt.Message.DocumentMessage
-			title := ""
-			if docMsg.Title != nil {
-				title = *docMsg.Title
-			}
-			messageContent = fmt.Sprintf("Document received: %s", title)
-			attachmentInfo = map[string]interface{}{
-				"type":        "document",
-				"title":       title,
-				"mimetype":    docMsg.Mimetype,
-				"file_length": docMsg.FileLength,
-				"page_count":  docMsg.PageCount,
-			}
-		} else if evt.Message.AudioMessage != nil {
-			audioMsg := evt.Message.AudioMessage
-			messageContent = "Audio message received"
-			attachmentInfo = map[string]interface{}{
-				"type":        "audio",
-				"mimetype":    audioMsg.Mimetype,
-				"file_length": audioMsg.FileLength,
-				"seconds":     audioMsg.Seconds,
-			}
-		} else if evt.Message.VideoMessage != nil {
-			vidMsg := evt.Message.VideoMessage
-			caption := ""
-			if vidMsg.Caption != nil {
-				caption = *vidMsg.Caption
-			}
-			messageContent = fmt.Sprintf("Video received%s", func() string {
-				if caption != "" {
-					return fmt.Sprintf(": %s", caption)
-				}
-				return ""
-			}())
-			attachmentInfo = map[string]interface{}{
-				"type":        "video",
-				"caption":     caption,
-				"mimetype":    vidMsg.Mimetype,
-				"file_length": vidMsg.FileLength,
-				"seconds":     vidMsg.Seconds,
-				"width":       vidMsg.Width,
-				"height":      vidMsg.Height,
-			}
-		} else if evt.Message.StickerMessage != nil {
-			stickerMsg := evt.Message.StickerMessage
-			messageContent = "Sticker received"
-			attachmentInfo = map[string]interface{}{
-				"type":        "sticker",
-				"mimetype":    stickerMsg.Mimetype,
-				"file_length": stickerMsg.FileLength,
-				"width":       stickerMsg.Width,
-				"height":      stickerMsg.Height,
+// parseVCard extracts name, organization, phone numbers and emails from a vCard string
+func parseVCard(vcard string) VCardContact {
+	contact := VCardContact{
+		Phones: []VCardPhone{},
+		Emails: []string{},
+	}
+
+	// Unfold continuation lines (lines starting with a space or tab belong to the previous line)
+	vcard = strings.ReplaceAll(vcard, "\r\n", "\n")
+	vcard = strings.ReplaceAll(vcard, "\n ", "")
+	vcard = strings.ReplaceAll(vcard, "\n\t", "")
+
+	var structuredName string
+	for _, line := range strings.Split(vcard, "\n") {
+		line = strings.TrimSpace(line)
+		sep := strings.Index(line, ":")
+		if sep <= 0 {
+			continue
+		}
+
+		// Property names may be prefixed with a group (e.g. "item1.TEL")
+		params := strings.Split(line[:sep], ";")
+		name := strings.ToUpper(params[0])
+		if dot := strings.LastIndex(name, "."); dot >= 0 {
+			name = name[dot+1:]
+		}
+		value := strings.TrimSpace(line[sep+1:])
+
+		switch name {
+		case "FN":
+			contact.Name = value
+		case "N":
+			// N is Family;Given;Additional;Prefix;Suffix
+			parts := strings.Split(value, ";")
+			var nameParts []string
+			for _, i := range []int{3, 1, 2, 0, 4} {
+				if i < len(parts) && parts[i] != "" {
+					nameParts = append(nameParts, parts[i])
+				}
 			}
-		} else if evt.Message.ContactMessage != nil {
-			contactMsg := evt.Message.ContactMessage
-			messageContent = fmt.Sprintf("Contact received: %s", contactMsg.DisplayName)
-			attachmentInfo = map[string]interface{}{
-				"type":         "contact",
-				"display_name": contactMsg.DisplayName,
-				"vcard":        contactMsg.Vcard,
+			structuredName = strings.Join(nameParts, " ")
+		case "ORG":
+			contact.Organization = strings.TrimRight(strings.ReplaceAll(value, ";", " "), " ")
+		case "EMAIL":
+			if value != "" {
+				contact.Emails = append(contact.Emails, value)
 			}
-		} else if evt.Message.LocationMessage != nil {
-			locMsg := evt.Message.LocationMessage
-			messageContent = fmt.Sprintf("Location received: %s", locMsg.Name)
-			attachmentInfo = map[string]interface{}{
-				"type":      "location",
-				"name":      locMsg.Name,
-				"address":   locMsg.Address,
-				"latitude":  locMsg.DegreesLatitude,
-				"longitude": locMsg.DegreesLongitude,
+		case "TEL":
+			if value == "" {
+				continue
 			}
-		} else {
-			messageContent = "Non-text message received"
-			attachmentInfo = map[string]interface{}{
-				"type": "unknown",
+			phone := VCardPhone{Number: value}
+			for _, param := range params[1:] {
+				key, val, found := strings.Cut(param, "=")
+				if !found {
+					// vCard 2.1 style bare type parameter (e.g. TEL;CELL:...)
+					phone.Type = strings.ToLower(key)
+					continue
+				}
+				switch strings.ToLower(key) {
+				case "waid":
+					phone.WaID = val
+				case "type":
+					phone.Type = strings.ToLower(val)
+				}
 			}
+			contact.Phones = append(contact.Phones, phone)
 		}
 	}
 
-	// Log the processed message content and attachment details
-	log.Printf("Processed message - Content: %s", messageContent)
-	if attachmentInfo != nil {
-		log.Printf("Attachment details: %+v", attachmentInfo)
+	if contact.Name == "" {
+		contact.Name = structuredName
 	}
+	return contact
+}
 
-	// Send to webhook if configured
-	if webhookURL != "" {
-		sendToWebhook("message", messageContent, evt.Info.Sender.String(), evt.Info.Chat.String(), attachmentInfo)
+// normalizePhone strips everything but digits from a phone number
+func normalizePhone(number string) string {
+	var b strings.Builder
+	for _, r := range number {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// downloadFilenameUnsafe matches characters that are not allowed in download file names
+var downloadFilenameUnsafe = regexp.MustCompile(`[^A-Za-z0-9._@+-]`)
+
+// downloadFilename builds the file name for downloaded media from downloadNameTemplate.
+// Supported tokens: {id}, {chat}, {sender}, {timestamp} and {ext}. The result is a single
+// file name (no directories) so it can be served by /images.
+func downloadFilename(info types.MessageInfo, ext string) string {
+	name := strings.NewReplacer(
+		"{id}", info.ID,
+		"{chat}", info.Chat.ToNonAD().String(),
+		"{sender}", info.Sender.ToNonAD().String(),
+		"{timestamp}", info.Timestamp.UTC().Format("20060102-150405"),
+		"{ext}", ext,
+	).Replace(downloadNameTemplate)
+
+	name = downloadFilenameUnsafe.ReplaceAllString(name, "_")
+	name = strings.ReplaceAll(name, "..", "_")
+	if name == "" || name == "." {
+		name = info.ID + "." + ext
 	}
+	return name
 }
 
-func downloadAndSaveImage(messageID types.MessageID, imgMsg *waProto.ImageMessage) error {
+func downloadAndSaveImage(messageID types.MessageID, name string, imgMsg *waProto.ImageMessage) error {
 	log.Printf("=== IMAGE DOWNLOAD START ===")
 	log.Printf("Message ID: %s", messageID)
 	log.Printf("Image URL: %s", *imgMsg.URL)
@@ -898,12 +11566,13 @@ func downloadAndSaveImage(messageID types.MessageID, imgMsg *waProto.ImageMessag
 		return fmt.Errorf("failed to download image: %v", err)
 	}
 
+	recordDownload(len(data))
 	log.Printf("Successfully downloaded image data: %d bytes", len(data))
 
 	// Optionally save to file (you can customize this path)
-	filename := fmt.Sprintf("downloads/%s.jpg", messageID)
+	filename := filepath.Join(downloadDir, name)
 	log.Printf("Creating downloads directory if needed...")
-	err = os.MkdirAll("downloads", 0755)
+	err = os.MkdirAll(downloadDir, 0755)
 	if err != nil {
 		log.Printf("Failed to create downloads directory: %v", err)
 		return fmt.Errorf("failed to create downloads directory: %v", err)
@@ -921,11 +11590,253 @@ func downloadAndSaveImage(messageID types.MessageID, imgMsg *waProto.ImageMessag
 	return nil
 }
 
+// autoDownloadMedia saves the video, audio or document of an incoming message in the background
+// and points the attachment's url at /media, unless the file is over the auto-download limit
+func autoDownloadMedia(evt *events.Message, media whatsmeow.DownloadableMessage, fileLength uint64, attachmentInfo map[string]interface{}) {
+	if skip := autoDownloadSkip(evt.Info.ID, fileLength); skip != "" {
+		attachmentInfo["download_skipped"] = skip
+		return
+	}
+
+	filename := downloadFilename(evt.Info, mediaFileExtension(evt.Message))
+	queueDownload(evt.Info.ID, func() {
+		err := downloadAndSaveMedia(evt.Info.ID, filename, media)
+		if err != nil {
+			log.Printf("Failed to download %s: %v", attachmentInfo["type"], err)
+		}
+	})
+	attachmentInfo["url"] = mediaURL(evt.Message, filename)
+}
+
+// mediaURL is the path a downloaded file of msg is linked under: images and stickers
+// under /images, videos, audio and documents under /media
+func mediaURL(msg *waProto.Message, name string) string {
+	if msg.GetImageMessage() != nil || msg.GetStickerMessage() != nil {
+		return "/images/" + name
+	}
+	return "/media/" + name
+}
+
+// downloadAndSaveMedia saves an incoming video, audio message or document next to the downloaded images
+func downloadAndSaveMedia(messageID types.MessageID, name string, media whatsmeow.DownloadableMessage) error {
+	log.Printf("=== MEDIA DOWNLOAD START ===")
+	log.Printf("Message ID: %s", messageID)
+
+	data, err := client.Download(context.Background(), media)
+	if err != nil {
+		log.Printf("Download failed: %v", err)
+		return fmt.Errorf("failed to download media: %v", err)
+	}
+	recordDownload(len(data))
+
+	err = os.MkdirAll(downloadDir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create downloads directory: %v", err)
+	}
+
+	filename := filepath.Join(downloadDir, name)
+	err = os.WriteFile(filename, data, 0644)
+	if err != nil {
+		log.Printf("Failed to save media file: %v", err)
+		return fmt.Errorf("failed to save media file: %v", err)
+	}
+
+	log.Printf("Media successfully saved to: %s", filename)
+	log.Printf("=== MEDIA DOWNLOAD COMPLETE ===")
+	return nil
+}
+
+// downloadAndSaveSticker saves an incoming WebP sticker together with a PNG rendition of it.
+// Animated stickers are rendered from their first frame.
+func downloadAndSaveSticker(messageID types.MessageID, name, previewName string, stickerMsg *waProto.StickerMessage) error {
+	log.Printf("=== STICKER DOWNLOAD START ===")
+	log.Printf("Message ID: %s", messageID)
+
+	data, err := client.Download(context.Background(), stickerMsg)
+	if err != nil {
+		log.Printf("Download failed: %v", err)
+		return fmt.Errorf("failed to download sticker: %v", err)
+	}
+	recordDownload(len(data))
+
+	err = os.MkdirAll(downloadDir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create downloads directory: %v", err)
+	}
+
+	filename := filepath.Join(downloadDir, name)
+	err = os.WriteFile(filename, data, 0644)
+	if err != nil {
+		log.Printf("Failed to save sticker file: %v", err)
+		return fmt.Errorf("failed to save sticker file: %v", err)
+	}
+	log.Printf("Sticker successfully saved to: %s", filename)
+
+	still, err := webpFirstFrame(data)
+	if err != nil {
+		return fmt.Errorf("failed to read sticker frame: %v", err)
+	}
+	img, err := webp.Decode(bytes.NewReader(still))
+	if err != nil {
+		return fmt.Errorf("failed to decode sticker: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, img)
+	if err != nil {
+		return fmt.Errorf("failed to encode sticker as PNG: %v", err)
+	}
+
+	previewFile := filepath.Join(downloadDir, previewName)
+	err = os.WriteFile(previewFile, buf.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to save sticker preview: %v", err)
+	}
+
+	log.Printf("Sticker preview saved to: %s", previewFile)
+	log.Printf("=== STICKER DOWNLOAD COMPLETE ===")
+	return nil
+}
+
+// webpFirstFrame returns a still WebP the webp decoder can read. Still images are returned
+// unchanged; for animated ones the first ANMF frame is rewrapped into its own WebP container,
+// since golang.org/x/image/webp does not understand animations.
+func webpFirstFrame(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("not a WebP file")
+	}
+
+	for pos := 12; pos+8 <= len(data); {
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		body := pos + 8
+		if size < 0 || body+size > len(data) {
+			return nil, fmt.Errorf("truncated %s chunk", fourCC)
+		}
+
+		switch fourCC {
+		case "VP8 ", "VP8L":
+			return data, nil
+		case "ANMF":
+			// 16 byte frame header: offset X/Y, width-1, height-1, duration (24 bits each) and flags
+			if size < 16 {
+				return nil, fmt.Errorf("invalid ANMF chunk")
+			}
+			frame := data[body+16 : body+size]
+			hasAlpha := len(frame) >= 4 && string(frame[0:4]) == "ALPH"
+
+			vp8x := make([]byte, 10)
+			if hasAlpha {
+				vp8x[0] = 1 << 4
+			}
+			copy(vp8x[4:10], data[body+6:body+12])
+
+			var out bytes.Buffer
+			out.WriteString("RIFF")
+			binary.Write(&out, binary.LittleEndian, uint32(4+8+len(vp8x)+len(frame)))
+			out.WriteString("WEBP")
+			out.WriteString("VP8X")
+			binary.Write(&out, binary.LittleEndian, uint32(len(vp8x)))
+			out.Write(vp8x)
+			out.Write(frame)
+			return out.Bytes(), nil
+		}
+
+		// Chunks are padded to an even length
+		pos = body + size + size%2
+	}
+
+	return nil, fmt.Errorf("no image data found")
+}
+
+// autoDownloadSkip reports why media of the given size is not downloaded automatically: "disabled"
+// when auto-download is off, "size" when it's over the limit, or "" when it is downloaded.
+// Skipped files can still be fetched on demand with /chats/{jid}/download-media.
+func autoDownloadSkip(messageID types.MessageID, size uint64) string {
+	if !autoDownload.Load() {
+		return "disabled"
+	}
+	limit := autoDownloadMaxSize.Load()
+	if limit <= 0 || size <= uint64(limit) {
+		return ""
+	}
+	log.Printf("Not downloading media of %s automatically: %d bytes exceeds the %d byte limit", messageID, size, limit)
+	return "size"
+}
+
+// parseByteSize reads a size in bytes, optionally with a KB, MB or GB suffix (powers of 1024)
+func parseByteSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a size like 10485760 or 10MB", value)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// startDownloadWorkers starts the workers that run queued automatic downloads, n at a time
+func startDownloadWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for download := range downloadQueue {
+				downloadsActive.Add(1)
+				download()
+				downloadsActive.Add(-1)
+			}
+		}()
+	}
+}
+
+// queueDownload hands an automatic download to the download workers. Bursts of media wait in the
+// queue instead of each getting a goroutine; only when the queue itself is full does the caller
+// wait for a free spot.
+func queueDownload(messageID types.MessageID, download func()) {
+	if int(downloadsActive.Load()) >= downloadWorkers {
+		log.Printf("⏳ All %d download workers busy, queueing media of %s (%d waiting)", downloadWorkers, messageID, len(downloadQueue))
+	}
+	select {
+	case downloadQueue <- download:
+	default:
+		log.Printf("⏳ Download queue full with %d waiting, holding media of %s until a spot frees up", cap(downloadQueue), messageID)
+		downloadQueue <- download
+	}
+}
+
+// recordUpload and recordDownload keep the media bandwidth counters reported by /diagnostics
+func recordUpload(n int) {
+	bytesUploaded.Add(int64(n))
+	uploadCount.Add(1)
+}
+
+func recordDownload(n int) {
+	bytesDownloaded.Add(int64(n))
+	downloadCount.Add(1)
+}
+
 func downloadFile(url string) ([]byte, string, error) {
 	log.Printf("=== FILE DOWNLOAD START ===")
 	log.Printf("Downloading from URL: %s", url)
 
-	resp, err := http.Get(url)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		log.Printf("Invalid download URL: %v", err)
+		return nil, "", err
+	}
+	// Some hosts refuse Go's default client or need a token
+	downloadHeaders.Load().Apply(req)
+
+	resp, err := downloadClient.Do(req)
 	if err != nil {
 		log.Printf("HTTP GET request failed: %v", err)
 		return nil, "", err
@@ -948,6 +11859,7 @@ func downloadFile(url string) ([]byte, string, error) {
 		return nil, "", err
 	}
 
+	recordDownload(len(data))
 	log.Printf("Successfully downloaded %d bytes", len(data))
 
 	contentType := resp.Header.Get("Content-Type")
@@ -962,9 +11874,42 @@ func downloadFile(url string) ([]byte, string, error) {
 	return data, contentType, nil
 }
 
-func convertImageToJPEG(data []byte, contentType string) ([]byte, error) {
-	// If already JPEG, return as-is
-	if strings.Contains(contentType, "jpeg") || strings.Contains(contentType, "jpg") {
+// convertImageToSticker scales an image to fit a 512x512 canvas, pads the rest with transparency
+// to keep the aspect ratio, and encodes it as WebP
+func convertImageToSticker(data []byte) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return nil, fmt.Errorf("image has no pixels")
+	}
+
+	// Fit the longer side to the canvas and center the shorter one
+	width, height := stickerSize, stickerSize
+	if bounds.Dx() > bounds.Dy() {
+		height = max(1, bounds.Dy()*stickerSize/bounds.Dx())
+	} else {
+		width = max(1, bounds.Dx()*stickerSize/bounds.Dy())
+	}
+	offsetX, offsetY := (stickerSize-width)/2, (stickerSize-height)/2
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, stickerSize, stickerSize))
+	draw.CatmullRom.Scale(canvas, image.Rect(offsetX, offsetY, offsetX+width, offsetY+height), img, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	err = nativewebp.Encode(&buf, canvas, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode WebP: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func convertImageToJPEG(data []byte, contentType string, crop *ImageCrop) ([]byte, error) {
+	// If already JPEG, return as-is unless it has to be cropped
+	if (strings.Contains(contentType, "jpeg") || strings.Contains(contentType, "jpg")) && crop == nil {
 		return data, nil
 	}
 
@@ -986,62 +11931,352 @@ func convertImageToJPEG(data []byte, contentType string) ([]byte, error) {
 		return nil, fmt.Errorf("failed to decode image: %v", err)
 	}
 
-	// Check if image is valid before encoding
-	if img == nil {
-		return nil, fmt.Errorf("decoded image is nil")
+	// Check if image is valid before encoding
+	if img == nil {
+		return nil, fmt.Errorf("decoded image is nil")
+	}
+
+	if crop != nil {
+		region, err := crop.rect(img.Bounds())
+		if err != nil {
+			return nil, err
+		}
+		cropped := image.NewRGBA(image.Rect(0, 0, region.Dx(), region.Dy()))
+		draw.Draw(cropped, cropped.Bounds(), img, region.Min, draw.Src)
+		img = cropped
+		log.Printf("Image cropped to %dx%d at %d,%d", region.Dx(), region.Dy(), region.Min.X, region.Min.Y)
+	}
+
+	// Encode as JPEG
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode as JPEG: %v", err)
+	}
+
+	log.Printf("Successfully converted %s to JPEG", contentType)
+	return buf.Bytes(), nil
+}
+
+// transcodeMedia converts audio to OGG/Opus (playable as a voice note) and video to H.264/AAC MP4
+// using ffmpeg. It returns nil data when the input is already in the target format.
+func transcodeMedia(data []byte, contentType, mediaKind string) ([]byte, string, error) {
+	var outputExt, outputType string
+	var codecArgs []string
+	switch mediaKind {
+	case "audio":
+		if strings.Contains(contentType, "ogg") {
+			return nil, "", nil
+		}
+		outputExt, outputType = ".ogg", "audio/ogg; codecs=opus"
+		codecArgs = []string{"-vn", "-c:a", "libopus", "-b:a", "64k", "-ac", "1", "-ar", "48000"}
+	case "video":
+		outputExt, outputType = ".mp4", "video/mp4"
+		codecArgs = []string{"-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p", "-c:a", "aac", "-b:a", "128k", "-movflags", "+faststart"}
+	default:
+		return nil, "", nil
+	}
+
+	tempDir, err := os.MkdirTemp("", "wa-transcode-")
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	inputPath := filepath.Join(tempDir, "input")
+	outputPath := filepath.Join(tempDir, "output"+outputExt)
+	if err := os.WriteFile(inputPath, data, 0600); err != nil {
+		return nil, "", fmt.Errorf("failed to write temp input: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), transcodeTimeout)
+	defer cancel()
+
+	// An MP4 that already has H.264 video and AAC (or no) audio plays as is; re-encoding it only costs time and quality
+	if mediaKind == "video" && strings.Contains(contentType, "mp4") {
+		videoCodec, audioCodec, err := probeCodecs(ctx, inputPath)
+		if err != nil {
+			log.Printf("Could not probe video codecs, transcoding anyway: %v", err)
+		} else if videoCodec == "h264" && (audioCodec == "" || audioCodec == "aac") {
+			log.Printf("Video is already H.264/AAC MP4, sending it without transcoding")
+			return nil, "", nil
+		}
+	}
+
+	args := append([]string{"-y", "-hide_banner", "-loglevel", "error", "-i", inputPath}, codecArgs...)
+	args = append(args, outputPath)
+	output, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput()
+	if err != nil {
+		return nil, "", fmt.Errorf("ffmpeg failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	transcoded, err := os.ReadFile(outputPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read transcoded output: %v", err)
+	}
+	return transcoded, outputType, nil
+}
+
+// probeCodecs returns the codecs of the first video and audio stream of a media file, as reported
+// by ffprobe ("" when there is no such stream)
+func probeCodecs(ctx context.Context, path string) (string, string, error) {
+	output, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_entries", "stream=codec_type,codec_name", "-of", "compact=p=0", path).Output()
+	if err != nil {
+		return "", "", fmt.Errorf("ffprobe failed: %v", err)
+	}
+
+	var videoCodec, audioCodec string
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		// Lines look like codec_name=h264|codec_type=video
+		fields := make(map[string]string)
+		for _, field := range strings.Split(line, "|") {
+			if key, value, ok := strings.Cut(field, "="); ok {
+				fields[key] = value
+			}
+		}
+		switch fields["codec_type"] {
+		case "video":
+			if videoCodec == "" {
+				videoCodec = fields["codec_name"]
+			}
+		case "audio":
+			if audioCodec == "" {
+				audioCodec = fields["codec_name"]
+			}
+		}
+	}
+	return videoCodec, audioCodec, nil
+}
+
+// sendTypingIndicator shows "typing…" in the chat and returns a function that clears it again.
+// Callers must call the returned function once sending has finished or failed; as a safety net the
+// indicator is also cleared after typingTimeout.
+func sendTypingIndicator(targetJID types.JID) func() {
+	if !autoTyping.Load() {
+		return func() {}
+	}
+
+	// Only chats show typing; status updates, broadcast lists and newsletters don't
+	if kind := sendTargetKind(targetJID); kind != targetUser && kind != targetGroup {
+		return func() {}
+	}
+
+	// Send chat state (composing) to indicate typing
+	chatJID := targetJID.ToNonAD()
+	if chatJID.Server == "g.us" {
+		// For group chats, use the group JID directly
+		chatJID = targetJID
+	}
+
+	// Send composing presence
+	err := client.SendChatPresence(chatJID, types.ChatPresenceComposing, types.ChatPresenceMediaText)
+	if err != nil {
+		log.Printf("Failed to send typing indicator: %v", err)
+		return func() {}
+	}
+	log.Printf("Typing indicator sent to %s", chatJID.String())
+
+	var once sync.Once
+	clearTyping := func() {
+		once.Do(func() {
+			err := client.SendChatPresence(chatJID, types.ChatPresencePaused, types.ChatPresenceMediaText)
+			if err != nil {
+				log.Printf("Failed to clear typing indicator: %v", err)
+			}
+		})
+	}
+	timer := time.AfterFunc(typingTimeout, func() {
+		log.Printf("Typing indicator for %s timed out, clearing it", chatJID.String())
+		clearTyping()
+	})
+	return func() {
+		timer.Stop()
+		clearTyping()
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// errInvalidLocation is returned for a location attachment without valid coordinates
+var errInvalidLocation = errors.New("latitude (-90 to 90) and longitude (-180 to 180) are required")
+
+// buildLocationMessage builds a location pin from a location attachment
+func buildLocationMessage(attachment Attachment) (*waProto.Message, error) {
+	if attachment.Latitude == nil || attachment.Longitude == nil ||
+		*attachment.Latitude < -90 || *attachment.Latitude > 90 || *attachment.Longitude < -180 || *attachment.Longitude > 180 {
+		return nil, errInvalidLocation
+	}
+
+	location := &waProto.LocationMessage{
+		DegreesLatitude:  attachment.Latitude,
+		DegreesLongitude: attachment.Longitude,
+	}
+	if attachment.Name != "" {
+		location.Name = proto.String(attachment.Name)
+	}
+	if attachment.Address != "" {
+		location.Address = proto.String(attachment.Address)
+	}
+	log.Printf("Location attachment: %f, %f (%s)", *attachment.Latitude, *attachment.Longitude, attachment.Name)
+	return &waProto.Message{LocationMessage: location}, nil
+}
+
+// errMimeTypeMismatch is returned when an attachment's content doesn't match its declared type
+var errMimeTypeMismatch = errors.New("MIME_TYPE_MISMATCH")
+
+// attachmentContentTypes lists the content type prefixes accepted for each attachment type.
+// Audio also accepts the MP4/WebM/Ogg containers audio files are commonly detected as.
+var attachmentContentTypes = map[string][]string{
+	"image": {"image/"},
+	"audio": {"audio/", "application/ogg", "video/mp4", "video/webm"},
+	"video": {"video/"},
+}
+
+// checkAttachmentContentType verifies that a downloaded file matches the declared attachment type.
+// The type sniffed from the data is preferred over the server's Content-Type, which is often wrong or generic.
+// Documents accept any content.
+func checkAttachmentContentType(attachmentType, contentType string, data []byte) error {
+	allowed, ok := attachmentContentTypes[attachmentType]
+	if !ok {
+		return nil
+	}
+
+	resolved := http.DetectContentType(data)
+	if resolved == "application/octet-stream" || strings.HasPrefix(resolved, "text/plain") {
+		// Sniffing couldn't tell, so fall back to what the server said
+		resolved = contentType
+	}
+	resolved = strings.ToLower(strings.TrimSpace(strings.Split(resolved, ";")[0]))
+	if resolved == "" || resolved == "application/octet-stream" {
+		return nil
+	}
+
+	for _, prefix := range allowed {
+		if strings.HasPrefix(resolved, prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: attachment declared as %q but the URL returned %s; fix the type or set \"force\": true to send it anyway",
+		errMimeTypeMismatch, attachmentType, resolved)
+}
+
+// documentContentType returns the mimetype to send a document with. The server's Content-Type is kept
+// unless it is missing or generic, in which case the type sniffed from the data is used.
+func documentContentType(contentType string, data []byte) string {
+	contentType = strings.TrimSpace(contentType)
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if mediaType == "" || mediaType == "application/octet-stream" || mediaType == "binary/octet-stream" {
+		if sniffed := http.DetectContentType(data); sniffed != "application/octet-stream" {
+			return sniffed
+		}
+		return "application/octet-stream"
+	}
+	return contentType
+}
+
+// documentFilename returns the file name shown to the recipient: the requested one, otherwise the
+// last segment of the attachment URL, otherwise "document" with an extension matching contentType
+func documentFilename(attachment Attachment, contentType string) string {
+	if attachment.Filename != "" {
+		return attachment.Filename
 	}
 
-	// Encode as JPEG
-	var buf bytes.Buffer
-	err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
-	if err != nil {
-		return nil, fmt.Errorf("failed to encode as JPEG: %v", err)
+	if u, err := url.Parse(attachment.URL); err == nil {
+		if name, err := url.PathUnescape(path.Base(u.Path)); err == nil && path.Ext(name) != "" {
+			return name
+		}
 	}
 
-	log.Printf("Successfully converted %s to JPEG", contentType)
-	return buf.Bytes(), nil
+	if ext := mimeExtension(contentType); ext != "" {
+		return "document." + ext
+	}
+	return "document"
 }
 
-func sendTypingIndicator(targetJID types.JID) {
-	// Send chat state (composing) to indicate typing
-	chatJID := targetJID.ToNonAD()
-	if chatJID.Server == "g.us" {
-		// For group chats, use the group JID directly
-		chatJID = targetJID
+// decodeDataURI decodes an inline attachment such as data:image/png;base64,iVBOR... and returns its
+// bytes with the declared MIME type, or the detected one when the URI doesn't declare any
+func decodeDataURI(uri string) ([]byte, string, error) {
+	header, payload, found := strings.Cut(strings.TrimPrefix(uri, "data:"), ",")
+	if !found {
+		return nil, "", fmt.Errorf("invalid data URI: missing comma")
 	}
 
-	// Send composing presence
-	err := client.SendChatPresence(chatJID, types.ChatPresenceComposing, types.ChatPresenceMediaText)
-	if err != nil {
-		log.Printf("Failed to send typing indicator: %v", err)
+	var data []byte
+	var err error
+	mediaType, isBase64 := strings.CutSuffix(header, ";base64")
+	if isBase64 {
+		data, err = decodeBase64(payload)
 	} else {
-		log.Printf("Typing indicator sent to %s", chatJID.String())
+		var unescaped string
+		unescaped, err = url.PathUnescape(payload)
+		data = []byte(unescaped)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid data URI: %v", err)
+	}
+
+	contentType, _, _ := mime.ParseMediaType(mediaType)
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
 	}
+	return data, contentType, nil
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
+// decodeBase64 decodes standard or URL-safe base64, with or without padding and line breaks
+func decodeBase64(encoded string) ([]byte, error) {
+	encoded = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' || r == ' ' {
+			return -1
+		}
+		return r
+	}, encoded)
+	encoded = strings.TrimRight(encoded, "=")
+	if strings.ContainsAny(encoded, "-_") {
+		return base64.RawURLEncoding.DecodeString(encoded)
 	}
-	return b
+	return base64.RawStdEncoding.DecodeString(encoded)
 }
 
-func prepareAttachmentMessage(attachment Attachment, targetJID types.JID) (*waProto.Message, error) {
+func prepareAttachmentMessage(c *whatsmeow.Client, attachment Attachment, targetJID types.JID) (*waProto.Message, error) {
 	log.Printf("=== ATTACHMENT PREPARATION ===")
 	log.Printf("Attachment Type: %s", attachment.Type)
-	log.Printf("Attachment URL: %s", attachment.URL)
+	if attachment.Type == "location" {
+		return buildLocationMessage(attachment)
+	}
+	if strings.HasPrefix(attachment.URL, "http") {
+		log.Printf("Attachment URL: %s", attachment.URL)
+	} else {
+		log.Printf("Attachment URL: inline data (%d characters)", len(attachment.URL))
+	}
 	log.Printf("Attachment Caption: %s", attachment.Caption)
 	log.Printf("Attachment Filename: %s", attachment.Filename)
 	log.Printf("Target JID: %s", targetJID.String())
 
+	if attachment.Crop != nil && attachment.Type != "image" {
+		return nil, fmt.Errorf("crop is only supported for image attachments")
+	}
+
 	var data []byte
 	var contentType string
 	var err error
 
-	if strings.HasPrefix(attachment.URL, "http") {
+	switch {
+	case strings.HasPrefix(attachment.URL, "data:"):
+		data, contentType, err = decodeDataURI(attachment.URL)
+	case attachment.Encoding == "base64":
+		data, err = decodeBase64(attachment.URL)
+		contentType = http.DetectContentType(data)
+	case attachment.Encoding != "":
+		return nil, fmt.Errorf("unsupported attachment encoding %q, only base64 is supported", attachment.Encoding)
+	case strings.HasPrefix(attachment.URL, "http"):
 		data, contentType, err = downloadFile(attachment.URL)
-	} else {
-		return nil, fmt.Errorf("attachment URL must be a publicly accessible HTTP/HTTPS link, not base64 data. Found: %s", attachment.URL[:min(50, len(attachment.URL))])
+	default:
+		return nil, fmt.Errorf("attachment URL must be an HTTP/HTTPS link, a data: URI, or base64 data with \"encoding\": \"base64\". Found: %s", attachment.URL[:min(50, len(attachment.URL))])
 	}
 
 	if err != nil {
@@ -1051,10 +12286,27 @@ func prepareAttachmentMessage(attachment Attachment, targetJID types.JID) (*waPr
 
 	log.Printf("Attachment loaded successfully: %d bytes, content type: %s", len(data), contentType)
 
+	// Catch e.g. a PDF sent as an image before it fails somewhere in conversion or upload
+	if !attachment.Force {
+		err = checkAttachmentContentType(attachment.Type, contentType, data)
+		if err != nil {
+			log.Printf("Attachment content type check failed: %v", err)
+			return nil, err
+		}
+	}
+
+	// Documents are sent byte for byte, so an image sent as a document keeps its full resolution
+	if attachment.Type == "document" {
+		contentType = documentContentType(contentType, data)
+		if strings.HasPrefix(contentType, "image/") {
+			log.Printf("Sending %s as a document without recompressing it", contentType)
+		}
+	}
+
 	// Convert image to JPEG if needed
 	if attachment.Type == "image" {
 		log.Printf("Converting image to JPEG...")
-		data, err = convertImageToJPEG(data, contentType)
+		data, err = convertImageToJPEG(data, contentType, attachment.Crop)
 		if err != nil {
 			log.Printf("Failed to convert image: %v", err)
 			return nil, fmt.Errorf("failed to convert image: %v", err)
@@ -1063,6 +12315,18 @@ func prepareAttachmentMessage(attachment Attachment, targetJID types.JID) (*waPr
 		log.Printf("Image converted to JPEG successfully")
 	}
 
+	// Transcode audio/video to WhatsApp-friendly codecs when enabled, keeping the original on failure
+	if transcodeEnabled && (attachment.Type == "audio" || attachment.Type == "video") {
+		transcoded, transcodedType, err := transcodeMedia(data, contentType, attachment.Type)
+		if err != nil {
+			log.Printf("Transcoding failed, sending original %s: %v", attachment.Type, err)
+		} else if transcoded != nil {
+			log.Printf("Transcoded %s from %s (%d bytes) to %s (%d bytes)", attachment.Type, contentType, len(data), transcodedType, len(transcoded))
+			data = transcoded
+			contentType = transcodedType
+		}
+	}
+
 	var mediaType whatsmeow.MediaType
 	switch attachment.Type {
 	case "image":
@@ -1078,12 +12342,13 @@ func prepareAttachmentMessage(attachment Attachment, targetJID types.JID) (*waPr
 	}
 
 	log.Printf("Uploading attachment to WhatsApp servers...")
-	uploaded, err := client.Upload(context.Background(), data, mediaType)
+	uploaded, err := c.Upload(context.Background(), data, mediaType)
 	if err != nil {
 		log.Printf("Failed to upload attachment: %v", err)
 		return nil, fmt.Errorf("failed to upload attachment: %v", err)
 	}
 
+	recordUpload(len(data))
 	log.Printf("Attachment uploaded successfully")
 	log.Printf("Upload URL: %s", uploaded.URL)
 	log.Printf("Direct Path: %s", uploaded.DirectPath)
@@ -1105,10 +12370,7 @@ func prepareAttachmentMessage(attachment Attachment, targetJID types.JID) (*waPr
 		}
 		log.Printf("Image message prepared successfully")
 	case "document":
-		filename := attachment.Filename
-		if filename == "" {
-			filename = "document"
-		}
+		filename := documentFilename(attachment, contentType)
 		message = &waProto.Message{
 			DocumentMessage: &waProto.DocumentMessage{
 				URL:           &uploaded.URL,
@@ -1160,24 +12422,30 @@ func prepareAttachmentMessage(attachment Attachment, targetJID types.JID) (*waPr
 }
 
 func sendToWebhook(event, message, sender, chat string, attachment map[string]interface{}) {
-	log.Printf("=== WEBHOOK SENDING ===")
-	log.Printf("Event: %s", event)
-	log.Printf("Sender: %s", sender)
-	log.Printf("Chat: %s", chat)
-	log.Printf("Message: %s", message)
-	log.Printf("Webhook URL: %s", webhookURL)
-
-	if attachment != nil {
-		log.Printf("Attachment: %+v", attachment)
-	}
-
-	payload := WebhookPayload{
+	postWebhook(WebhookPayload{
 		Event:      event,
 		Message:    message,
 		Sender:     sender,
 		Chat:       chat,
 		Time:       time.Now(),
 		Attachment: attachment,
+	})
+}
+
+// postWebhook delivers a prepared payload to the webhook URL
+func postWebhook(payload WebhookPayload) {
+	log.Printf("=== WEBHOOK SENDING ===")
+	log.Printf("Event: %s", payload.Event)
+	log.Printf("Sender: %s", payload.Sender)
+	log.Printf("Chat: %s", payload.Chat)
+	log.Printf("Message: %s", payload.Message)
+	log.Printf("Webhook URL: %s", webhookURL)
+
+	if payload.Attachment != nil {
+		log.Printf("Attachment: %+v", payload.Attachment)
+	}
+	if payload.VerifiedName != "" {
+		log.Printf("Verified business: %s", payload.VerifiedName)
 	}
 
 	jsonData, err := json.Marshal(payload)
@@ -1187,22 +12455,431 @@ func sendToWebhook(event, message, sender, chat string, attachment map[string]in
 	}
 
 	log.Printf("Webhook payload size: %d bytes", len(jsonData))
+	if webhookMaxPayload > 0 && len(jsonData) > webhookMaxPayload {
+		jsonData = shrinkWebhookPayload(payload, jsonData)
+	}
 	log.Printf("Sending webhook request...")
 
-	resp, err := http.Post(webhookURL, "application/json", bytes.NewBuffer(jsonData))
+	retryable, err := deliverWebhook(jsonData)
 	if err != nil {
 		log.Printf("Failed to send webhook: %v", err)
+		if policy := webhookRetries.Policy(payload.Event); retryable && policy.MaxRetries > 0 {
+			go retryWebhook(payload.Event, jsonData, policy)
+		} else {
+			recordDeadLetter(payload.Event, jsonData, err, 1)
+		}
+	} else {
+		log.Printf("Webhook sent successfully to %s", webhookURL)
+	}
+	log.Printf("=== WEBHOOK COMPLETE ===")
+}
+
+// oversizedPayload is the full body of a webhook that was sent with fields left out
+type oversizedPayload struct {
+	data    []byte
+	expires time.Time
+}
+
+// shrinkWebhookPayload leaves the largest fields out of a payload over WA_WEBHOOK_MAX_PAYLOAD,
+// biggest first, until it fits. Omitted fields are listed in the attachment together with the URL
+// that serves the full payload. A payload without fields large enough to leave out is sent as is.
+func shrinkWebhookPayload(payload WebhookPayload, full []byte) []byte {
+	// Work on a copy so the caller's attachment map is left alone
+	attachment := make(map[string]interface{}, len(payload.Attachment)+2)
+	for key, value := range payload.Attachment {
+		attachment[key] = value
+	}
+	type field struct {
+		name string
+		size int
+	}
+	var fields []field
+	for key, value := range attachment {
+		if encoded, err := json.Marshal(value); err == nil && len(encoded) > minOmittedFieldSize {
+			fields = append(fields, field{key, len(encoded)})
+		}
+	}
+	if len(payload.Message) > minOmittedFieldSize {
+		fields = append(fields, field{"message", len(payload.Message)})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].size > fields[j].size })
+	if len(fields) == 0 {
+		log.Printf("Webhook payload of %d bytes exceeds WA_WEBHOOK_MAX_PAYLOAD (%d) but has no field large enough to leave out, sending it whole",
+			len(full), webhookMaxPayload)
+		return full
+	}
+
+	random := make([]byte, 8)
+	rand.Read(random)
+	id := hex.EncodeToString(random)
+	fullURL := publicURL + "/webhook/payloads/" + id
+
+	var omitted []string
+	attachment["full_payload_url"] = fullURL
+	shrunk := full
+	for _, f := range fields {
+		if f.name == "message" {
+			payload.Message = ""
+		} else {
+			delete(attachment, f.name)
+		}
+		omitted = append(omitted, f.name)
+		attachment["omitted_fields"] = omitted
+		payload.Attachment = attachment
+
+		data, err := json.Marshal(payload)
+		if err != nil {
+			break
+		}
+		shrunk = data
+		if len(shrunk) <= webhookMaxPayload {
+			break
+		}
+	}
+
+	stashOversizedPayload(id, full)
+	log.Printf("✂️ Webhook payload of %d bytes exceeds WA_WEBHOOK_MAX_PAYLOAD (%d), omitted %v (now %d bytes); full payload at %s",
+		len(full), webhookMaxPayload, omitted, len(shrunk), fullURL)
+	return shrunk
+}
+
+// stashOversizedPayload keeps the full body of a shrunk webhook for oversizedPayloadTTL, dropping
+// expired ones and, beyond maxOversizedPayloads, the one that would expire first
+func stashOversizedPayload(id string, full []byte) {
+	oversizedPayloadsMu.Lock()
+	defer oversizedPayloadsMu.Unlock()
+
+	now := time.Now()
+	oldest := ""
+	for key, stashed := range oversizedPayloads {
+		if now.After(stashed.expires) {
+			delete(oversizedPayloads, key)
+		} else if oldest == "" || stashed.expires.Before(oversizedPayloads[oldest].expires) {
+			oldest = key
+		}
+	}
+	if len(oversizedPayloads) >= maxOversizedPayloads && oldest != "" {
+		delete(oversizedPayloads, oldest)
+	}
+	oversizedPayloads[id] = oversizedPayload{data: full, expires: now.Add(oversizedPayloadTTL)}
+}
+
+// /webhook/payloads/{id} endpoint - the full body of a webhook that was sent with fields left out
+func oversizedPayloadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	oversizedPayloadsMu.Lock()
+	stashed, ok := oversizedPayloads[mux.Vars(r)["id"]]
+	oversizedPayloadsMu.Unlock()
+	if !ok || time.Now().After(stashed.expires) {
+		response := APIResponse{
+			Success: false,
+			Message: "Payload not found or expired",
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
 		return
 	}
+	w.Write(stashed.data)
+}
+
+// deliverWebhook posts a webhook body once. retryable reports whether a failure is worth retrying:
+// network errors, timeouts, rate limiting and server errors are, other rejections are not.
+func deliverWebhook(jsonData []byte) (retryable bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, webhookURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return false, fmt.Errorf("failed to create webhook request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if signature := webhookSecret.Sign(jsonData); signature != "" {
+		req.Header.Set("X-Webhook-Signature", signature)
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
 	defer resp.Body.Close()
+	// Drain the body so the connection can be reused
+	io.Copy(io.Discard, resp.Body)
 
 	log.Printf("Webhook response status: %d", resp.StatusCode)
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		log.Printf("Webhook sent successfully to %s", webhookURL)
+		return false, nil
+	}
+	retryable = resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return retryable, fmt.Errorf("webhook request failed with status: %d", resp.StatusCode)
+}
+
+// retryWebhook redelivers a failed webhook following policy, doubling the wait after every attempt
+func retryWebhook(event string, jsonData []byte, policy webhookRetryPolicy) {
+	backoff := time.Duration(policy.BackoffSeconds * float64(time.Second))
+	var err error
+	for attempt := 1; attempt <= policy.MaxRetries; attempt++ {
+		// Half of each wait is random, so a receiver coming back from an outage isn't hit by every retry at once
+		wait := backoff / 2
+		if wait > 0 {
+			wait += mathrand.N(wait)
+		}
+		time.Sleep(wait)
+		backoff *= 2
+
+		var retryable bool
+		retryable, err = deliverWebhook(jsonData)
+		if err == nil {
+			log.Printf("Webhook %s delivered on retry %d", event, attempt)
+			return
+		}
+		log.Printf("Webhook %s retry %d/%d failed: %v", event, attempt, policy.MaxRetries, err)
+		if !retryable {
+			recordDeadLetter(event, jsonData, err, attempt+1)
+			return
+		}
+	}
+	log.Printf("❌ Giving up on webhook %s after %d retries", event, policy.MaxRetries)
+	recordDeadLetter(event, jsonData, err, policy.MaxRetries+1)
+}
+
+// recordDeadLetter keeps a webhook that could not be delivered so it can be replayed later
+func recordDeadLetter(event string, jsonData []byte, deliveryErr error, attempts int) {
+	_, err := db.Exec(`INSERT INTO webhook_dead_letters (event, payload, error, attempts) VALUES ($1, $2, $3, $4)`,
+		event, jsonData, deliveryErr.Error(), attempts)
+	if err != nil {
+		log.Printf("Failed to keep undelivered webhook %s: %v", event, err)
+		return
+	}
+	log.Printf("📥 Webhook %s kept as dead letter after %d attempt(s)", event, attempts)
+
+	// A receiver that stays down for long mustn't fill the database
+	result, err := db.Exec(`DELETE FROM webhook_dead_letters WHERE id <= (
+		SELECT id FROM webhook_dead_letters ORDER BY id DESC OFFSET $1 LIMIT 1)`, maxDeadLetters)
+	if err != nil {
+		log.Printf("Failed to trim dead letters: %v", err)
+	} else if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("⚠️ More than %d dead letters, dropped the %d oldest", maxDeadLetters, n)
+	}
+}
+
+// /webhook/dead-letters endpoint - list webhooks that could not be delivered, oldest first
+func deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit, err := parseCountParam(r, "limit", 100, 1000)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: err.Error(),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var total int
+	err = db.QueryRow(`SELECT COUNT(*) FROM webhook_dead_letters`).Scan(&total)
+	var letters []WebhookDeadLetter
+	if err == nil {
+		letters, err = queryDeadLetters(`SELECT id, event, payload, error, attempts, failed_at
+			FROM webhook_dead_letters ORDER BY id LIMIT $1`, limit)
+	}
+	if err != nil {
+		log.Printf("Failed to list dead letters: %v", err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to list dead letters: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("%d undelivered webhook(s)", total),
+		Data: map[string]interface{}{
+			"total":        total,
+			"dead_letters": letters,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /webhook/dead-letters/replay endpoint - deliver kept webhooks again, oldest first and up to limit per
+// request; delivered ones are removed
+func replayDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit, err := parseCountParam(r, "limit", defaultDeadLetterReplay, maxDeadLetterReplay)
+	// A batch continues after the last ID of the previous one, so letters failing again don't block the rest
+	var after int64
+	if err == nil && r.URL.Query().Get("after") != "" {
+		after, err = strconv.ParseInt(r.URL.Query().Get("after"), 10, 64)
+		if err != nil {
+			err = fmt.Errorf("after must be a dead letter ID")
+		}
+	}
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: err.Error(),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if webhookURL == "" {
+		response := APIResponse{
+			Success: false,
+			Message: "No webhook URL configured",
+		}
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Without ids the oldest dead letters are replayed
+	var req struct {
+		IDs []int64 `json:"ids"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			response := APIResponse{
+				Success: false,
+				Message: "Invalid request body",
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+
+	var letters []WebhookDeadLetter
+	if len(req.IDs) > 0 {
+		letters, err = queryDeadLetters(`SELECT id, event, payload, error, attempts, failed_at
+			FROM webhook_dead_letters WHERE id = ANY($1) AND id > $2 ORDER BY id LIMIT $3`, pq.Array(req.IDs), after, limit)
 	} else {
-		log.Printf("Webhook request failed with status: %d", resp.StatusCode)
+		letters, err = queryDeadLetters(`SELECT id, event, payload, error, attempts, failed_at
+			FROM webhook_dead_letters WHERE id > $1 ORDER BY id LIMIT $2`, after, limit)
 	}
-	log.Printf("=== WEBHOOK COMPLETE ===")
+	if err != nil {
+		log.Printf("Failed to load dead letters: %v", err)
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to load dead letters: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	results := make([]map[string]interface{}, 0, len(letters))
+	delivered := 0
+	for _, letter := range letters {
+		result := map[string]interface{}{"id": letter.ID, "event": letter.Event}
+		_, err := deliverWebhook(letter.Payload)
+		if err != nil {
+			result["delivered"] = false
+			result["error"] = err.Error()
+			_, dbErr := db.Exec(`UPDATE webhook_dead_letters SET error = $2, attempts = attempts + 1, failed_at = NOW() WHERE id = $1`,
+				letter.ID, err.Error())
+			if dbErr != nil {
+				log.Printf("Failed to update dead letter %d: %v", letter.ID, dbErr)
+			}
+		} else {
+			result["delivered"] = true
+			delivered++
+			if _, dbErr := db.Exec(`DELETE FROM webhook_dead_letters WHERE id = $1`, letter.ID); dbErr != nil {
+				log.Printf("Failed to remove replayed dead letter %d: %v", letter.ID, dbErr)
+			}
+		}
+		results = append(results, result)
+	}
+	// Dead letters after this batch that haven't been tried yet
+	if len(letters) > 0 {
+		after = letters[len(letters)-1].ID
+	}
+	var remaining int
+	if len(req.IDs) > 0 {
+		err = db.QueryRow(`SELECT COUNT(*) FROM webhook_dead_letters WHERE id = ANY($1) AND id > $2`, pq.Array(req.IDs), after).Scan(&remaining)
+	} else {
+		err = db.QueryRow(`SELECT COUNT(*) FROM webhook_dead_letters WHERE id > $1`, after).Scan(&remaining)
+	}
+	if err != nil {
+		log.Printf("Failed to count dead letters: %v", err)
+	}
+	log.Printf("Replayed %d dead letter(s): %d delivered, %d remaining", len(letters), delivered, remaining)
+
+	data := map[string]interface{}{
+		"delivered": delivered,
+		"failed":    len(letters) - delivered,
+		"remaining": remaining,
+		"results":   results,
+	}
+	if remaining > 0 {
+		data["next_after"] = after
+	}
+	response := APIResponse{
+		Success: delivered == len(letters),
+		Message: fmt.Sprintf("Delivered %d of %d dead letter(s)", delivered, len(letters)),
+		Data:    data,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// /webhook/dead-letters/{id} endpoint - discard a dead letter without delivering it
+func deleteDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	var result sql.Result
+	if err == nil {
+		result, err = db.Exec(`DELETE FROM webhook_dead_letters WHERE id = $1`, id)
+	}
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to delete dead letter: %v", err),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		response := APIResponse{
+			Success: false,
+			Message: "Dead letter not found",
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "Dead letter deleted",
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func queryDeadLetters(query string, args ...interface{}) ([]WebhookDeadLetter, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := []WebhookDeadLetter{}
+	for rows.Next() {
+		var letter WebhookDeadLetter
+		var payload []byte
+		if err := rows.Scan(&letter.ID, &letter.Event, &payload, &letter.Error, &letter.Attempts, &letter.FailedAt); err != nil {
+			return nil, err
+		}
+		letter.Payload = payload
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
 }
 
 func main() {
@@ -1211,14 +12888,83 @@ func main() {
 
 	// Create router
 	r := mux.NewRouter()
+	r.Use(apiKeyMiddleware)
 
 	// API endpoints
 	r.HandleFunc("/pair", pairHandler).Methods("GET")
-	r.HandleFunc("/send", sendHandler).Methods("POST")
+	r.HandleFunc("/send", refuseDuringCooldown(sendHandler)).Methods("POST")
+	r.HandleFunc("/send-bulk", refuseDuringCooldown(sendBulkHandler)).Methods("POST")
+	r.HandleFunc("/send-album", refuseDuringCooldown(sendAlbumHandler)).Methods("POST")
+	r.HandleFunc("/send-sticker", refuseDuringCooldown(sendStickerHandler)).Methods("POST")
+	r.HandleFunc("/send-contact", refuseDuringCooldown(sendContactHandler)).Methods("POST")
+	r.HandleFunc("/send-if-active", refuseDuringCooldown(sendIfActiveHandler)).Methods("POST")
+	r.HandleFunc("/test-send", refuseDuringCooldown(testSendHandler)).Methods("POST")
+	r.HandleFunc("/react", refuseDuringCooldown(reactHandler)).Methods("POST")
+	r.HandleFunc("/request-location", refuseDuringCooldown(requestLocationHandler)).Methods("POST")
+	r.HandleFunc("/client-messages/{id}", clientMessageHandler).Methods("GET")
+	r.HandleFunc("/message-status/{id}", messageStatusHandler).Methods("GET")
 	r.HandleFunc("/health", healthHandler).Methods("GET")
+	r.HandleFunc("/version", versionHandler).Methods("GET")
+	r.HandleFunc("/capabilities", capabilitiesHandler).Methods("GET")
+	r.HandleFunc("/webhook/schema", webhookSchemaHandler).Methods("GET")
+	r.HandleFunc("/webhook/payloads/{id}", oversizedPayloadHandler).Methods("GET")
+	r.HandleFunc("/webhook/dead-letters", deadLettersHandler).Methods("GET")
+	r.HandleFunc("/webhook/dead-letters/replay", replayDeadLettersHandler).Methods("POST")
+	r.HandleFunc("/webhook/dead-letters/{id}", deleteDeadLetterHandler).Methods("DELETE")
 	r.HandleFunc("/devices", devicesHandler).Methods("GET")
+	r.HandleFunc("/diagnostics", diagnosticsHandler).Methods("GET")
+	r.HandleFunc("/account", accountHandler).Methods("GET")
 	r.HandleFunc("/disconnect", disconnectHandler).Methods("POST")
+	r.HandleFunc("/accounts", accountsHandler).Methods("GET")
+	r.HandleFunc("/accounts/{id}/pair", accountPairHandler).Methods("GET")
+	r.HandleFunc("/accounts/{id}/send", accountSendHandler).Methods("POST")
+	r.HandleFunc("/accounts/{id}/devices", accountDevicesHandler).Methods("GET")
+	r.HandleFunc("/accounts/{id}/disconnect", accountDisconnectHandler).Methods("POST")
+	r.HandleFunc("/reconnect", refuseDuringCooldown(reconnectHandler)).Methods("POST")
 	r.HandleFunc("/images/{filename}", imageHandler).Methods("GET")
+	r.HandleFunc("/contacts/import", importContactsHandler).Methods("POST")
+	r.HandleFunc("/send-payment-request", refuseDuringCooldown(sendPaymentRequestHandler)).Methods("POST")
+	r.HandleFunc("/config", configHandler).Methods("GET")
+	r.HandleFunc("/config/rate-limit", rateLimitConfigHandler).Methods("GET", "POST")
+	r.HandleFunc("/config/auto-read", autoReadConfigHandler).Methods("GET", "POST")
+	r.HandleFunc("/config/store-outgoing", storeOutgoingConfigHandler).Methods("GET", "POST")
+	r.HandleFunc("/config/message-footer", messageFooterConfigHandler).Methods("GET", "POST")
+	r.HandleFunc("/config/download-headers", downloadHeadersConfigHandler).Methods("GET", "POST")
+	r.HandleFunc("/config/auto-download", autoDownloadConfigHandler).Methods("GET", "POST")
+	r.HandleFunc("/config/presence", presenceConfigHandler).Methods("GET", "POST")
+	r.HandleFunc("/config/webhook-secret", webhookSecretConfigHandler).Methods("GET", "POST")
+	r.HandleFunc("/config/webhook-retry", webhookRetryConfigHandler).Methods("GET", "POST")
+	r.HandleFunc("/messages", messagesHandler).Methods("GET")
+	r.HandleFunc("/message/{chat}/{id}/context", messageContextHandler).Methods("GET")
+	r.HandleFunc("/templates", templatesHandler).Methods("GET", "POST")
+	r.HandleFunc("/templates/{name}", templateHandler).Methods("GET", "DELETE")
+	r.HandleFunc("/receipt-rules", receiptRulesHandler).Methods("GET", "POST")
+	r.HandleFunc("/receipt-rules/{chat}", receiptRuleHandler).Methods("DELETE")
+	r.HandleFunc("/filter-rules", filterRulesHandler).Methods("GET", "POST")
+	r.HandleFunc("/filter-rules/{id}", filterRuleHandler).Methods("DELETE")
+	r.HandleFunc("/send-template", refuseDuringCooldown(sendTemplateHandler)).Methods("POST")
+	r.HandleFunc("/keep-message", refuseDuringCooldown(keepMessageHandler)).Methods("POST")
+	r.HandleFunc("/mark-read-before", refuseDuringCooldown(markReadBeforeHandler)).Methods("POST")
+	r.HandleFunc("/star-message", starMessageHandler).Methods("POST")
+	r.HandleFunc("/delete", refuseDuringCooldown(deleteMessageHandler)).Methods("POST")
+	r.HandleFunc("/edit", refuseDuringCooldown(editMessageHandler)).Methods("POST")
+	r.HandleFunc("/dedup/stats", dedupStatsHandler).Methods("GET")
+	r.HandleFunc("/dedup/clear", dedupClearHandler).Methods("POST")
+	r.HandleFunc("/groups", groupsHandler).Methods("GET")
+	r.HandleFunc("/groups/{jid}", groupInfoHandler).Methods("GET")
+	r.HandleFunc("/groups/{jid}/picture", groupPictureHandler).Methods("GET")
+	r.HandleFunc("/newsletter/{jid}/metrics", newsletterMetricsHandler).Methods("GET")
+	r.HandleFunc("/groups/{jid}/broadcast-location", refuseDuringCooldown(broadcastLocationHandler)).Methods("POST")
+	r.HandleFunc("/group/{jid}/broadcast-location", refuseDuringCooldown(broadcastLocationHandler)).Methods("POST") // singular alias
+	r.HandleFunc("/groups/{jid}/join-requests", groupJoinRequestsHandler).Methods("GET", "POST")
+	r.HandleFunc("/groups/{jid}/add-from-vcard", groupAddFromVCardHandler).Methods("POST")
+	r.HandleFunc("/forward", refuseDuringCooldown(forwardHandler)).Methods("POST")
+	r.HandleFunc("/chats/{jid}/download-media", chatDownloadMediaHandler).Methods("POST")
+	r.HandleFunc("/jobs/{id}", jobStatusHandler).Methods("GET")
+	r.HandleFunc("/media/export", mediaExportHandler).Methods("GET")
+	r.HandleFunc("/media/reindex", mediaReindexHandler).Methods("POST")
+	r.HandleFunc("/media/{filename}", imageHandler).Methods("GET")
+	r.HandleFunc("/stats", statsHandler).Methods("GET")
 
 	// Serve Swagger documentation
 	r.HandleFunc("/swagger", swaggerHandler).Methods("GET")
@@ -1232,12 +12978,80 @@ func main() {
 
 	log.Printf("Starting WhatsApp Web API server on port %s", port)
 	log.Printf("Available endpoints:")
-	log.Printf("  GET  /pair      - Generate QR code for pairing")
+	log.Printf("  GET  /pair      - Generate QR code for pairing (?method=code&number=... for a pairing code)")
 	log.Printf("  POST /send      - Send message with attachments (requires pairing)")
+	log.Printf("  POST /send-bulk - Send a message to many numbers, once per WhatsApp account")
+	log.Printf("  POST /send-album - Send images and videos as one album")
+	log.Printf("  POST /send-sticker - Send an image as a sticker")
+	log.Printf("  POST /send-contact - Share a contact card, optionally validated against WhatsApp")
+	log.Printf("  POST /send-if-active - Send a text only if the contact was online recently")
+	log.Printf("  POST /test-send - Send a test message to your own number")
+	log.Printf("  POST /react - React to a message with an emoji")
+	log.Printf("  POST /request-location - Ask a contact to share their location")
+	log.Printf("  GET  /client-messages/{id} - Look up WhatsApp message IDs for a client_message_id")
+	log.Printf("  GET  /message-status/{id} - Delivery/read status of a sent message (?detailed=true for who read it)")
 	log.Printf("  GET  /health    - Check service status")
+	log.Printf("  GET  /version   - Build details and uptime")
+	log.Printf("  GET  /capabilities - Optional features supported by this build and configuration")
+	log.Printf("  GET  /webhook/schema - JSON schema of webhook payloads with an example per event")
+	log.Printf("  GET  /webhook/payloads/{id} - Full body of a webhook that exceeded WA_WEBHOOK_MAX_PAYLOAD")
+	log.Printf("  GET  /webhook/dead-letters - List webhooks that could not be delivered")
+	log.Printf("  POST /webhook/dead-letters/replay - Deliver undelivered webhooks again")
+	log.Printf("  DELETE /webhook/dead-letters/{id} - Discard an undelivered webhook")
 	log.Printf("  GET  /devices   - Get device information")
+	log.Printf("  GET  /diagnostics - Get runtime diagnostics and media bandwidth stats")
+	log.Printf("  GET  /account   - Get linked account phone number details")
 	log.Printf("  POST /disconnect - Disconnect and clear session")
+	log.Printf("  GET /accounts - List the default and additional accounts")
+	log.Printf("  GET /accounts/{id}/pair - Link an additional account by QR code (?force=true to replace a working session)")
+	log.Printf("  POST /accounts/{id}/send - Send a message with attachments from an additional account")
+	log.Printf("  GET /accounts/{id}/devices - Device information of an additional account")
+	log.Printf("  POST /accounts/{id}/disconnect - Unlink an additional account")
+	log.Printf("  POST /reconnect - Reconnect the existing session without clearing it")
 	log.Printf("  GET  /images/{filename} - Serve downloaded images")
+	log.Printf("  GET  /media/{filename} - Serve downloaded videos, audio and documents")
+	log.Printf("  POST /contacts/import - Import vCard contacts into the local contacts table")
+	log.Printf("  POST /send-payment-request - Send a payment request (India/Brazil accounts only)")
+	log.Printf("  GET  /config    - View the effective configuration (secrets redacted)")
+	log.Printf("  GET/POST /config/rate-limit - View or update the send rate limit")
+	log.Printf("  GET/POST /config/auto-read - View or toggle automatic read receipts")
+	log.Printf("  GET/POST /config/store-outgoing - View or toggle storing sent messages")
+	log.Printf("  GET/POST /config/message-footer - View or change the footer added to outgoing messages")
+	log.Printf("  GET/POST /config/download-headers - View or change the User-Agent and headers used to fetch attachments")
+	log.Printf("  GET/POST /config/auto-download - View or change automatic media downloads and their size limit")
+	log.Printf("  GET/POST /config/presence - View or change the presence announced after connecting")
+	log.Printf("  GET/POST /config/webhook-secret - View webhook signing status or rotate the signing secret")
+	log.Printf("  GET/POST /config/webhook-retry - View or change webhook retry policies per event type")
+	log.Printf("  GET  /messages  - Page through the stored messages of a chat")
+	log.Printf("  GET  /message/{chat}/{id}/context - Get stored messages around a message")
+	log.Printf("  GET/POST /templates - List or save message templates")
+	log.Printf("  GET/DELETE /templates/{name} - Get or delete a message template")
+	log.Printf("  GET/POST /receipt-rules - List or set per-chat read receipt rules")
+	log.Printf("  DELETE /receipt-rules/{chat} - Remove a chat's read receipt rule")
+	log.Printf("  GET/POST /filter-rules - List or add spam filter rules")
+	log.Printf("  DELETE /filter-rules/{id} - Remove a spam filter rule")
+	log.Printf("  POST /send-template - Render a template with variables and send it")
+	log.Printf("  POST /keep-message - Keep a disappearing message in the chat")
+	log.Printf("  POST /mark-read-before - Mark stored messages in a chat older than a timestamp as read")
+	log.Printf("  POST /star-message - Star or unstar a message")
+	log.Printf("  POST /delete - Delete a message for everyone or only for you")
+	log.Printf("  POST /edit - Edit the text of a message you sent")
+	log.Printf("  GET  /dedup/stats - Show incoming message dedup cache size")
+	log.Printf("  POST /dedup/clear - Flush the incoming message dedup cache")
+	log.Printf("  GET  /groups    - List the groups the account is a member of")
+	log.Printf("  GET  /groups/{jid} - Get cached group info (kept current by group_update events)")
+	log.Printf("  GET  /groups/{jid}/picture - Get the group icon URL (?download=true for the image, ?preview=true for a thumbnail)")
+	log.Printf("  GET  /newsletter/{jid}/metrics - Latest view and reaction counts of a channel's posts")
+	log.Printf("  POST /groups/{jid}/broadcast-location - Send a location to every group member individually")
+	log.Printf("  POST /group/{jid}/broadcast-location - Same as /groups/{jid}/broadcast-location")
+	log.Printf("  GET/POST /groups/{jid}/join-requests - List, approve or reject requests to join a group")
+	log.Printf("  POST /groups/{jid}/add-from-vcard - Add the phone numbers of a contact card to a group")
+	log.Printf("  POST /forward   - Forward a stored message without re-uploading its media")
+	log.Printf("  POST /chats/{jid}/download-media - Download all stored media of a chat as a background job")
+	log.Printf("  GET  /jobs/{id} - Status of a background job")
+	log.Printf("  GET  /media/export - Download the saved media of a chat as a zip archive")
+	log.Printf("  POST /media/reindex - Relink stored media messages with their downloaded files (?dry_run=true to only report)")
+	log.Printf("  GET  /stats     - Message counts and media volume over a period (?from=&to=&group_by=day)")
 	log.Printf("  GET  /swagger   - API documentation info")
 	log.Printf("  GET  /swagger.yaml - Full OpenAPI specification")
 